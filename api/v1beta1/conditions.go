@@ -0,0 +1,44 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+// Condition types of LokiRules and GlobalLokiRules
+const (
+	// ConditionValidated is true when the expressions and the tenant of the rules are valid
+	ConditionValidated = "Validated"
+	// ConditionSynced is true when the rules are stored in the ConfigMap or the Loki ruler
+	ConditionSynced = "Synced"
+	// ConditionReady is true when the current generation of the rules is validated and synced
+	ConditionReady = "Ready"
+)
+
+// Condition reasons of LokiRules and GlobalLokiRules
+const (
+	ReasonValid             = "Valid"
+	ReasonInvalidExpression = "InvalidExpression"
+	ReasonInvalidTenant     = "InvalidTenant"
+	ReasonEnforcementFailed = "EnforcementFailed"
+	ReasonLabelConflict     = "LabelConflict"
+	ReasonSynced            = "Synced"
+	ReasonSyncFailed        = "SyncFailed"
+	ReasonConfigMapConflict = "ConfigMapConflict"
+)
+
+// Condition reasons of LokiRulerTargets
+const (
+	ReasonInvalidTarget = "InvalidTarget"
+)
@@ -0,0 +1,76 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// DurationBounds are the minimum and maximum of the evaluation interval of the groups
+// and of the 'for' duration of the alerting rules. A zero bound is not checked.
+type DurationBounds struct {
+	MinInterval time.Duration
+	MaxInterval time.Duration
+	MinFor      time.Duration
+	MaxFor      time.Duration
+}
+
+// validateGroupInterval validates the interval of the group and normalizes it
+func (bounds DurationBounds) validateGroupInterval(group *LokiRuleGroup, path *field.Path) field.ErrorList {
+	if group.Interval == "" {
+		return nil
+	}
+	normalized, err := validateDuration(group.Interval, bounds.MinInterval, bounds.MaxInterval)
+	if err != nil {
+		return field.ErrorList{field.Invalid(path.Child("interval"), group.Interval, fmt.Sprintf("invalid interval '%s': %s", group.Interval, err.Error()))}
+	}
+	group.Interval = normalized
+	return nil
+}
+
+// validateFor validates the 'for' duration of the rule and normalizes it
+func (bounds DurationBounds) validateFor(rule *LokiGroupRule, path *field.Path) field.ErrorList {
+	if rule.For == "" || rule.Record != "" {
+		return nil
+	}
+	normalized, err := validateDuration(rule.For, bounds.MinFor, bounds.MaxFor)
+	if err != nil {
+		return field.ErrorList{field.Invalid(path.Child("for"), rule.For, fmt.Sprintf("invalid 'for' duration '%s': %s", rule.For, err.Error()))}
+	}
+	rule.For = normalized
+	return nil
+}
+
+// validateDuration parses the duration the way Prometheus does, e.g. '1h30m' or '90s',
+// checks it against the bounds and returns it in its canonical form
+func validateDuration(value string, min time.Duration, max time.Duration) (string, error) {
+	d, err := model.ParseDuration(value)
+	if err != nil {
+		return "", err
+	}
+	if min > 0 && time.Duration(d) < min {
+		return "", fmt.Errorf("should be at least %s", model.Duration(min))
+	}
+	if max > 0 && time.Duration(d) > max {
+		return "", fmt.Errorf("should be at most %s", model.Duration(max))
+	}
+	return d.String(), nil
+}
@@ -0,0 +1,101 @@
+package v1beta1
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestValidateDurations(t *testing.T) {
+	validator := &RuleValidator{Durations: DurationBounds{MinInterval: 30 * time.Second, MaxInterval: time.Hour, MaxFor: 24 * time.Hour}}
+
+	tests := []struct {
+		interval         string
+		forDuration      string
+		expectedInterval string
+		expectedFor      string
+		err              string
+	}{
+		{interval: "", forDuration: "", expectedInterval: "", expectedFor: ""},
+		{interval: "90s", forDuration: "1h0m", expectedInterval: "1m30s", expectedFor: "1h"},
+		{interval: "1m", forDuration: "0s", expectedInterval: "1m", expectedFor: "0s"},
+		{interval: "5 m", err: `test: invalid interval '5 m'`},
+		{forDuration: "10mins", err: `Errors: invalid 'for' duration '10mins'`},
+		{interval: "10s", err: `invalid interval '10s': should be at least 30s`},
+		{interval: "2h", err: `invalid interval '2h': should be at most 1h`},
+		{forDuration: "2d", err: `invalid 'for' duration '2d': should be at most 1d`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.interval+"/"+test.forDuration, func(t *testing.T) {
+			lokiRule := &GlobalLokiRule{Spec: GlobalLokiRuleSpec{Groups: []*LokiRuleGroup{{
+				Name:     "test",
+				Interval: test.interval,
+				Rules:    []*LokiGroupRule{{Alert: "Errors", Expr: `count_over_time({app="api"}[5m]) > 0`, For: test.forDuration}},
+			}}}}
+			spec, err := validator.ValidateGlobalLokiRule(lokiRule)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if interval := spec.Groups[0].Interval; interval != test.expectedInterval {
+				t.Fatalf("expected interval %q, got %q", test.expectedInterval, interval)
+			}
+			if forDuration := spec.Groups[0].Rules[0].For; forDuration != test.expectedFor {
+				t.Fatalf("expected for %q, got %q", test.expectedFor, forDuration)
+			}
+		})
+	}
+}
+
+func TestWebhookFieldErrors(t *testing.T) {
+	lokiRule := &LokiRule{Spec: LokiRuleSpec{Groups: []*LokiRuleGroup{{
+		Name:     "test",
+		Interval: "5 m",
+		Rules:    []*LokiGroupRule{{Alert: "Errors", Expr: `count_over_time({app="api"}[5m]) > 0`, For: "10mins"}},
+	}}}}
+	lokiRule.Name, lokiRule.Namespace = "api", "prod"
+	raw, err := json.Marshal(lokiRule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scheme := runtime.NewScheme()
+	if err := AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	hook := lokiRuleWebhook(&RuleValidator{})
+	if err := hook.InjectScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := hook.Handle(context.Background(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	}})
+	if resp.Allowed || resp.Result == nil || resp.Result.Reason != metav1.StatusReasonInvalid {
+		t.Fatalf("expected an Invalid response, got %+v", resp.Result)
+	}
+	causes := resp.Result.Details.Causes
+	expected := []string{"spec.groups[0].interval", "spec.groups[0].rules[0].for"}
+	if len(causes) != len(expected) {
+		t.Fatalf("expected %d causes, got %+v", len(expected), causes)
+	}
+	for i, path := range expected {
+		if causes[i].Field != path {
+			t.Fatalf("expected cause %d on %s, got %s", i, path, causes[i].Field)
+		}
+	}
+}
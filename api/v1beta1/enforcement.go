@@ -0,0 +1,129 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// DefaultNamespaceLabel is the stream label that holds the namespace of a log stream
+const DefaultNamespaceLabel = "namespace"
+
+// EnforcementPolicy selects the stream labels that are enforced on every stream selector
+// of the expressions of a LokiRule, so the rules can only read the log streams of their namespace
+type EnforcementPolicy struct {
+	// NamespaceLabel is the stream label that holds the namespace, defaults to 'namespace'
+	// +optional
+	NamespaceLabel string `json:"namespaceLabel,omitempty"`
+	// ExtraLabels are enforced with the value of a label or annotation of the namespace
+	// +optional
+	ExtraLabels []EnforcedLabel `json:"extraLabels,omitempty"`
+}
+
+// EnforcedLabel is a stream label enforced with the value of a label or annotation of the namespace.
+// Exactly one of FromLabel and FromAnnotation must be set.
+type EnforcedLabel struct {
+	// Name of the stream label, e.g. 'cluster'
+	Name string `json:"name"`
+	// FromLabel is the key of the namespace label that holds the value
+	// +optional
+	FromLabel string `json:"fromLabel,omitempty"`
+	// FromAnnotation is the key of the namespace annotation that holds the value
+	// +optional
+	FromAnnotation string `json:"fromAnnotation,omitempty"`
+}
+
+// EnforcedNamespaceLabel returns the stream label that holds the namespace
+func (p *EnforcementPolicy) EnforcedNamespaceLabel() string {
+	if p != nil && p.NamespaceLabel != "" {
+		return p.NamespaceLabel
+	}
+	return DefaultNamespaceLabel
+}
+
+// Matchers returns the matchers the policy enforces on the LokiRules of the namespace,
+// given the labels and annotations of the namespace. A nil policy only enforces the namespace.
+func (p *EnforcementPolicy) Matchers(namespace string, nsLabels map[string]string, nsAnnotations map[string]string) ([]*labels.Matcher, error) {
+	matchers := []*labels.Matcher{{Type: labels.MatchEqual, Name: p.EnforcedNamespaceLabel(), Value: namespace}}
+	if p == nil {
+		return matchers, nil
+	}
+
+	for _, label := range p.ExtraLabels {
+		var value string
+		var ok bool
+		switch {
+		case label.FromLabel != "" && label.FromAnnotation != "":
+			return nil, fmt.Errorf("only one of fromLabel and fromAnnotation can be set for label '%s'", label.Name)
+		case label.FromLabel != "":
+			if value, ok = nsLabels[label.FromLabel]; !ok {
+				return nil, fmt.Errorf("namespace '%s' is missing label '%s' to enforce '%s'", namespace, label.FromLabel, label.Name)
+			}
+		case label.FromAnnotation != "":
+			if value, ok = nsAnnotations[label.FromAnnotation]; !ok {
+				return nil, fmt.Errorf("namespace '%s' is missing annotation '%s' to enforce '%s'", namespace, label.FromAnnotation, label.Name)
+			}
+		default:
+			return nil, fmt.Errorf("one of fromLabel or fromAnnotation should be set for label '%s'", label.Name)
+		}
+		if label.Name == p.EnforcedNamespaceLabel() {
+			return nil, fmt.Errorf("label '%s' is already enforced with the namespace", label.Name)
+		}
+		matchers = append(matchers, &labels.Matcher{Type: labels.MatchEqual, Name: label.Name, Value: value})
+	}
+	return matchers, nil
+}
+
+// Enforce validates the expressions of the LokiRule and enforces the stream labels of the policy
+// on them, with the values of the namespace of the rule. The expressions may also select the granted
+// namespaces, see LokiRuleGrant. The durations are validated against the bounds.
+// It returns the condition reason on failure.
+func (p *EnforcementPolicy) Enforce(lokiRule *LokiRule, ns *corev1.Namespace, granted []string, durations DurationBounds) (*LokiRuleSpec, string, error) {
+	matchers, err := p.Matchers(ns.Name, ns.Labels, ns.Annotations)
+	if err != nil {
+		return nil, ReasonEnforcementFailed, err
+	}
+	spec, err := lokiRule.ValidateExpressionsWith(matchers, map[string][]string{p.EnforcedNamespaceLabel(): granted}, durations)
+	if err != nil {
+		return nil, ReasonInvalidExpression, err
+	}
+	// The extra labels are enforced with the values of the namespace of the rule, a selector of a granted
+	// namespace would only match the streams of the granted namespace that have the same values
+	if len(granted) > 0 && len(matchers) > 1 {
+		if _, err := lokiRule.ValidateExpressionsWith(matchers, nil, durations); err != nil {
+			return nil, ReasonEnforcementFailed, fmt.Errorf("granted namespaces can't be selected while %s enforced with the values of namespace '%s': %s",
+				extraLabelNames(matchers[1:]), ns.Name, err.Error())
+		}
+	}
+	return spec, "", nil
+}
+
+// extraLabelNames returns the quoted names of the enforced extra labels for messages
+func extraLabelNames(matchers []*labels.Matcher) string {
+	names := make([]string, 0, len(matchers))
+	for _, matcher := range matchers {
+		names = append(names, "'"+matcher.Name+"'")
+	}
+	if len(names) == 1 {
+		return "label " + names[0] + " is"
+	}
+	return "labels " + strings.Join(names, ", ") + " are"
+}
@@ -0,0 +1,159 @@
+package v1beta1
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestEnforcementPolicy(t *testing.T) {
+	policy := &EnforcementPolicy{
+		NamespaceLabel: "k8s_namespace",
+		ExtraLabels: []EnforcedLabel{
+			{Name: "cluster", FromLabel: "cluster"},
+			{Name: "team", FromAnnotation: "example.com/team"},
+		},
+	}
+	nsLabels := map[string]string{"cluster": "eu-1"}
+	nsAnnotations := map[string]string{"example.com/team": "payments"}
+
+	tests := []struct {
+		query    string
+		expected string
+		err      string
+	}{
+		{
+			query:    `count_over_time({app="api"}[5m]) > 0`,
+			expected: `count_over_time({app="api", k8s_namespace="prod", cluster="eu-1", team="payments"}[5m]) > 0`,
+		},
+		{
+			query:    `count_over_time({app="api", namespace="other", team="payments"}[5m])`,
+			expected: `count_over_time({app="api", namespace="other", k8s_namespace="prod", cluster="eu-1", team="payments"}[5m])`,
+		},
+		{query: `{app="api", k8s_namespace="dev"}`, err: `'k8s_namespace' selector should equals 'prod'`},
+		{query: `{app="api", cluster=~"eu-.*"}`, err: `'cluster' selector should equals 'eu-1'`},
+		{query: `{app="api", team!="payments"}`, err: `'team' selector should equals 'payments'`},
+	}
+
+	matchers, err := policy.Matchers("prod", nsLabels, nsAnnotations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			lokiRule := &LokiRule{Spec: LokiRuleSpec{Groups: []*LokiRuleGroup{{
+				Name:  "test",
+				Rules: []*LokiGroupRule{{Alert: "Test", Expr: test.query}},
+			}}}}
+			spec, err := lokiRule.ValidateExpressionsWith(matchers, nil, DurationBounds{})
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expr := spec.Groups[0].Rules[0].Expr; expr != test.expected {
+				t.Fatalf("expected %s, got %s", test.expected, expr)
+			}
+		})
+	}
+
+	if _, err := policy.Matchers("prod", nil, nsAnnotations); err == nil || !strings.Contains(err.Error(), "missing label 'cluster'") {
+		t.Fatalf("expected an error for the missing namespace label, got %v", err)
+	}
+	if _, err := policy.Matchers("prod", nsLabels, nil); err == nil || !strings.Contains(err.Error(), "missing annotation 'example.com/team'") {
+		t.Fatalf("expected an error for the missing namespace annotation, got %v", err)
+	}
+
+	// Without a policy only the namespace is enforced
+	matchers, err = (*EnforcementPolicy)(nil).Matchers("prod", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matchers) != 1 || matchers[0].String() != `namespace="prod"` {
+		t.Fatalf("expected only the namespace matcher, got %v", matchers)
+	}
+}
+
+// testLokiRule returns a LokiRule in namespace 'app' with a single alert
+func testLokiRule(expr string) *LokiRule {
+	lokiRule := &LokiRule{Spec: LokiRuleSpec{Groups: []*LokiRuleGroup{{
+		Name:  "test",
+		Rules: []*LokiGroupRule{{Alert: "Errors", Expr: expr}},
+	}}}}
+	lokiRule.Name, lokiRule.Namespace = "test", "app"
+	return lokiRule
+}
+
+// The extra labels are enforced with the values of the namespace of the rule, a rule that selects
+// a granted namespace is rejected instead of silently matching no streams
+func TestEnforcementPolicyGrantedWithExtraLabels(t *testing.T) {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "app", Labels: map[string]string{"cluster": "eu-1"}}}
+	extraLabels := &EnforcementPolicy{ExtraLabels: []EnforcedLabel{{Name: "cluster", FromLabel: "cluster"}}}
+	granted := []string{"ingress"}
+
+	// Without extra labels the granted namespace can be selected
+	spec, _, err := (*EnforcementPolicy)(nil).Enforce(testLokiRule(`count_over_time({namespace="ingress"}[5m]) > 0`), ns, granted, DurationBounds{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expr := spec.Groups[0].Rules[0].Expr; expr != `count_over_time({namespace="ingress"}[5m]) > 0` {
+		t.Fatalf("expected the granted namespace to be selected, got %s", expr)
+	}
+
+	// The rules of the namespace itself are still valid with a grant and extra labels
+	spec, _, err = extraLabels.Enforce(testLokiRule(`count_over_time({app="api"}[5m]) > 0`), ns, granted, DurationBounds{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expr := spec.Groups[0].Rules[0].Expr; expr != `count_over_time({app="api", namespace="app", cluster="eu-1"}[5m]) > 0` {
+		t.Fatalf("expected the namespace and cluster to be enforced, got %s", expr)
+	}
+
+	_, reason, err := extraLabels.Enforce(testLokiRule(`count_over_time({namespace="ingress"}[5m]) > 0`), ns, granted, DurationBounds{})
+	if reason != ReasonEnforcementFailed || err == nil ||
+		!strings.Contains(err.Error(), "granted namespaces can't be selected while label 'cluster' is enforced with the values of namespace 'app'") {
+		t.Fatalf("expected the granted namespace to be rejected, got %s: %v", reason, err)
+	}
+}
+
+// The webhook enforces the same policies as the LokiRule controller, including those of the LokiRulerTargets
+func TestRuleValidatorEnforcement(t *testing.T) {
+	validator := &RuleValidator{
+		Enforcement: &EnforcementPolicy{ExtraLabels: []EnforcedLabel{{Name: "cluster", FromLabel: "cluster"}}},
+		Namespace: func(name string) (*corev1.Namespace, error) {
+			return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"cluster": "eu-1"}}}, nil
+		},
+		GrantedNamespaces: func(namespace string) ([]string, error) {
+			return []string{"ingress"}, nil
+		},
+	}
+
+	spec, err := validator.ValidateLokiRule(testLokiRule(`count_over_time({app="api"}[5m]) > 0`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expr := spec.Groups[0].Rules[0].Expr; expr != `count_over_time({app="api", namespace="app", cluster="eu-1"}[5m]) > 0` {
+		t.Fatalf("expected the namespace and cluster to be enforced, got %s", expr)
+	}
+	if _, err := validator.ValidateLokiRule(testLokiRule(`count_over_time({app="api", cluster="us-1"}[5m]) > 0`)); err == nil {
+		t.Fatal("expected the rule to be rejected for selecting another cluster")
+	}
+	if _, err := validator.ValidateLokiRule(testLokiRule(`count_over_time({namespace="ingress"}[5m]) > 0`)); err == nil ||
+		!strings.Contains(err.Error(), "granted namespaces can't be selected") {
+		t.Fatalf("expected the granted namespace to be rejected, got %v", err)
+	}
+
+	validator.TargetEnforcements = func(lokiRule *LokiRule) (map[string]*EnforcementPolicy, error) {
+		return map[string]*EnforcementPolicy{"eu": {ExtraLabels: []EnforcedLabel{{Name: "team", FromAnnotation: "example.com/team"}}}}, nil
+	}
+	if _, err := validator.ValidateLokiRule(testLokiRule(`count_over_time({app="api"}[5m]) > 0`)); err == nil ||
+		!strings.Contains(err.Error(), "LokiRulerTarget eu: namespace 'app' is missing annotation 'example.com/team'") {
+		t.Fatalf("expected the rule to be rejected by the policy of the target, got %v", err)
+	}
+}
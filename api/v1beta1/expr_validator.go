@@ -1,213 +1,407 @@
 package v1beta1
 
 import (
+	goerrors "errors"
 	"fmt"
-	"reflect"
-	"unsafe"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
 
 	"github.com/grafana/loki/pkg/logql"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/pkg/labels"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 )
 
-// ValidateExpressions validates the expressions of the rules
-func (lokiRule *GlobalLokiRule) ValidateExpressions() (*GlobalLokiRuleSpec, error) {
+// ValidateExpressions validates the expressions, labels and annotations of the rules
+// and the durations against the bounds
+func (lokiRule *GlobalLokiRule) ValidateExpressions(durations DurationBounds) (spec *GlobalLokiRuleSpec, err error) {
+	defer recoverValidation(&err)
 	specCopy := lokiRule.Spec.DeepCopy()
-	for _, group := range specCopy.Groups {
-		for _, rule := range group.Rules {
-			alertName := rule.Expr
-			if rule.Alert != "" {
-				alertName = rule.Alert
-			}
+	if err := validateGroups(specCopy.Groups, durations, nil); err != nil {
+		return nil, err
+	}
+	return specCopy, nil
+}
 
-			// validate expression
-			expr, err := logql.ParseExpr(rule.Expr)
-			if err != nil {
-				return nil, fmt.Errorf("%s: %s", alertName, err.Error())
-			}
+// ValidateExpressionsWith validates the expressions, labels and annotations of the rules
+// and enforces the matchers on the expressions, see EnforcementPolicy. Granted are the
+// other values a stream selector may select for an enforced label. The durations are
+// validated against the bounds.
+func (lokiRule *LokiRule) ValidateExpressionsWith(enforced []*labels.Matcher, granted map[string][]string, durations DurationBounds) (spec *LokiRuleSpec, err error) {
+	defer recoverValidation(&err)
+	specCopy := lokiRule.Spec.DeepCopy()
+	enforce := func(query string) (logql.Expr, error) {
+		return enforceLabels(enforced, granted, query)
+	}
+	if err := validateGroups(specCopy.Groups, durations, enforce); err != nil {
+		return nil, err
+	}
+	return specCopy, nil
+}
 
-			rule.Expr = expr.String()
-		}
+// RuleError is an invalid field of a rule
+type RuleError struct {
+	// Rule is the name of the alerting or recording rule, or of the group for errors of the group
+	Rule string
+	// Field is the invalid field, with its path, e.g. spec.groups[0].rules[1].expr
+	Field *field.Error
+}
+
+// RuleErrors are the errors of all the rules of a LokiRule or GlobalLokiRule
+type RuleErrors []RuleError
+
+func (e RuleErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", err.Rule, err.Field.Detail))
 	}
+	return strings.Join(msgs, "; ")
+}
 
-	return specCopy, nil
+// FieldErrors returns the errors with the paths of the invalid fields
+func (e RuleErrors) FieldErrors() field.ErrorList {
+	errs := make(field.ErrorList, 0, len(e))
+	for _, err := range e {
+		errs = append(errs, err.Field)
+	}
+	return errs
 }
 
-// ValidateExpressions validates the expressions of the rules
-func (lokiRule *LokiRule) ValidateExpressions() (*LokiRuleSpec, error) {
-	specCopy := lokiRule.Spec.DeepCopy()
-	for _, group := range specCopy.Groups {
-		for _, rule := range group.Rules {
-			alertName := rule.Expr
-			if rule.Alert != "" {
-				alertName = rule.Alert
-			}
+// invalidError returns RuleErrors as an Invalid API error, so the webhook response
+// contains the paths of the invalid fields
+func invalidError(kind string, name string, err error) error {
+	var errs RuleErrors
+	if goerrors.As(err, &errs) {
+		return apierrors.NewInvalid(GroupVersion.WithKind(kind).GroupKind(), name, errs.FieldErrors())
+	}
+	return err
+}
 
-			// validate expression
-			expr, err := logql.ParseExpr(rule.Expr)
-			if err != nil {
-				return nil, fmt.Errorf("%s: %s", alertName, err.Error())
-			}
-			if err := enforceNode(lokiRule.Namespace, expr); err != nil {
-				return nil, fmt.Errorf("%s: %s", alertName, err.Error())
+// validateGroups validates the rules of the groups and returns the errors of all rules as RuleErrors.
+// The expressions are replaced with the result of enforce, or are formatted when enforce is nil.
+func validateGroups(groups []*LokiRuleGroup, durations DurationBounds, enforce func(query string) (logql.Expr, error)) error {
+	var errs RuleErrors
+	path := field.NewPath("spec", "groups")
+	for i, group := range groups {
+		for _, err := range durations.validateGroupInterval(group, path.Index(i)) {
+			errs = append(errs, RuleError{Rule: group.Name, Field: err})
+		}
+		for j, rule := range group.Rules {
+			for _, err := range validateRule(rule, path.Index(i).Child("rules").Index(j), durations, enforce) {
+				errs = append(errs, RuleError{Rule: rule.Name(), Field: err})
 			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
 
+// validateRule validates the expression, labels and annotations of the rule and returns all its errors
+func validateRule(rule *LokiGroupRule, path *field.Path, durations DurationBounds, enforce func(query string) (logql.Expr, error)) field.ErrorList {
+	var errs field.ErrorList
+	expr, err := logql.ParseExpr(rule.Expr)
+	if err != nil {
+		errs = append(errs, field.Invalid(path.Child("expr"), rule.Expr, err.Error()))
+	} else {
+		errs = append(errs, validateRuleType(rule, expr, path)...)
+		if enforce != nil {
+			expr, err = enforce(rule.Expr)
+		}
+		if err != nil {
+			errs = append(errs, field.Invalid(path.Child("expr"), rule.Expr, err.Error()))
+		} else {
 			rule.Expr = expr.String()
 		}
 	}
+	errs = append(errs, durations.validateFor(rule, path)...)
+	errs = append(errs, validateLabels(rule, path)...)
+	errs = append(errs, validateTemplates(rule, path)...)
+	return errs
+}
 
-	return specCopy, nil
+// recoverValidation turns a panic during validation into an error,
+// so a single bad rule can't take down the manager or the webhook
+func recoverValidation(err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("unable to validate rules: %v", r)
+	}
 }
 
-// EnforceNode walks the given node recursively
-// and enforces the given label enforcer on it.
-//
-// Whenever a parser.MatrixSelector or parser.VectorSelector AST node is found,
-// their label enforcer is being potentially modified.
-// If a node's label matcher has the same name as a label matcher
-// of the given enforcer, then it will be replaced.
-func enforceNode(ns string, node logql.Expr) error {
-	t := getType(node)
-	switch t {
-	case "*matchersExpr":
-		rs := reflect.ValueOf(node).Elem()
-		rf := rs.FieldByName("matchers")
-		re := reflect.NewAt(rf.Type(), unsafe.Pointer(rf.UnsafeAddr())).Elem()
-		matchers := re.Interface().([]*labels.Matcher)
-		enforcedMatchers, err := enforceMatchers(ns, matchers)
+// Name returns the name used to identify the rule in messages: the alert or record,
+// or the expression of a rule that has neither
+func (rule *LokiGroupRule) Name() string {
+	if rule.Alert != "" {
+		return rule.Alert
+	}
+	if rule.Record != "" {
+		return rule.Record
+	}
+	return rule.Expr
+}
+
+// validateRuleType validates that the rule is either an alerting or a recording rule.
+// Recording rules must produce a metric, so they need a sample expression and
+// don't support 'for' or 'annotations'.
+func validateRuleType(rule *LokiGroupRule, expr logql.Expr, path *field.Path) field.ErrorList {
+	if rule.Alert != "" && rule.Record != "" {
+		return field.ErrorList{field.Invalid(path.Child("record"), rule.Record, "only one of 'alert' and 'record' can be set")}
+	}
+	if rule.Alert == "" && rule.Record == "" {
+		return field.ErrorList{field.Required(path.Child("alert"), "one of 'alert' or 'record' should be set")}
+	}
+	if rule.Record == "" {
+		return nil
+	}
+
+	var errs field.ErrorList
+	if !model.IsValidMetricName(model.LabelValue(rule.Record)) {
+		errs = append(errs, field.Invalid(path.Child("record"), rule.Record, fmt.Sprintf("invalid recording rule name '%s'", rule.Record)))
+	}
+	if rule.For != "" {
+		errs = append(errs, field.Forbidden(path.Child("for"), "'for' is not allowed on recording rules"))
+	}
+	if len(rule.Annotations) > 0 {
+		errs = append(errs, field.Forbidden(path.Child("annotations"), "'annotations' are not allowed on recording rules"))
+	}
+	if _, ok := expr.(logql.SampleExpr); !ok {
+		errs = append(errs, field.Invalid(path.Child("expr"), rule.Expr, "recording rules require a metric query, got a log query"))
+	}
+	return errs
+}
+
+// enforceLabels enforces the matchers on every stream selector of the expression
+// and returns the resulting expression.
+func enforceLabels(enforced []*labels.Matcher, granted map[string][]string, query string) (logql.Expr, error) {
+	result, err := walkSelectors(query, func(sel *streamSelector) error {
+		matchers, err := enforceMatchers(enforced, granted, sel)
 		if err != nil {
 			return err
 		}
-		re.Set(reflect.ValueOf(enforcedMatchers))
+		sel.Matchers = matchers
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	case "*filterExpr":
-		rs := reflect.ValueOf(node).Elem()
-		rf := rs.FieldByName("left")
-		re := reflect.NewAt(rf.Type(), unsafe.Pointer(rf.UnsafeAddr())).Elem()
-		expr := re.Interface().(logql.Expr)
-		if err := enforceNode(ns, expr); err != nil {
-			return err
-		}
+	expr, err := logql.ParseExpr(result)
+	if err != nil {
+		return nil, fmt.Errorf("unable to enforce namespace on expression: %s", err.Error())
+	}
+	return expr, nil
+}
 
-	case "*rangeAggregationExpr":
-		rs := reflect.ValueOf(node).Elem()
-		rf := rs.FieldByName("left")
-		re := reflect.NewAt(rf.Type(), unsafe.Pointer(rf.UnsafeAddr())).Elem()
-		left := re.Interface()
+// enforceMatchers replaces the matchers of the enforced labels with the enforced matchers.
+// A selector can only match an enforced label when the matcher can only select the enforced
+// value within the enforced selector: an equality on the value, a regex that only matches the
+// value, or a negative matcher that doesn't exclude the value. These are rewritten to the
+// canonical equality, any other matcher is rejected with its position in the expression.
+//
+// Equalities and regexes may also select the granted values of the label, these are rewritten
+// to an equality on the selected value or a regex of the selected values.
+func enforceMatchers(enforced []*labels.Matcher, granted map[string][]string, sel *streamSelector) ([]*labels.Matcher, error) {
+	var res []*labels.Matcher
+	selected := map[string][]string{}
+	var negative []int
 
-		leftType := getType(left)
-		if leftType == "*logRange" {
-			if err := enforceRange(ns, left); err != nil {
-				return err
-			}
-		} else {
-			if err := enforceNode(ns, left.(logql.Expr)); err != nil {
-				return err
-			}
+	for i, target := range sel.Matchers {
+		matcher := findMatcher(enforced, target.Name)
+		if matcher == nil {
+			res = append(res, target)
+			continue
 		}
-
-	case "*vectorAggregationExpr":
-		rs := reflect.ValueOf(node).Elem()
-		rf := rs.FieldByName("left")
-		re := reflect.NewAt(rf.Type(), unsafe.Pointer(rf.UnsafeAddr())).Elem()
-		left := re.Interface()
-
-		leftType := getType(left)
-		if leftType == "*logRange" {
-			if err := enforceRange(ns, left); err != nil {
-				return err
-			}
-		} else {
-			if err := enforceNode(ns, left.(logql.Expr)); err != nil {
-				return err
-			}
+		if target.Type == labels.MatchNotEqual || target.Type == labels.MatchNotRegexp {
+			negative = append(negative, i)
+			continue
 		}
 
-	case "*pipelineExpr":
-		rs := reflect.ValueOf(node).Elem()
-		rf := rs.FieldByName("left")
-		re := reflect.NewAt(rf.Type(), unsafe.Pointer(rf.UnsafeAddr())).Elem()
-		left := re.Interface()
+		values, ok := selectedValues(target, append([]string{matcher.Value}, granted[matcher.Name]...))
+		if previous, constrained := selected[target.Name]; ok && constrained {
+			values = intersect(previous, values)
+		}
+		if !ok || len(values) == 0 {
+			return nil, enforceError(matcher, granted[matcher.Name], target, sel.position(i))
+		}
+		selected[target.Name] = values
+	}
 
-		leftType := getType(left)
-		if leftType == "*logRange" {
-			if err := enforceRange(ns, left); err != nil {
-				return err
-			}
-		} else {
-			if err := enforceNode(ns, left.(logql.Expr)); err != nil {
-				return err
+	for _, matcher := range enforced {
+		values, ok := selected[matcher.Name]
+		if !ok {
+			values = []string{matcher.Value}
+		}
+		for _, i := range negative {
+			if target := sel.Matchers[i]; target.Name == matcher.Name {
+				if values = filterValues(values, target); len(values) == 0 {
+					return nil, enforceError(matcher, granted[matcher.Name], target, sel.position(i))
+				}
 			}
 		}
+		res = append(res, valuesMatcher(matcher.Name, values))
+	}
+
+	return res, nil
+}
 
-	case "*binOpExpr":
-		rs := reflect.ValueOf(node).Elem()
-		rf := rs.FieldByName("SampleExpr")
-		re := reflect.NewAt(rf.Type(), unsafe.Pointer(rf.UnsafeAddr())).Elem()
-		left := re.Interface()
+// enforceError returns the error for a matcher that could select other values than the enforced or granted values
+func enforceError(matcher *labels.Matcher, granted []string, target *labels.Matcher, pos int) error {
+	if len(granted) == 0 {
+		return fmt.Errorf("'%s' selector should equals '%s', got %s at position %d", matcher.Name, matcher.Value, target, pos)
+	}
+	return fmt.Errorf("'%s' selector should only select '%s' or the granted '%s', got %s at position %d",
+		matcher.Name, matcher.Value, strings.Join(granted, "', '"), target, pos)
+}
 
-		leftType := getType(left)
-		if leftType == "*logRange" {
-			if err := enforceRange(ns, left); err != nil {
-				return err
-			}
-		} else {
-			if err := enforceNode(ns, left.(logql.Expr)); err != nil {
-				return err
-			}
+// selectedValues returns the allowed values an equality or regex matcher selects,
+// or false when it could select other values
+func selectedValues(matcher *labels.Matcher, allowed []string) ([]string, bool) {
+	var values []string
+	switch matcher.Type {
+	case labels.MatchEqual:
+		values = []string{matcher.Value}
+	case labels.MatchRegexp:
+		var ok bool
+		if values, ok = regexLiterals(matcher.Value); !ok {
+			return nil, false
 		}
-
 	default:
-		panic(fmt.Errorf("parser.Walk: unhandled node type %s", t))
+		return nil, false
 	}
 
-	return nil
+	var res []string
+	for _, value := range values {
+		if !containsValue(allowed, value) {
+			return nil, false
+		}
+		if !containsValue(res, value) {
+			res = append(res, value)
+		}
+	}
+	return res, true
 }
 
-func enforceRange(ns string, logRange interface{}) error {
-	rs := reflect.ValueOf(logRange).Elem()
-	rf := rs.FieldByName("left")
-	re := reflect.NewAt(rf.Type(), unsafe.Pointer(rf.UnsafeAddr())).Elem()
-	left := re.Interface()
-	leftType := getType(left)
-	if leftType == "*logRange" {
-		if err := enforceRange(ns, left); err != nil {
-			return err
-		}
-	} else {
-		if err := enforceNode(ns, left.(logql.Expr)); err != nil {
-			return err
+// filterValues returns the values the (negative) matcher matches
+func filterValues(values []string, matcher *labels.Matcher) []string {
+	m, err := labels.NewMatcher(matcher.Type, matcher.Name, matcher.Value)
+	if err != nil {
+		return nil
+	}
+	var res []string
+	for _, value := range values {
+		if m.Matches(value) {
+			res = append(res, value)
 		}
 	}
-	return nil
+	return res
 }
 
-func enforceMatchers(ns string, targets []*labels.Matcher) ([]*labels.Matcher, error) {
-	var res []*labels.Matcher
+// valuesMatcher returns the canonical matcher that selects the values
+func valuesMatcher(name string, values []string) *labels.Matcher {
+	if len(values) == 1 {
+		return &labels.Matcher{Type: labels.MatchEqual, Name: name, Value: values[0]}
+	}
+	sorted := make([]string, 0, len(values))
+	for _, value := range values {
+		sorted = append(sorted, regexp.QuoteMeta(value))
+	}
+	sort.Strings(sorted)
+	return labels.MustNewMatcher(labels.MatchRegexp, name, strings.Join(sorted, "|"))
+}
 
-	for _, target := range targets {
-		if target.Name == "namespace" {
-			if target.Type != labels.MatchEqual || target.Value != ns {
-				return nil, fmt.Errorf("'namespace' selector should equals '%s'", ns)
-			}
-		} else {
-			res = append(res, target)
+func intersect(a []string, b []string) []string {
+	var res []string
+	for _, value := range a {
+		if containsValue(b, value) {
+			res = append(res, value)
 		}
 	}
+	return res
+}
 
-	nsMatcher := &labels.Matcher{
-		Name:  "namespace",
-		Type:  labels.MatchEqual,
-		Value: ns,
+func containsValue(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
 	}
-	res = append(res, nsMatcher)
+	return false
+}
 
-	return res, nil
+// maxRegexLiterals limits the number of values a regex is expanded to
+const maxRegexLiterals = 64
+
+// regexLiterals returns the values a (fully anchored) label regex matches,
+// when it only matches a small, finite set of values
+func regexLiterals(re string) ([]string, bool) {
+	parsed, err := syntax.Parse("^(?:"+re+")$", syntax.Perl)
+	if err != nil {
+		return nil, false
+	}
+	return expandRegex(parsed.Simplify())
+}
+
+func expandRegex(re *syntax.Regexp) ([]string, bool) {
+	switch re.Op {
+	case syntax.OpEmptyMatch, syntax.OpBeginText, syntax.OpEndText, syntax.OpBeginLine, syntax.OpEndLine:
+		return []string{""}, true
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return nil, false
+		}
+		return []string{string(re.Rune)}, true
+	case syntax.OpCharClass:
+		var values []string
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			for r := re.Rune[i]; r <= re.Rune[i+1]; r++ {
+				if len(values) >= maxRegexLiterals {
+					return nil, false
+				}
+				values = append(values, string(r))
+			}
+		}
+		return values, true
+	case syntax.OpCapture:
+		return expandRegex(re.Sub[0])
+	case syntax.OpAlternate:
+		var values []string
+		for _, sub := range re.Sub {
+			subValues, ok := expandRegex(sub)
+			if !ok || len(values)+len(subValues) > maxRegexLiterals {
+				return nil, false
+			}
+			values = append(values, subValues...)
+		}
+		return values, true
+	case syntax.OpConcat:
+		values := []string{""}
+		for _, sub := range re.Sub {
+			subValues, ok := expandRegex(sub)
+			if !ok || len(values)*len(subValues) > maxRegexLiterals {
+				return nil, false
+			}
+			var concat []string
+			for _, prefix := range values {
+				for _, suffix := range subValues {
+					concat = append(concat, prefix+suffix)
+				}
+			}
+			values = concat
+		}
+		return values, true
+	}
+	return nil, false
 }
 
-func getType(myvar interface{}) string {
-	t := reflect.TypeOf(myvar)
-	if t.Kind() == reflect.Ptr {
-		return "*" + t.Elem().Name()
+func findMatcher(matchers []*labels.Matcher, name string) *labels.Matcher {
+	for _, matcher := range matchers {
+		if matcher.Name == name {
+			return matcher
+		}
 	}
-	return t.Name()
+	return nil
 }
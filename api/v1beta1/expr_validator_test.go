@@ -0,0 +1,298 @@
+package v1beta1
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// alertCorpus contains real-world alert and recording expressions
+var alertCorpus = []string{
+	`{namespace="prod"}`,
+	`{app="nginx"} |= "error"`,
+	`{app="nginx"} |= "error" != "timeout" |~ "5\\d\\d" !~ "GET /healthz"`,
+	`count_over_time({app="nginx"}[5m]) > 0`,
+	`sum by (cluster, job, pod) (count_over_time({namespace="prod"} |~ "http(s?)://(\\w+):(\\w+)@" [5m]) > 0)`,
+	`sum(rate({app="api"} |= "panic" [1m])) by (pod) > 0`,
+	`sum(rate({app="api", container!="istio-proxy"}[5m])) by (pod) / sum(rate({app="api"}[5m])) by (pod) > 0.05`,
+	`topk(10, sum by (path) (rate({app="nginx"} | json | status >= 500 [5m])))`,
+	`bottomk(3, sum by (pod) (bytes_over_time({app="nginx"}[1h])))`,
+	`sum by (pod) (bytes_rate({app=~"nginx|envoy"}[5m])) > 1e6`,
+	`quantile_over_time(0.99, {app="api"} | logfmt | unwrap duration(latency) [5m]) by (route) > 2`,
+	`avg_over_time({app="api"} | json | unwrap response_time [10m]) by (pod)`,
+	`sum_over_time({app="api"} | regexp "(?P<method>\\w+) (?P<path>[\\w/]+) (?P<status>\\d+)" | unwrap status [1m])`,
+	`count_over_time({app="api"} | json | line_format "{{.level}}: {{.msg}}" |= "fatal" [5m]) > 0`,
+	`count_over_time({app="api"} | logfmt | label_format level="{{ .lvl | upper }}" | level="ERROR" [5m])`,
+	"count_over_time({app=\"api\"} |~ `\\d{3} \\{\\}` [5m]) > 10",
+	`count_over_time({app="api"}[5m]) > 1 and count_over_time({app="worker"}[5m]) > 1`,
+	`count_over_time({app="api"}[5m]) or count_over_time({app="worker"}[5m])`,
+	`(count_over_time({app="api"}[5m]) * 2) - count_over_time({app="api"}[10m])`,
+	`1 + 1`,
+	`max without (instance) (count_over_time({app="api"} |= "OOMKilled" [15m])) >= bool 1`,
+}
+
+// prodNamespace enforces the namespace "prod" on the stream selectors
+var prodNamespace = []*labels.Matcher{{Type: labels.MatchEqual, Name: "namespace", Value: "prod"}}
+
+// selectorMatchers returns the matchers of every stream selector of the expression
+func selectorMatchers(t *testing.T, query string) [][]*labels.Matcher {
+	selectors, err := findSelectors(query)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	var matchers [][]*labels.Matcher
+	for _, sel := range selectors {
+		matchers = append(matchers, sel.Matchers)
+	}
+	return matchers
+}
+
+func TestEnforceNamespaceCorpus(t *testing.T) {
+	for _, query := range alertCorpus {
+		t.Run(query, func(t *testing.T) {
+			expr, err := enforceLabels(prodNamespace, nil, query)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			before := selectorMatchers(t, query)
+			after := selectorMatchers(t, expr.String())
+			if len(before) != len(after) {
+				t.Fatalf("expected %d stream selectors, got %d in %s", len(before), len(after), expr.String())
+			}
+			for _, matchers := range after {
+				namespaces := 0
+				for _, matcher := range matchers {
+					if matcher.Name != "namespace" {
+						continue
+					}
+					namespaces++
+					if matcher.Type != labels.MatchEqual || matcher.Value != "prod" {
+						t.Fatalf("expected namespace=\"prod\", got %s in %s", matcher, expr.String())
+					}
+				}
+				if namespaces != 1 {
+					t.Fatalf("expected exactly one namespace matcher, got %d in %s", namespaces, expr.String())
+				}
+			}
+		})
+	}
+}
+
+func TestEnforceNamespaceIsIdempotent(t *testing.T) {
+	for _, query := range alertCorpus {
+		first, err := enforceLabels(prodNamespace, nil, query)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		second, err := enforceLabels(prodNamespace, nil, first.String())
+		if err != nil {
+			t.Fatalf("%s: %v", first.String(), err)
+		}
+		if first.String() != second.String() {
+			t.Fatalf("expected %s, got %s", first.String(), second.String())
+		}
+	}
+}
+
+func TestEnforceNamespaceErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		err   string
+	}{
+		{`{namespace="dev"}`, `'namespace' selector should equals 'prod', got namespace="dev" at position 1`},
+		{`count_over_time({namespace=~"prod|dev"}[5m])`, `'namespace' selector should equals 'prod', got namespace=~"prod|dev" at position 17`},
+		{`count_over_time({app="api"}[5m]) / count_over_time({app="api", namespace!="prod"}[5m])`, `got namespace!="prod" at position 63`},
+		{`{namespace=~".*"}`, `got namespace=~".*" at position 1`},
+		{`{namespace=~"(?i)prod"}`, `got namespace=~"(?i)prod" at position 1`},
+		{`{namespace!~"pro.*"}`, `got namespace!~"pro.*" at position 1`},
+		{`count_over_time({app="api"} |= "}" [5m]) > 0 }`, `unexpected '}'`},
+		{`count_over_time({app="api", {pod="x"}}[5m])`, `unexpected '{'`},
+		{`{app="api"`, `unclosed stream selector`},
+		{`{app="api"} |= "unterminated`, `literal not terminated`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			_, err := enforceLabels(prodNamespace, nil, test.query)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error containing %q, got %q", test.err, err.Error())
+			}
+		})
+	}
+}
+
+func TestEnforceNamespaceCanonical(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{`{namespace="prod"}`, `{namespace="prod"}`},
+		{`{namespace=~"prod"}`, `{namespace="prod"}`},
+		{`{namespace=~"^prod$"}`, `{namespace="prod"}`},
+		{`{namespace=~"(prod)|prod"}`, `{namespace="prod"}`},
+		{`{app="api", namespace!="kube-system"}`, `{app="api", namespace="prod"}`},
+		{`{namespace!~"kube-.*", app="api"}`, `{app="api", namespace="prod"}`},
+		{`{namespace!="", namespace=~"prod"}`, `{namespace="prod"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			expr, err := enforceLabels(prodNamespace, nil, test.query)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if expr.String() != test.expected {
+				t.Fatalf("expected %s, got %s", test.expected, expr.String())
+			}
+		})
+	}
+}
+
+func TestEnforceNamespaceGrants(t *testing.T) {
+	enforced := []*labels.Matcher{{Type: labels.MatchEqual, Name: "namespace", Value: "app"}}
+	granted := map[string][]string{"namespace": {"ingress", "monitoring"}}
+	tests := []struct {
+		query    string
+		expected string
+		err      string
+	}{
+		{query: `{app="api"}`, expected: `{app="api", namespace="app"}`},
+		{query: `{namespace="ingress"}`, expected: `{namespace="ingress"}`},
+		{query: `{namespace=~"app|ingress"}`, expected: `{namespace=~"app|ingress"}`},
+		{query: `{namespace=~"monitoring|ingress|app"}`, expected: `{namespace=~"app|ingress|monitoring"}`},
+		{query: `{namespace=~"app|ingress", namespace!="app"}`, expected: `{namespace="ingress"}`},
+		{query: `{namespace!="kube-system"}`, expected: `{namespace="app"}`},
+		{query: `{namespace=~"app|ingress", namespace="monitoring"}`, err: `got namespace="monitoring" at position 27`},
+		{query: `{namespace=~"app|kube-system"}`, err: `'namespace' selector should only select 'app' or the granted 'ingress', 'monitoring', got namespace=~"app|kube-system" at position 1`},
+		{query: `{namespace=~"ingress.*"}`, err: `got namespace=~"ingress.*" at position 1`},
+		{query: `{namespace="ingress", namespace!="ingress"}`, err: `got namespace!="ingress" at position 22`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			expr, err := enforceLabels(enforced, granted, test.query)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if expr.String() != test.expected {
+				t.Fatalf("expected %s, got %s", test.expected, expr.String())
+			}
+			second, err := enforceLabels(enforced, granted, expr.String())
+			if err != nil || second.String() != expr.String() {
+				t.Fatalf("expected %s to be enforced as is, got %v, %v", expr.String(), second, err)
+			}
+		})
+	}
+}
+
+func TestValidateExpressions(t *testing.T) {
+	tests := []struct {
+		name string
+		rule LokiGroupRule
+		err  string
+	}{
+		{
+			name: "alert",
+			rule: LokiGroupRule{Alert: "Errors", Expr: `count_over_time({app="api"} |= "error" [5m]) > 0`, For: "5m"},
+		},
+		{
+			name: "recording rule",
+			rule: LokiGroupRule{Record: "app:errors:rate5m", Expr: `sum(rate({app="api"} |= "error" [5m]))`},
+		},
+		{
+			name: "alert and record",
+			rule: LokiGroupRule{Alert: "Errors", Record: "errors", Expr: `count_over_time({app="api"}[5m])`},
+			err:  "only one of 'alert' and 'record' can be set",
+		},
+		{
+			name: "neither alert nor record",
+			rule: LokiGroupRule{Expr: `count_over_time({app="api"}[5m])`},
+			err:  "one of 'alert' or 'record' should be set",
+		},
+		{
+			name: "recording rule with for",
+			rule: LokiGroupRule{Record: "errors", Expr: `count_over_time({app="api"}[5m])`, For: "5m"},
+			err:  "'for' is not allowed on recording rules",
+		},
+		{
+			name: "recording rule with annotations",
+			rule: LokiGroupRule{Record: "errors", Expr: `count_over_time({app="api"}[5m])`, Annotations: map[string]string{"summary": "errors"}},
+			err:  "'annotations' are not allowed on recording rules",
+		},
+		{
+			name: "invalid recording rule name",
+			rule: LokiGroupRule{Record: "app errors", Expr: `count_over_time({app="api"}[5m])`},
+			err:  "invalid recording rule name 'app errors'",
+		},
+		{
+			name: "recording rule with a log query",
+			rule: LokiGroupRule{Record: "errors", Expr: `{app="api"} |= "error"`},
+			err:  "recording rules require a metric query",
+		},
+		{
+			name: "invalid expression",
+			rule: LokiGroupRule{Alert: "Errors", Expr: `count_over_time({app="api"})`},
+			err:  "Errors: ",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule := test.rule
+			lokiRule := &LokiRule{
+				Spec: LokiRuleSpec{
+					Groups: []*LokiRuleGroup{{Name: "test", Rules: []*LokiGroupRule{&rule}}},
+				},
+			}
+			lokiRule.Namespace = "prod"
+
+			spec, err := (&RuleValidator{}).ValidateLokiRule(lokiRule)
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if !strings.Contains(spec.Groups[0].Rules[0].Expr, `namespace="prod"`) {
+					t.Fatalf("expected namespace to be enforced, got %s", spec.Groups[0].Rules[0].Expr)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+// A rule without 'alert' and 'record' was accepted before recording rules were supported,
+// it is rejected now for both kinds with the path of the missing field
+func TestValidateExpressionsRequiresRuleType(t *testing.T) {
+	groups := func() []*LokiRuleGroup {
+		return []*LokiRuleGroup{{Name: "test", Rules: []*LokiGroupRule{{Expr: `count_over_time({app="api"}[5m]) > 0`}}}}
+	}
+	lokiRule := &LokiRule{Spec: LokiRuleSpec{Groups: groups()}}
+	lokiRule.Namespace = "prod"
+	_, lokiRuleErr := (&RuleValidator{}).ValidateLokiRule(lokiRule)
+	globalLokiRule := &GlobalLokiRule{Spec: GlobalLokiRuleSpec{Groups: groups()}}
+	_, globalLokiRuleErr := globalLokiRule.ValidateExpressions(DurationBounds{})
+
+	for _, err := range []error{lokiRuleErr, globalLokiRuleErr} {
+		errs, ok := err.(RuleErrors)
+		if !ok || len(errs) != 1 {
+			t.Fatalf("expected a single rule error, got %v", err)
+		}
+		if field := errs[0].Field; field.Field != "spec.groups[0].rules[0].alert" || field.Type != "FieldValueRequired" {
+			t.Fatalf("expected spec.groups[0].rules[0].alert to be required, got %s", field)
+		}
+	}
+}
@@ -25,6 +25,10 @@ import (
 
 // GlobalLokiRuleSpec defines the desired state of GlobalLokiRule
 type GlobalLokiRuleSpec struct {
+	// Tenant (X-Scope-OrgID) of the rules. Defaults to the default tenant of the operator.
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	// +optional
+	Tenant string           `json:"tenant,omitempty" yaml:"-"`
 	Groups []*LokiRuleGroup `json:"groups,omitempty" yaml:"groups"`
 }
 
@@ -32,10 +36,33 @@ type GlobalLokiRuleSpec struct {
 type GlobalLokiRuleStatus struct {
 	Valid   bool   `json:"valid"`
 	Message string `json:"message,omitempty"`
+	// Tenant the rules are stored for
+	Tenant string `json:"tenant,omitempty"`
+	// ConfigMap (shard) the rules are stored in
+	ConfigMap string `json:"configMap,omitempty"`
+	// Key of the rules file in the ConfigMap, or the rule namespace in the Loki ruler
+	Key string `json:"key,omitempty"`
+	// Hash (SHA-256) of the rendered rules
+	Hash string `json:"hash,omitempty"`
+	// ObservedGeneration is the generation of the spec the status is based on
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Targets are the LokiRulerTargets the rules are stored in
+	// +listType=map
+	// +listMapKey=name
+	// +optional
+	Targets []RuleTargetStatus `json:"targets,omitempty"`
+	// Conditions of the rules: Validated, Synced and Ready
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
+// +kubebuilder:printcolumn:name="Reason",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].reason"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 // +kubebuilder:resource:scope=Cluster
 
 // GlobalLokiRule is the Schema for the globallokirules API
@@ -0,0 +1,43 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// SetupWebhookWithManager registers the validating webhook of GlobalLokiRules, which validates them with the validator
+func (r *GlobalLokiRule) SetupWebhookWithManager(mgr ctrl.Manager, validator *RuleValidator) error {
+	mgr.GetWebhookServer().Register("/validate-logging-opsgy-com-v1beta1-globallokirule", globalLokiRuleWebhook(validator))
+	return nil
+}
+
+// globalLokiRuleWebhook returns the validating webhook of GlobalLokiRules
+func globalLokiRuleWebhook(validator *RuleValidator) *webhook.Admission {
+	return &webhook.Admission{Handler: &validatingHandler{
+		newObject: func() runtime.Object { return &GlobalLokiRule{} },
+		validate: func(obj runtime.Object) error {
+			lokiRule := obj.(*GlobalLokiRule)
+			_, err := validator.ValidateGlobalLokiRule(lokiRule)
+			return invalidError("GlobalLokiRule", lokiRule.Name, err)
+		},
+	}}
+}
+
+// +kubebuilder:webhook:path=/validate-logging-opsgy-com-v1beta1-globallokirule,mutating=false,failurePolicy=fail,sideEffects=None,groups=logging.opsgy.com,resources=globallokirules,verbs=create;update,versions=v1beta1,name=vgloballokirule.kb.io,admissionReviewVersions={v1,v1beta1}
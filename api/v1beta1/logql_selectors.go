@@ -0,0 +1,123 @@
+package v1beta1
+
+import (
+	"fmt"
+	"strings"
+	"text/scanner"
+
+	"github.com/grafana/loki/pkg/logql"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// streamSelector is a stream selector, e.g. {namespace="prod", app="nginx"}, in a LogQL expression.
+//
+// Stream selectors are the only place where LogQL selects log streams. Every other
+// expression kind (pipelines, range and vector aggregations, binary operations, literals,
+// etc.) either wraps a stream selector or doesn't select any streams at all.
+type streamSelector struct {
+	Matchers []*labels.Matcher
+	// MatcherPos is the byte offset of every matcher in the expression
+	MatcherPos []int
+	// Pos is the byte offset of the opening brace in the expression
+	Pos int
+	// End is the byte offset after the closing brace
+	End int
+}
+
+// String returns the selector in LogQL syntax
+func (sel *streamSelector) String() string {
+	matchers := make([]string, 0, len(sel.Matchers))
+	for _, matcher := range sel.Matchers {
+		matchers = append(matchers, matcher.String())
+	}
+	return "{" + strings.Join(matchers, ", ") + "}"
+}
+
+// position returns the byte offset of the i-th matcher in the expression,
+// or the offset of the selector when it is unknown
+func (sel *streamSelector) position(i int) int {
+	if i < len(sel.MatcherPos) {
+		return sel.MatcherPos[i]
+	}
+	return sel.Pos
+}
+
+// selectorVisitor is called for every stream selector of an expression,
+// it can modify the matchers of the selector.
+type selectorVisitor func(sel *streamSelector) error
+
+// findSelectors returns the stream selectors of a LogQL expression.
+// The expression is tokenized the same way the Loki parser does, so braces
+// inside strings (e.g. in line_format templates or regexes) are skipped.
+func findSelectors(query string) ([]*streamSelector, error) {
+	var s scanner.Scanner
+	s.Init(strings.NewReader(query))
+	var scanErr error
+	s.Error = func(s *scanner.Scanner, msg string) {
+		if scanErr == nil {
+			scanErr = fmt.Errorf("%s at position %d", msg, s.Position.Offset)
+		}
+	}
+
+	var selectors []*streamSelector
+	var positions []int
+	start := -1
+	prev := rune(scanner.EOF)
+	for tok := s.Scan(); tok != scanner.EOF; prev, tok = tok, s.Scan() {
+		switch tok {
+		case scanner.Ident:
+			if start >= 0 && (prev == '{' || prev == ',') {
+				positions = append(positions, s.Position.Offset)
+			}
+		case '{':
+			if start >= 0 {
+				return nil, fmt.Errorf("unexpected '{' at position %d", s.Position.Offset)
+			}
+			start = s.Position.Offset
+		case '}':
+			if start < 0 {
+				return nil, fmt.Errorf("unexpected '}' at position %d", s.Position.Offset)
+			}
+			end := s.Position.Offset + 1
+			matchers, err := logql.ParseMatchers(query[start:end])
+			if err != nil {
+				return nil, fmt.Errorf("invalid stream selector %s at position %d: %s", query[start:end], start, err.Error())
+			}
+			if len(positions) != len(matchers) {
+				positions = nil
+			}
+			selectors = append(selectors, &streamSelector{Matchers: matchers, MatcherPos: positions, Pos: start, End: end})
+			positions = nil
+			start = -1
+		}
+		if scanErr != nil {
+			return nil, scanErr
+		}
+	}
+	if start >= 0 {
+		return nil, fmt.Errorf("unclosed stream selector at position %d", start)
+	}
+	return selectors, nil
+}
+
+// walkSelectors calls the visitor for every stream selector of the LogQL expression
+// and returns the expression with the (modified) selectors.
+func walkSelectors(query string, visit selectorVisitor) (string, error) {
+	selectors, err := findSelectors(query)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, sel := range selectors {
+		if err := visit(sel); err != nil {
+			return "", err
+		}
+		b.WriteString(query[last:sel.Pos])
+		b.WriteString(sel.String())
+		last = sel.End
+	}
+	b.WriteString(query[last:])
+	return b.String(), nil
+}
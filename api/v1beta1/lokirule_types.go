@@ -22,6 +22,11 @@ import (
 
 // LokiRuleSpec defines the desired state of LokiRule
 type LokiRuleSpec struct {
+	// Tenant (X-Scope-OrgID) of the rules. Defaults to the tenant of the namespace
+	// or the default tenant of the operator.
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	// +optional
+	Tenant string           `json:"tenant,omitempty" yaml:"-"`
 	Groups []*LokiRuleGroup `json:"groups,omitempty" yaml:"groups"`
 }
 
@@ -31,22 +36,47 @@ type LokiRuleGroup struct {
 	Rules    []*LokiGroupRule `json:"rules,omitempty" yaml:"rules"`
 }
 
+// LokiGroupRule is either an alerting rule (Alert) or a recording rule (Record)
 type LokiGroupRule struct {
-	Alert       string            `json:"alert,omitempty" yaml:"alert"`
+	Alert       string            `json:"alert,omitempty" yaml:"alert,omitempty"`
+	Record      string            `json:"record,omitempty" yaml:"record,omitempty"`
 	Expr        string            `json:"expr,omitempty" yaml:"expr"`
-	For         string            `json:"for,omitempty" yaml:"for"`
-	Annotations map[string]string `json:"annotations,omitempty" yaml:"annotations"`
-	Labels      map[string]string `json:"labels,omitempty" yaml:"labels"`
+	For         string            `json:"for,omitempty" yaml:"for,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty" yaml:"annotations,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
 }
 
 // LokiRuleStatus defines the observed state of LokiRule
 type LokiRuleStatus struct {
 	Valid   bool   `json:"valid"`
 	Message string `json:"message,omitempty"`
+	// Tenant the rules are stored for
+	Tenant string `json:"tenant,omitempty"`
+	// ConfigMap (shard) the rules are stored in
+	ConfigMap string `json:"configMap,omitempty"`
+	// Key of the rules file in the ConfigMap, or the rule namespace in the Loki ruler
+	Key string `json:"key,omitempty"`
+	// Hash (SHA-256) of the rendered rules
+	Hash string `json:"hash,omitempty"`
+	// ObservedGeneration is the generation of the spec the status is based on
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Targets are the LokiRulerTargets the rules are stored in
+	// +listType=map
+	// +listMapKey=name
+	// +optional
+	Targets []RuleTargetStatus `json:"targets,omitempty"`
+	// Conditions of the rules: Validated, Synced and Ready
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
+// +kubebuilder:printcolumn:name="Reason",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].reason"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 
 // LokiRule is the Schema for the lokirules API
 type LokiRule struct {
@@ -19,36 +19,25 @@ package v1beta1
 import (
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
-	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 )
 
-// log is for logging in this package.
-var lokirulelog = logf.Log.WithName("lokirule-resource")
-
-func (r *LokiRule) SetupWebhookWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewWebhookManagedBy(mgr).
-		For(r).
-		Complete()
-}
-
-// +kubebuilder:webhook:path=/validate-logging-opsgy-com-v1beta1-lokirule,mutating=false,failurePolicy=fail,sideEffects=None,groups=logging.opsgy.com,resources=lokirules,verbs=create;update,versions=v1beta1,name=vlokirule.kb.io,admissionReviewVersions={v1,v1beta1}
-
-var _ webhook.Validator = &LokiRule{}
-
-// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
-func (r *LokiRule) ValidateCreate() error {
-	_, err := r.ValidateExpressions()
-	return err
+// SetupWebhookWithManager registers the validating webhook of LokiRules, which validates them with the validator
+func (r *LokiRule) SetupWebhookWithManager(mgr ctrl.Manager, validator *RuleValidator) error {
+	mgr.GetWebhookServer().Register("/validate-logging-opsgy-com-v1beta1-lokirule", lokiRuleWebhook(validator))
+	return nil
 }
 
-// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
-func (r *LokiRule) ValidateUpdate(old runtime.Object) error {
-	_, err := r.ValidateExpressions()
-	return err
+// lokiRuleWebhook returns the validating webhook of LokiRules
+func lokiRuleWebhook(validator *RuleValidator) *webhook.Admission {
+	return &webhook.Admission{Handler: &validatingHandler{
+		newObject: func() runtime.Object { return &LokiRule{} },
+		validate: func(obj runtime.Object) error {
+			lokiRule := obj.(*LokiRule)
+			_, err := validator.ValidateLokiRule(lokiRule)
+			return invalidError("LokiRule", lokiRule.Name, err)
+		},
+	}}
 }
 
-// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
-func (r *LokiRule) ValidateDelete() error {
-	return nil
-}
+// +kubebuilder:webhook:path=/validate-logging-opsgy-com-v1beta1-lokirule,mutating=false,failurePolicy=fail,sideEffects=None,groups=logging.opsgy.com,resources=lokirules,verbs=create;update,versions=v1beta1,name=vlokirule.kb.io,admissionReviewVersions={v1,v1beta1}
@@ -0,0 +1,70 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// LokiRuleGrantSpec defines which namespaces may query the log streams of the namespace of the grant
+type LokiRuleGrantSpec struct {
+	// From are the namespaces whose LokiRules may select the log streams of this namespace
+	// +kubebuilder:validation:MinItems=1
+	From []LokiRuleGrantFrom `json:"from"`
+}
+
+// LokiRuleGrantFrom is a namespace that is granted access
+type LokiRuleGrantFrom struct {
+	// Namespace of the LokiRules
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	Namespace string `json:"namespace"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// LokiRuleGrant allows the LokiRules of other namespaces to query the log streams of its namespace,
+// e.g. {namespace=~"app|ingress"} in a LokiRule in namespace 'app' requires a grant in namespace 'ingress'
+type LokiRuleGrant struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec LokiRuleGrantSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// LokiRuleGrantList contains a list of LokiRuleGrant
+type LokiRuleGrantList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []LokiRuleGrant `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&LokiRuleGrant{}, &LokiRuleGrantList{})
+}
+
+// Grants returns whether the grant allows the LokiRules of the namespace
+func (grant *LokiRuleGrant) Grants(namespace string) bool {
+	for _, from := range grant.Spec.From {
+		if from.Namespace == namespace {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// LokiRulerTargetSpec defines where the rules of the selected LokiRules and GlobalLokiRules are stored.
+// Exactly one of ConfigMap and Ruler must be set.
+type LokiRulerTargetSpec struct {
+	// ConfigMap stores the rules in ConfigMaps to be mounted into the Loki ruler
+	// +optional
+	ConfigMap *ConfigMapTarget `json:"configMap,omitempty"`
+	// Ruler pushes the rules to the rules API of the Loki ruler
+	// +optional
+	Ruler *RulerTarget `json:"ruler,omitempty"`
+	// Tenant (X-Scope-OrgID) of the rules that don't specify one and are in a namespace without
+	// a tenant. Defaults to the default tenant of the operator.
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	// +optional
+	Tenant string `json:"tenant,omitempty"`
+	// NamespaceSelector selects the namespaces of the LokiRules, all namespaces when empty.
+	// It doesn't apply to GlobalLokiRules.
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// RuleSelector selects the LokiRules and GlobalLokiRules by their labels, all rules when empty
+	// +optional
+	RuleSelector *metav1.LabelSelector `json:"ruleSelector,omitempty"`
+	// ExternalLabels are added to the rules stored in this target
+	// +optional
+	ExternalLabels map[string]string `json:"externalLabels,omitempty"`
+	// Enforcement overrides the stream labels the operator enforces on the LokiRules stored in this target
+	// +optional
+	Enforcement *EnforcementPolicy `json:"enforcement,omitempty"`
+}
+
+// ConfigMapTarget stores the rules in ConfigMaps. Every tenant gets its own ConfigMap,
+// named '<name>-<tenant>' except for the default tenant of the target.
+type ConfigMapTarget struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// MaxSize is the maximum size in bytes of the data of a ConfigMap,
+	// before the rules are spread over an additional ConfigMap
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxSize int `json:"maxSize,omitempty"`
+	// MaxShards is the maximum number of ConfigMaps per tenant
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxShards int `json:"maxShards,omitempty"`
+}
+
+// RulerTarget pushes the rules to the rules API of a Loki ruler
+type RulerTarget struct {
+	// URL of the Loki ruler, e.g. 'http://loki:3100'
+	URL string `json:"url"`
+}
+
+// RulerTargetDestination is where a LokiRulerTarget stores the rules
+type RulerTargetDestination struct {
+	// ConfigMap the rules are stored in
+	// +optional
+	ConfigMap *ConfigMapTarget `json:"configMap,omitempty"`
+	// Ruler the rules are pushed to
+	// +optional
+	Ruler *RulerTarget `json:"ruler,omitempty"`
+	// Tenant of the rules that don't specify one
+	// +optional
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// LokiRulerTargetStatus defines the observed state of LokiRulerTarget
+type LokiRulerTargetStatus struct {
+	// Destination the rules are stored in. When the destination of the spec changes,
+	// the rules are removed from this destination before it is updated.
+	// +optional
+	Destination *RulerTargetDestination `json:"destination,omitempty"`
+	// LokiRules is the number of LokiRules stored in the target
+	LokiRules int32 `json:"lokiRules"`
+	// GlobalLokiRules is the number of GlobalLokiRules stored in the target
+	GlobalLokiRules int32 `json:"globalLokiRules"`
+	// ObservedGeneration is the generation of the spec the status is based on
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Conditions of the target: Ready
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// RuleTargetStatus is where the rules of a LokiRule or GlobalLokiRule are stored in a LokiRulerTarget
+type RuleTargetStatus struct {
+	// Name of the LokiRulerTarget
+	Name string `json:"name"`
+	// Tenant the rules are stored for
+	Tenant string `json:"tenant,omitempty"`
+	// ConfigMap (shard) the rules are stored in
+	ConfigMap string `json:"configMap,omitempty"`
+	// Key of the rules file in the ConfigMap, or the rule namespace in the Loki ruler
+	Key string `json:"key,omitempty"`
+	// Hash (SHA-256) of the rendered rules
+	Hash string `json:"hash,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="LokiRules",type="integer",JSONPath=".status.lokiRules"
+// +kubebuilder:printcolumn:name="GlobalLokiRules",type="integer",JSONPath=".status.globalLokiRules"
+// +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+// +kubebuilder:resource:scope=Cluster
+
+// LokiRulerTarget is the Schema for the lokirulertargets API
+type LokiRulerTarget struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   LokiRulerTargetSpec   `json:"spec,omitempty"`
+	Status LokiRulerTargetStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// LokiRulerTargetList contains a list of LokiRulerTarget
+type LokiRulerTargetList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []LokiRulerTarget `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&LokiRulerTarget{}, &LokiRulerTargetList{})
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"context"
+	goerrors "errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// RuleValidator validates the LokiRules and GlobalLokiRules of the webhook
+// with the configuration of the operator
+type RuleValidator struct {
+	// Enforcement selects the stream labels enforced on the expressions of LokiRules, by default only the namespace
+	Enforcement *EnforcementPolicy
+	// Namespace returns the namespace of a LokiRule, whose labels and annotations hold the values of
+	// the enforced extra labels. When nil the namespace has no labels and annotations.
+	Namespace func(name string) (*corev1.Namespace, error)
+	// GrantedNamespaces returns the namespaces whose log streams the LokiRules of a namespace may select,
+	// see LokiRuleGrant. When nil only the namespace of the LokiRule is allowed.
+	GrantedNamespaces func(namespace string) ([]string, error)
+	// TargetEnforcements returns the enforcement policies of the LokiRulerTargets that select the LokiRule,
+	// by the name of the target. Targets without an enforcement policy of their own are left out.
+	TargetEnforcements func(lokiRule *LokiRule) (map[string]*EnforcementPolicy, error)
+	// Durations are the bounds of the intervals and 'for' durations of the rules
+	Durations DurationBounds
+}
+
+// ValidateLokiRule validates the expressions, labels and annotations of the rules and enforces
+// the stream labels of the enforcement policy on the expressions, the same way the LokiRule controller does.
+// The namespaces that granted access to the namespace, see GrantedNamespaces, can be selected as well.
+// The rules must also be valid with the enforcement policies of the LokiRulerTargets that select them.
+func (v *RuleValidator) ValidateLokiRule(lokiRule *LokiRule) (*LokiRuleSpec, error) {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: lokiRule.Namespace}}
+	if v.Namespace != nil {
+		var err error
+		if ns, err = v.Namespace(lokiRule.Namespace); err != nil {
+			return nil, err
+		}
+	}
+	var granted []string
+	if v.GrantedNamespaces != nil {
+		var err error
+		if granted, err = v.GrantedNamespaces(lokiRule.Namespace); err != nil {
+			return nil, err
+		}
+	}
+	spec, _, err := v.Enforcement.Enforce(lokiRule, ns, granted, v.Durations)
+	if err != nil {
+		return nil, err
+	}
+	if v.TargetEnforcements == nil {
+		return spec, nil
+	}
+	policies, err := v.TargetEnforcements(lokiRule)
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]string, 0, len(policies))
+	for target := range policies {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	for _, target := range targets {
+		if _, _, err := policies[target].Enforce(lokiRule, ns, granted, v.Durations); err != nil {
+			return nil, fmt.Errorf("LokiRulerTarget %s: %s", target, err.Error())
+		}
+	}
+	return spec, nil
+}
+
+// ValidateGlobalLokiRule validates the expressions, labels and annotations of the rules
+func (v *RuleValidator) ValidateGlobalLokiRule(lokiRule *GlobalLokiRule) (*GlobalLokiRuleSpec, error) {
+	return lokiRule.ValidateExpressions(v.Durations)
+}
+
+// validatingHandler is the admission handler of the webhook of a kind, it validates
+// the created and updated objects and allows the rest
+type validatingHandler struct {
+	newObject func() runtime.Object
+	validate  func(obj runtime.Object) error
+	decoder   *admission.Decoder
+}
+
+var _ admission.DecoderInjector = &validatingHandler{}
+
+// InjectDecoder injects the decoder of the webhook server
+func (h *validatingHandler) InjectDecoder(d *admission.Decoder) error {
+	h.decoder = d
+	return nil
+}
+
+// Handle validates the object of the request
+func (h *validatingHandler) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if req.Operation != admissionv1.Create && req.Operation != admissionv1.Update {
+		return admission.Allowed("")
+	}
+	obj := h.newObject()
+	if err := h.decoder.Decode(req, obj); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if err := h.validate(obj); err != nil {
+		var apiStatus apierrors.APIStatus
+		if goerrors.As(err, &apiStatus) {
+			status := apiStatus.Status()
+			return admission.Response{AdmissionResponse: admissionv1.AdmissionResponse{Allowed: false, Result: &status}}
+		}
+		return admission.Denied(err.Error())
+	}
+	return admission.Allowed("")
+}
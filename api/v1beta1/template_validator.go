@@ -0,0 +1,92 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/template"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// templateDefs are the variables the Loki ruler defines for the templates of alerting rules
+var templateDefs = []string{
+	"{{$labels := .Labels}}",
+	"{{$externalLabels := .ExternalLabels}}",
+	"{{$value := .Value}}",
+}
+
+// validateLabels validates the names and values of the labels and the names of the annotations
+func validateLabels(rule *LokiGroupRule, path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	for _, name := range sortedKeys(rule.Labels) {
+		if !model.LabelName(name).IsValid() {
+			errs = append(errs, field.Invalid(path.Child("labels").Key(name), name, fmt.Sprintf("invalid label name '%s'", name)))
+		} else if value := rule.Labels[name]; !model.LabelValue(value).IsValid() {
+			errs = append(errs, field.Invalid(path.Child("labels").Key(name), value, fmt.Sprintf("invalid value of label '%s'", name)))
+		}
+	}
+	for _, name := range sortedKeys(rule.Annotations) {
+		if !model.LabelName(name).IsValid() {
+			errs = append(errs, field.Invalid(path.Child("annotations").Key(name), name, fmt.Sprintf("invalid annotation name '%s'", name)))
+		}
+	}
+	return errs
+}
+
+// validateTemplates parses the labels and annotations of alerting rules as templates,
+// the same way the Loki ruler does when the alert fires: with $labels, $externalLabels,
+// $value and the template functions of Prometheus, like humanize.
+func validateTemplates(rule *LokiGroupRule, path *field.Path) field.ErrorList {
+	if rule.Alert == "" {
+		return nil
+	}
+
+	data := template.AlertTemplateData(map[string]string{}, map[string]string{}, 0)
+	parse := func(text string) error {
+		expander := template.NewTemplateExpander(context.TODO(), strings.Join(append(templateDefs, text), ""),
+			"__alert_"+rule.Alert, data, model.Now(), nil, nil)
+		return expander.ParseTest()
+	}
+
+	var errs field.ErrorList
+	for _, name := range sortedKeys(rule.Labels) {
+		if err := parse(rule.Labels[name]); err != nil {
+			errs = append(errs, field.Invalid(path.Child("labels").Key(name), rule.Labels[name], fmt.Sprintf("label '%s': %s", name, err.Error())))
+		}
+	}
+	for _, name := range sortedKeys(rule.Annotations) {
+		if err := parse(rule.Annotations[name]); err != nil {
+			errs = append(errs, field.Invalid(path.Child("annotations").Key(name), rule.Annotations[name], fmt.Sprintf("annotation '%s': %s", name, err.Error())))
+		}
+	}
+	return errs
+}
+
+// sortedKeys returns the keys of the map in order, so errors are reported in a stable order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
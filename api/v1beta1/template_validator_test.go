@@ -0,0 +1,116 @@
+package v1beta1
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateTemplates(t *testing.T) {
+	tests := []struct {
+		name        string
+		labels      map[string]string
+		annotations map[string]string
+		err         string
+	}{
+		{
+			name:        "valid",
+			labels:      map[string]string{"severity": "critical", "job": "{{ $labels.job }}"},
+			annotations: map[string]string{"summary": "{{ $labels.job }} has {{ $value | humanize }} errors", "url": "{{ $externalLabels.cluster }}"},
+		},
+		{
+			name:        "unclosed action",
+			annotations: map[string]string{"summary": "{{ $labels.job }"},
+			err:         `Errors: annotation 'summary': `,
+		},
+		{
+			name:        "undefined function",
+			annotations: map[string]string{"summary": "{{ $value | humanise }}"},
+			err:         `function "humanise" not defined`,
+		},
+		{
+			name:   "undefined variable",
+			labels: map[string]string{"job": "{{ $job }}"},
+			err:    `Errors: label 'job': `,
+		},
+		{
+			name:   "invalid label name",
+			labels: map[string]string{"team-name": "payments"},
+			err:    `Errors: invalid label name 'team-name'`,
+		},
+		{
+			name:        "invalid annotation name",
+			annotations: map[string]string{"runbook.url": "https://example.com"},
+			err:         `Errors: invalid annotation name 'runbook.url'`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lokiRule := &GlobalLokiRule{Spec: GlobalLokiRuleSpec{Groups: []*LokiRuleGroup{{
+				Name: "test",
+				Rules: []*LokiGroupRule{{
+					Alert:       "Errors",
+					Expr:        `count_over_time({app="api"} |= "error" [5m]) > 0`,
+					Labels:      test.labels,
+					Annotations: test.annotations,
+				}},
+			}}}}
+			_, err := lokiRule.ValidateExpressions(DurationBounds{})
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestValidateAllErrors(t *testing.T) {
+	lokiRule := &LokiRule{Spec: LokiRuleSpec{Groups: []*LokiRuleGroup{
+		{
+			Name: "first",
+			Rules: []*LokiGroupRule{{
+				Alert:       "Errors",
+				Expr:        `count_over_time({namespace="dev"}[5m]) > 0`,
+				Annotations: map[string]string{"summary": "{{ $labels.job }"},
+			}},
+		},
+		{
+			Name: "second",
+			Rules: []*LokiGroupRule{
+				{Record: "app:errors", Expr: `count_over_time({app="api"}[5m])`, For: "5m"},
+				{Alert: "Valid", Expr: `count_over_time({app="api"}[5m]) > 0`},
+			},
+		},
+	}}}
+	lokiRule.Namespace = "prod"
+
+	_, err := (&RuleValidator{}).ValidateLokiRule(lokiRule)
+	errs, ok := err.(RuleErrors)
+	if !ok {
+		t.Fatalf("expected RuleErrors, got %v", err)
+	}
+	expected := []string{
+		"spec.groups[0].rules[0].expr",
+		"spec.groups[0].rules[0].annotations[summary]",
+		"spec.groups[1].rules[0].for",
+	}
+	fieldErrs := errs.FieldErrors()
+	if len(fieldErrs) != len(expected) {
+		t.Fatalf("expected %d errors, got %v", len(expected), err)
+	}
+	for i, path := range expected {
+		if fieldErrs[i].Field != path {
+			t.Fatalf("expected error %d on %s, got %s", i, path, fieldErrs[i].Field)
+		}
+	}
+	for _, msg := range []string{"Errors: 'namespace' selector should equals 'prod'", "Errors: annotation 'summary'", "app:errors: 'for' is not allowed"} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Fatalf("expected error containing %q, got %v", msg, err)
+		}
+	}
+}
@@ -30,6 +30,7 @@ import (
 
 	admissionv1beta1 "k8s.io/api/admission/v1beta1"
 	// +kubebuilder:scaffold:imports
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/rest"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -99,7 +100,10 @@ var _ = BeforeSuite(func() {
 	})
 	Expect(err).NotTo(HaveOccurred())
 
-	err = (&LokiRule{}).SetupWebhookWithManager(mgr)
+	err = (&LokiRule{}).SetupWebhookWithManager(mgr, &RuleValidator{})
+	Expect(err).NotTo(HaveOccurred())
+
+	err = (&GlobalLokiRule{}).SetupWebhookWithManager(mgr, &RuleValidator{})
 	Expect(err).NotTo(HaveOccurred())
 
 	// +kubebuilder:scaffold:webhook
@@ -131,3 +135,42 @@ var _ = AfterSuite(func() {
 	err := testEnv.Stop()
 	Expect(err).NotTo(HaveOccurred())
 })
+
+var _ = Describe("GlobalLokiRule webhook", func() {
+	newGlobalLokiRule := func(name string, expr string) *GlobalLokiRule {
+		return &GlobalLokiRule{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: GlobalLokiRuleSpec{
+				Groups: []*LokiRuleGroup{{
+					Name: "test",
+					Rules: []*LokiGroupRule{{
+						Alert: "Errors",
+						Expr:  expr,
+					}},
+				}},
+			},
+		}
+	}
+
+	It("should accept a GlobalLokiRule with valid expressions", func() {
+		globalLokiRule := newGlobalLokiRule("valid", `count_over_time({app="api"} |= "error" [5m]) > 0`)
+		Expect(k8sClient.Create(ctx, globalLokiRule)).To(Succeed())
+		Expect(k8sClient.Delete(ctx, globalLokiRule)).To(Succeed())
+	})
+
+	It("should reject a GlobalLokiRule with an invalid expression", func() {
+		globalLokiRule := newGlobalLokiRule("invalid", `count_over_time({app="api"})`)
+		err := k8sClient.Create(ctx, globalLokiRule)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Errors"))
+	})
+
+	It("should reject an update that makes a GlobalLokiRule invalid", func() {
+		globalLokiRule := newGlobalLokiRule("update", `count_over_time({app="api"}[5m]) > 0`)
+		Expect(k8sClient.Create(ctx, globalLokiRule)).To(Succeed())
+
+		globalLokiRule.Spec.Groups[0].Rules[0].Expr = `count_over_time({app="api"}`
+		Expect(k8sClient.Update(ctx, globalLokiRule)).NotTo(Succeed())
+		Expect(k8sClient.Delete(ctx, globalLokiRule)).To(Succeed())
+	})
+})
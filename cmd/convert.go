@@ -0,0 +1,338 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	goerrors "errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+)
+
+// PrometheusRuleKind is the kind of the rule resources of the Prometheus Operator
+const PrometheusRuleKind = "PrometheusRule"
+
+// ruleFile is a document of a Loki or Prometheus rule file, or a PrometheusRule of the Prometheus Operator
+type ruleFile struct {
+	Kind     string `yaml:"kind,omitempty"`
+	Metadata struct {
+		Name      string `yaml:"name,omitempty"`
+		Namespace string `yaml:"namespace,omitempty"`
+	} `yaml:"metadata,omitempty"`
+	Spec struct {
+		Groups []*loggingv1beta1.LokiRuleGroup `yaml:"groups,omitempty"`
+	} `yaml:"spec,omitempty"`
+	Groups []*loggingv1beta1.LokiRuleGroup `yaml:"groups,omitempty"`
+}
+
+// manifest is a LokiRule or GlobalLokiRule manifest
+type manifest struct {
+	APIVersion string           `yaml:"apiVersion"`
+	Kind       string           `yaml:"kind"`
+	Metadata   manifestMetadata `yaml:"metadata"`
+	Spec       manifestSpec     `yaml:"spec"`
+}
+
+type manifestMetadata struct {
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace,omitempty"`
+}
+
+// manifestSpec is the spec of a LokiRule or GlobalLokiRule, LokiRuleSpec leaves out the tenant in YAML
+type manifestSpec struct {
+	Tenant string                          `yaml:"tenant,omitempty"`
+	Groups []*loggingv1beta1.LokiRuleGroup `yaml:"groups"`
+}
+
+// convertOptions are the flags of the convert command
+type convertOptions struct {
+	Kind           string
+	Name           string
+	Namespace      string
+	Tenant         string
+	Enforce        bool
+	NamespaceLabel string
+	Granted        string
+	Output         string
+}
+
+const convertDescription = `
+Converts Loki or Prometheus rule files, in the 'groups:' format of the ruler, and PrometheusRules
+of the Prometheus Operator into LokiRule or GlobalLokiRule manifests. Every document becomes a
+manifest, named after the PrometheusRule or the file. The rules are validated like the webhook does.
+With -enforce the namespace is enforced on the expressions of LokiRules, like the operator does.
+Reads stdin when no files are given.`
+
+// Convert is the convert command
+func Convert(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	opts := &convertOptions{}
+	flags := newFlagSet("convert", "[flags] [file...]", convertDescription, stderr)
+	flags.StringVar(&opts.Kind, "kind", "LokiRule", "Kind of the manifests, either 'LokiRule' or 'GlobalLokiRule'")
+	flags.StringVar(&opts.Name, "name", "", "Name of the manifest, defaults to the name of the PrometheusRule or the file. Only for a single document")
+	flags.StringVar(&opts.Namespace, "namespace", "", "Namespace of the LokiRules, defaults to the namespace of the PrometheusRule")
+	flags.StringVar(&opts.Tenant, "tenant", "", "Tenant (X-Scope-OrgID) of the rules")
+	flags.BoolVar(&opts.Enforce, "enforce", false, "Enforce the namespace on the expressions of the LokiRules")
+	flags.StringVar(&opts.NamespaceLabel, "namespace-label", loggingv1beta1.DefaultNamespaceLabel, "Stream label that holds the namespace, used with -enforce")
+	flags.StringVar(&opts.Granted, "granted-namespaces", "", "Comma separated list of the namespaces that granted the namespace access with a LokiRuleGrant, used with -enforce")
+	flags.StringVar(&opts.Output, "o", "", "File to write the manifests to, defaults to stdout")
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	if err := opts.validate(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+
+	inputs, err := readInputs(flags.Args(), stdin)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitFailed
+	}
+	var manifests []*manifest
+	failed := false
+	for _, in := range inputs {
+		converted, err := opts.convert(in)
+		if err != nil {
+			printErrors(stderr, in.Name, err)
+			failed = true
+			continue
+		}
+		manifests = append(manifests, converted...)
+	}
+	if failed {
+		return exitFailed
+	}
+	if opts.Name != "" && len(manifests) > 1 {
+		fmt.Fprintln(stderr, "-name can only be used to convert a single document")
+		return exitUsage
+	}
+
+	var out bytes.Buffer
+	for i, m := range manifests {
+		if i > 0 {
+			out.WriteString("---\n")
+		}
+		data, err := yaml.Marshal(m)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitFailed
+		}
+		out.Write(data)
+	}
+	if err := writeOutput(opts.Output, out.Bytes(), stdout); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitFailed
+	}
+	return exitOK
+}
+
+func (opts *convertOptions) validate() error {
+	switch opts.Kind {
+	case "LokiRule":
+		if opts.Enforce && opts.Namespace == "" {
+			return fmt.Errorf("-namespace is required with -enforce")
+		}
+	case "GlobalLokiRule":
+		if opts.Namespace != "" || opts.Enforce {
+			return fmt.Errorf("-namespace and -enforce can't be used with GlobalLokiRules")
+		}
+	default:
+		return fmt.Errorf("unknown kind %q, should be 'LokiRule' or 'GlobalLokiRule'", opts.Kind)
+	}
+	if opts.Name != "" {
+		if errs := validation.IsDNS1123Subdomain(opts.Name); len(errs) > 0 {
+			return fmt.Errorf("invalid name %q: %s", opts.Name, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+// convert converts the documents of the input into manifests
+func (opts *convertOptions) convert(in input) ([]*manifest, error) {
+	files, err := parseRuleFiles(in.Data)
+	if err != nil {
+		return nil, err
+	}
+	base := strings.TrimSuffix(filepath.Base(in.Name), filepath.Ext(in.Name))
+	if in.Name == "-" {
+		base = "rules"
+	}
+
+	var manifests []*manifest
+	var errs documentErrors
+	for i, file := range files {
+		name := opts.Name
+		if name == "" {
+			name = file.Metadata.Name
+		}
+		if name == "" {
+			name = base
+			if len(files) > 1 {
+				name = fmt.Sprintf("%s-%d", base, i)
+			}
+		}
+		m, err := opts.manifest(resourceName(name), file)
+		if err != nil {
+			errs = append(errs, documentError{Document: name, Err: err})
+			continue
+		}
+		manifests = append(manifests, m)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return manifests, nil
+}
+
+// manifest converts a document into a validated manifest
+func (opts *convertOptions) manifest(name string, file *ruleFile) (*manifest, error) {
+	m := &manifest{
+		APIVersion: loggingv1beta1.GroupVersion.String(),
+		Kind:       opts.Kind,
+		Metadata:   manifestMetadata{Name: name},
+		Spec:       manifestSpec{Tenant: opts.Tenant},
+	}
+	groups := file.Groups
+	if file.Kind == PrometheusRuleKind {
+		groups = file.Spec.Groups
+	}
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("no rule groups found")
+	}
+
+	if opts.Kind == "GlobalLokiRule" {
+		globalLokiRule := &loggingv1beta1.GlobalLokiRule{Spec: loggingv1beta1.GlobalLokiRuleSpec{Groups: groups}}
+		spec, err := globalLokiRule.ValidateExpressions(loggingv1beta1.DurationBounds{})
+		if err != nil {
+			return nil, err
+		}
+		m.Spec.Groups = spec.Groups
+		return m, nil
+	}
+
+	m.Metadata.Namespace = opts.Namespace
+	if m.Metadata.Namespace == "" {
+		m.Metadata.Namespace = file.Metadata.Namespace
+	}
+	var enforced []*labels.Matcher
+	var granted map[string][]string
+	if opts.Enforce {
+		enforced = []*labels.Matcher{{Type: labels.MatchEqual, Name: opts.NamespaceLabel, Value: m.Metadata.Namespace}}
+		granted = map[string][]string{opts.NamespaceLabel: splitList(opts.Granted)}
+	}
+	lokiRule := &loggingv1beta1.LokiRule{Spec: loggingv1beta1.LokiRuleSpec{Groups: groups}}
+	spec, err := lokiRule.ValidateExpressionsWith(enforced, granted, loggingv1beta1.DurationBounds{})
+	if err != nil {
+		return nil, err
+	}
+	m.Spec.Groups = spec.Groups
+	return m, nil
+}
+
+// parseRuleFiles parses the documents of a YAML file
+func parseRuleFiles(data []byte) ([]*ruleFile, error) {
+	var files []*ruleFile
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		file := &ruleFile{}
+		if err := decoder.Decode(file); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch {
+		case file.Kind != "" && file.Kind != PrometheusRuleKind:
+			return nil, fmt.Errorf("unsupported kind %q, should be a rule file or a %s", file.Kind, PrometheusRuleKind)
+		case file.Kind == "" && len(file.Groups) == 0:
+			// Empty document
+			continue
+		}
+		files = append(files, file)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no rule groups found")
+	}
+	return files, nil
+}
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// resourceName turns a name into a valid name of a Kubernetes resource
+func resourceName(name string) string {
+	name = invalidNameChars.ReplaceAllString(strings.ToLower(name), "-")
+	if len(name) > validation.DNS1123SubdomainMaxLength {
+		name = name[:validation.DNS1123SubdomainMaxLength]
+	}
+	return strings.Trim(name, ".-")
+}
+
+// splitList splits a comma separated list, ignoring empty items
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// documentError is the error of a document of a file
+type documentError struct {
+	// Document is the name of the document
+	Document string
+	Err      error
+}
+
+// documentErrors are the errors of the documents of a file
+type documentErrors []documentError
+
+func (e documentErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", err.Document, err.Err))
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// printErrors prints the errors of a file, an error per line with the path of the field when the rules are invalid
+func printErrors(w io.Writer, file string, err error) {
+	var docErrs documentErrors
+	if !goerrors.As(err, &docErrs) {
+		fmt.Fprintf(w, "%s: %s\n", file, err)
+		return
+	}
+	for _, docErr := range docErrs {
+		var ruleErrs loggingv1beta1.RuleErrors
+		if !goerrors.As(docErr.Err, &ruleErrs) {
+			fmt.Fprintf(w, "%s: %s: %s\n", file, docErr.Document, docErr.Err)
+			continue
+		}
+		for _, ruleErr := range ruleErrs {
+			fmt.Fprintf(w, "%s: %s: %s: %s: %s\n", file, docErr.Document, ruleErr.Field.Field, ruleErr.Rule, ruleErr.Field.Detail)
+		}
+	}
+}
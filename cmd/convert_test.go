@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+const ruleFileYAML = `groups:
+- name: nginx
+  interval: 90s
+  rules:
+  - alert: NginxErrors
+    expr: sum(rate({app="nginx"} |= "error" [5m])) > 10
+    for: 10m
+    labels:
+      severity: warning
+`
+
+const prometheusRulesYAML = `apiVersion: monitoring.coreos.com/v1
+kind: PrometheusRule
+metadata:
+  name: Ingress_Rules
+  namespace: ingress
+spec:
+  groups:
+  - name: ingress
+    rules:
+    - record: job:requests:rate5m
+      expr: sum by (job) (rate({app="ingress"}[5m]))
+---
+apiVersion: monitoring.coreos.com/v1
+kind: PrometheusRule
+metadata:
+  name: api
+spec:
+  groups:
+  - name: api
+    rules:
+    - alert: ApiErrors
+      expr: count_over_time({app="api"} |= "error" [5m]) > 0
+`
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		input    string
+		code     int
+		expected []manifest
+		stderr   string
+	}{
+		{
+			name:  "rule file",
+			args:  []string{"-namespace", "prod", "-enforce", "-tenant", "team-a"},
+			input: ruleFileYAML,
+			expected: []manifest{{
+				APIVersion: "logging.opsgy.com/v1beta1",
+				Kind:       "LokiRule",
+				Metadata:   manifestMetadata{Name: "rules", Namespace: "prod"},
+				Spec:       manifestSpec{Tenant: "team-a"},
+			}},
+		},
+		{
+			name:  "prometheus rules",
+			input: prometheusRulesYAML,
+			expected: []manifest{
+				{APIVersion: "logging.opsgy.com/v1beta1", Kind: "LokiRule", Metadata: manifestMetadata{Name: "ingress-rules", Namespace: "ingress"}},
+				{APIVersion: "logging.opsgy.com/v1beta1", Kind: "LokiRule", Metadata: manifestMetadata{Name: "api"}},
+			},
+		},
+		{
+			name:     "global",
+			args:     []string{"-kind", "GlobalLokiRule", "-name", "nginx"},
+			input:    ruleFileYAML,
+			expected: []manifest{{APIVersion: "logging.opsgy.com/v1beta1", Kind: "GlobalLokiRule", Metadata: manifestMetadata{Name: "nginx"}}},
+		},
+		{
+			name:   "enforce on global",
+			args:   []string{"-kind", "GlobalLokiRule", "-enforce"},
+			input:  ruleFileYAML,
+			code:   exitUsage,
+			stderr: "-namespace and -enforce can't be used with GlobalLokiRules",
+		},
+		{
+			name:   "name of several documents",
+			args:   []string{"-name", "rules"},
+			input:  prometheusRulesYAML,
+			code:   exitUsage,
+			stderr: "-name can only be used to convert a single document",
+		},
+		{
+			name:   "enforcement failed",
+			args:   []string{"-namespace", "prod", "-enforce"},
+			input:  strings.Replace(ruleFileYAML, `app="nginx"`, `namespace="dev"`, 1),
+			code:   exitFailed,
+			stderr: "-: rules: spec.groups[0].rules[0].expr: NginxErrors: 'namespace' selector should equals 'prod'",
+		},
+		{
+			name:   "promql",
+			input:  strings.Replace(ruleFileYAML, `sum(rate({app="nginx"} |= "error" [5m])) > 10`, `sum(rate(http_errors_total[5m])) > 10`, 1),
+			code:   exitFailed,
+			stderr: "-: rules: spec.groups[0].rules[0].expr: NginxErrors: ",
+		},
+		{
+			name:   "unsupported kind",
+			input:  "kind: ConfigMap\n",
+			code:   exitFailed,
+			stderr: `-: unsupported kind "ConfigMap"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := Convert(test.args, strings.NewReader(test.input), &stdout, &stderr)
+			if code != test.code {
+				t.Fatalf("expected exit code %d, got %d: %s", test.code, code, stderr.String())
+			}
+			if !strings.Contains(stderr.String(), test.stderr) {
+				t.Fatalf("expected %q in the output, got %s", test.stderr, stderr.String())
+			}
+			if code != exitOK {
+				return
+			}
+
+			docs := strings.Split(stdout.String(), "---\n")
+			if len(docs) != len(test.expected) {
+				t.Fatalf("expected %d manifests, got %s", len(test.expected), stdout.String())
+			}
+			for i, doc := range docs {
+				m := manifest{}
+				if err := yaml.Unmarshal([]byte(doc), &m); err != nil {
+					t.Fatal(err)
+				}
+				if len(m.Spec.Groups) != 1 || len(m.Spec.Groups[0].Rules) != 1 {
+					t.Fatalf("expected the groups to be converted, got %s", doc)
+				}
+				m.Spec.Groups = nil
+				if !reflect.DeepEqual(m, test.expected[i]) {
+					t.Fatalf("expected %v, got %v", test.expected[i], m)
+				}
+			}
+		})
+	}
+}
+
+func TestConvertNormalizesRules(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := Convert([]string{"-namespace", "prod", "-enforce"}, strings.NewReader(ruleFileYAML), &stdout, &stderr); code != exitOK {
+		t.Fatalf("expected exit code 0, got %d: %s", code, stderr.String())
+	}
+	m := manifest{}
+	if err := yaml.Unmarshal(stdout.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	group := m.Spec.Groups[0]
+	if group.Interval != "1m30s" {
+		t.Fatalf("expected the interval to be normalized, got %s", group.Interval)
+	}
+	if expr := group.Rules[0].Expr; !strings.Contains(expr, `{app="nginx", namespace="prod"}`) {
+		t.Fatalf("expected the namespace to be enforced, got %s", expr)
+	}
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+	"github.com/opsgy/loki-rule-operator/controllers"
+)
+
+// LabelFlags are labels in the format <key>=<value>, created so that multiple inputs can be accecpted
+type LabelFlags []controllers.Label
+
+func (l *LabelFlags) String() string {
+	str := ""
+	for i, label := range *l {
+		if i > 0 {
+			str += ","
+		}
+		str += label.Name + "=" + label.Value
+	}
+	return str
+}
+
+func (l *LabelFlags) Set(value string) error {
+	pair := strings.SplitN(value, "=", 2)
+	if len(pair) != 2 {
+		return fmt.Errorf("invalid label, should be in the format <key>=<value>")
+	}
+	label := controllers.Label{
+		Name:  strings.TrimSpace(pair[0]),
+		Value: strings.TrimSpace(pair[1]),
+	}
+	*l = append(*l, label)
+	return nil
+}
+
+// TenantNamespacesFlags restrict which namespaces may target a tenant, in the format <tenant>=<namespace regex>
+type TenantNamespacesFlags map[string][]*regexp.Regexp
+
+func (t TenantNamespacesFlags) String() string {
+	var pairs []string
+	for tenant, namespaces := range t {
+		for _, re := range namespaces {
+			pairs = append(pairs, tenant+"="+re.String())
+		}
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (t TenantNamespacesFlags) Set(value string) error {
+	pair := strings.SplitN(value, "=", 2)
+	if len(pair) != 2 {
+		return fmt.Errorf("invalid tenant namespaces, should be in the format <tenant>=<namespace regex>")
+	}
+	re, err := regexp.Compile("^(?:" + strings.TrimSpace(pair[1]) + ")$")
+	if err != nil {
+		return err
+	}
+	tenant := strings.TrimSpace(pair[0])
+	t[tenant] = append(t[tenant], re)
+	return nil
+}
+
+// EnforcedLabelFlags are stream labels enforced with the value of a namespace label or annotation,
+// in the format <stream label>=label:<key> or <stream label>=annotation:<key>
+type EnforcedLabelFlags []loggingv1beta1.EnforcedLabel
+
+func (e *EnforcedLabelFlags) String() string {
+	var pairs []string
+	for _, label := range *e {
+		if label.FromLabel != "" {
+			pairs = append(pairs, label.Name+"=label:"+label.FromLabel)
+		} else {
+			pairs = append(pairs, label.Name+"=annotation:"+label.FromAnnotation)
+		}
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (e *EnforcedLabelFlags) Set(value string) error {
+	pair := strings.SplitN(value, "=", 2)
+	if len(pair) != 2 {
+		return fmt.Errorf("invalid enforced label, should be in the format <stream label>=label:<key> or <stream label>=annotation:<key>")
+	}
+	label := loggingv1beta1.EnforcedLabel{Name: strings.TrimSpace(pair[0])}
+	source := strings.SplitN(strings.TrimSpace(pair[1]), ":", 2)
+	switch {
+	case len(source) == 2 && source[0] == "label":
+		label.FromLabel = source[1]
+	case len(source) == 2 && source[0] == "annotation":
+		label.FromAnnotation = source[1]
+	default:
+		return fmt.Errorf("invalid enforced label, should be in the format <stream label>=label:<key> or <stream label>=annotation:<key>")
+	}
+	*e = append(*e, label)
+	return nil
+}
+
+// RuleFlags are the flags of the manager that decide how the rules are rendered and where they are
+// stored in the rules ConfigMaps. The render command uses the same flags.
+type RuleFlags struct {
+	RulesConfigMap     string
+	ConfigMapMaxSize   int
+	ConfigMapMaxShards int
+	DefaultTenant      string
+	TenantNamespaces   TenantNamespacesFlags
+	ExternalLabels     LabelFlags
+	LabelConflict      string
+	GroupLabel         bool
+	ProvenanceLabels   bool
+	NamespaceLabel     string
+	EnforcedLabels     EnforcedLabelFlags
+	Durations          loggingv1beta1.DurationBounds
+}
+
+// Bind registers the flags
+func (f *RuleFlags) Bind(flags *flag.FlagSet) {
+	f.TenantNamespaces = TenantNamespacesFlags{}
+	flags.StringVar(&f.RulesConfigMap, "rules-configmap", "default/loki-rules", "Configmap name to store all the LokiRules, in the format '<namespace>/<name>'")
+	flags.IntVar(&f.ConfigMapMaxSize, "rules-configmap-max-size", controllers.DefaultConfigMapMaxSize, "Maximum size in bytes of the data of a rules ConfigMap, before the rules are spread over an additional ConfigMap")
+	flags.IntVar(&f.ConfigMapMaxShards, "rules-configmap-max-shards", controllers.DefaultConfigMapMaxShards, "Maximum number of ConfigMaps per tenant to spread the rules over, named '<name>', '<name>.1', '<name>.2', etc. All of them should be mounted into the Loki ruler")
+	flags.StringVar(&f.DefaultTenant, "default-tenant", "fake", "Tenant (X-Scope-OrgID) of rules that don't specify one and are in a namespace without the "+controllers.TenantKey+" annotation or label")
+	flags.Var(f.TenantNamespaces, "tenant-namespaces", "Only allow namespaces matching the regex to use the tenant, in the format <tenant>=<namespace regex>. Can be repeated")
+	flags.Var(&f.ExternalLabels, "external-label", "Add labels to the alert rules, in the format <key>=<value>. The value can be a template of the namespace of the rule, e.g. '{{ .Labels.team }}'. Can be repeated")
+	flags.StringVar(&f.LabelConflict, "label-conflict", string(controllers.LabelConflictOperatorWins), "What to do when a rule already has a label added by the operator: 'operator-wins', 'rule-wins' or 'reject' to make the rule invalid")
+	flags.BoolVar(&f.GroupLabel, "group-label", false, "Always add the '"+controllers.GroupLabel+"' label with the name of the rule group, by default it is only added together with external labels")
+	flags.BoolVar(&f.ProvenanceLabels, "provenance-labels", false, "Add the '"+controllers.RuleNamespaceLabel+"' and '"+controllers.RuleNameLabel+"' labels with the LokiRule or GlobalLokiRule of the rule")
+	flags.StringVar(&f.NamespaceLabel, "namespace-label", loggingv1beta1.DefaultNamespaceLabel, "Stream label that holds the namespace, which is enforced on the expressions of LokiRules")
+	flags.Var(&f.EnforcedLabels, "enforce-label", "Enforce a stream label on the expressions of LokiRules with the value of a label or annotation of their namespace, in the format <stream label>=label:<key> or <stream label>=annotation:<key>. Can be repeated")
+	flags.DurationVar(&f.Durations.MinInterval, "min-interval", 0, "Minimum evaluation interval of a rule group, 0 for no minimum")
+	flags.DurationVar(&f.Durations.MaxInterval, "max-interval", 0, "Maximum evaluation interval of a rule group, 0 for no maximum")
+	flags.DurationVar(&f.Durations.MinFor, "min-for", 0, "Minimum 'for' duration of an alerting rule, 0 for no minimum")
+	flags.DurationVar(&f.Durations.MaxFor, "max-for", 0, "Maximum 'for' duration of an alerting rule, 0 for no maximum")
+}
+
+// Enforcement returns the policy of the stream labels enforced on the expressions of LokiRules
+func (f *RuleFlags) Enforcement() *loggingv1beta1.EnforcementPolicy {
+	return &loggingv1beta1.EnforcementPolicy{NamespaceLabel: f.NamespaceLabel, ExtraLabels: f.EnforcedLabels}
+}
+
+// Labels returns the validated policy of the labels added to the rules
+func (f *RuleFlags) Labels() (*controllers.LabelPolicy, error) {
+	conflict, err := controllers.ParseLabelConflict(f.LabelConflict)
+	if err != nil {
+		return nil, err
+	}
+	labelPolicy := &controllers.LabelPolicy{
+		ExternalLabels: f.ExternalLabels,
+		Conflict:       conflict,
+		Group:          f.GroupLabel,
+		Provenance:     f.ProvenanceLabels,
+	}
+	if err := labelPolicy.Validate(); err != nil {
+		return nil, err
+	}
+	return labelPolicy, nil
+}
+
+// Tenants returns the resolver of the tenants of the rules
+func (f *RuleFlags) Tenants(c client.Client) *controllers.TenantResolver {
+	return &controllers.TenantResolver{
+		Client:            c,
+		DefaultTenant:     f.DefaultTenant,
+		AllowedNamespaces: f.TenantNamespaces,
+	}
+}
+
+// ConfigMapSink returns the sink of the rules ConfigMaps, it creates the rules ConfigMap if it doesn't exist yet
+func (f *RuleFlags) ConfigMapSink(ctx context.Context, clientset kubernetes.Interface) (*controllers.ConfigMapSink, error) {
+	sink, err := controllers.SetupConfigMapSink(ctx, clientset, f.RulesConfigMap, f.DefaultTenant)
+	if err != nil {
+		return nil, err
+	}
+	sink.MaxSize = f.ConfigMapMaxSize
+	sink.MaxShards = f.ConfigMapMaxShards
+	return sink, nil
+}
@@ -0,0 +1,453 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	goerrors "errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+)
+
+// Types of the diagnostics that aren't a field error of a rule
+const (
+	diagnosticYAMLError   = "YAMLError"
+	diagnosticDecodeError = "DecodeError"
+)
+
+// diagnostic is an error found by the lint command
+type diagnostic struct {
+	File   string `json:"file"`
+	Line   int    `json:"line,omitempty"`
+	Column int    `json:"column,omitempty"`
+	// Object is the LokiRule or GlobalLokiRule, e.g. 'LokiRule prod/nginx'
+	Object string `json:"object,omitempty"`
+	// Field is the path of the invalid field, e.g. 'spec.groups[0].rules[1].expr'
+	Field string `json:"field,omitempty"`
+	// Rule is the name of the alerting or recording rule, or of the group
+	Rule string `json:"rule,omitempty"`
+	// Type is the type of the field error, e.g. 'FieldValueInvalid', or 'YAMLError' and 'DecodeError'
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+func (d diagnostic) String() string {
+	location := d.File
+	if d.Line > 0 {
+		location = fmt.Sprintf("%s:%d", d.File, d.Line)
+	}
+	if d.Line > 0 && d.Column > 0 {
+		location = fmt.Sprintf("%s:%d:%d", d.File, d.Line, d.Column)
+	}
+	return location + ": " + d.summary()
+}
+
+// summary returns the object, field and rule of the diagnostic with the message
+func (d diagnostic) summary() string {
+	var parts []string
+	for _, part := range []string{d.Object, d.Field, d.Rule} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(append(parts, d.Message), ": ")
+}
+
+// lintOptions are the flags of the lint command
+type lintOptions struct {
+	Files          stringsFlag
+	Format         string
+	Namespace      string
+	NamespaceLabel string
+	Granted        string
+	Durations      loggingv1beta1.DurationBounds
+	Output         string
+}
+
+const lintDescription = `
+Validates the LokiRules and GlobalLokiRules in multi-document YAML files, like the webhook does:
+the expressions with the enforced namespace, the durations, the labels and the templates of the rules.
+Directories are searched for YAML files, other resources are ignored. Reads stdin when no files are given.
+Prints a diagnostic per error with the line of the invalid field and exits with 1 when there are errors.`
+
+// Lint is the lint command
+func Lint(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	opts := &lintOptions{}
+	flags := newFlagSet("lint", "[flags] [-f file|dir]...", lintDescription, stderr)
+	flags.Var(&opts.Files, "f", "File or directory to lint, can be repeated")
+	flags.StringVar(&opts.Format, "format", "text", "Output format, either 'text', 'json' or 'sarif'")
+	flags.StringVar(&opts.Namespace, "namespace", "", "Namespace of the LokiRules without a namespace, their namespace is not enforced when empty")
+	flags.StringVar(&opts.NamespaceLabel, "namespace-label", loggingv1beta1.DefaultNamespaceLabel, "Stream label that holds the namespace, which is enforced on the expressions of LokiRules")
+	flags.StringVar(&opts.Granted, "granted-namespaces", "", "Comma separated list of the namespaces that granted every namespace access with a LokiRuleGrant")
+	flags.DurationVar(&opts.Durations.MinInterval, "min-interval", 0, "Minimum evaluation interval of a rule group, 0 for no minimum")
+	flags.DurationVar(&opts.Durations.MaxInterval, "max-interval", 0, "Maximum evaluation interval of a rule group, 0 for no maximum")
+	flags.DurationVar(&opts.Durations.MinFor, "min-for", 0, "Minimum 'for' duration of an alerting rule, 0 for no minimum")
+	flags.DurationVar(&opts.Durations.MaxFor, "max-for", 0, "Maximum 'for' duration of an alerting rule, 0 for no maximum")
+	flags.StringVar(&opts.Output, "o", "", "File to write the diagnostics to, defaults to stdout")
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	if opts.Format != "text" && opts.Format != "json" && opts.Format != "sarif" {
+		fmt.Fprintf(stderr, "unknown format %q, should be 'text', 'json' or 'sarif'\n", opts.Format)
+		return exitUsage
+	}
+
+	paths := append(opts.Files, flags.Args()...)
+	files, err := expandPaths(paths)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitFailed
+	}
+	var inputs []input
+	if len(paths) == 0 || len(files) > 0 {
+		if inputs, err = readInputs(files, stdin); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitFailed
+		}
+	}
+	diagnostics := []diagnostic{}
+	for _, in := range inputs {
+		diagnostics = append(diagnostics, opts.lint(in)...)
+	}
+
+	var out bytes.Buffer
+	switch opts.Format {
+	case "text":
+		for _, d := range diagnostics {
+			fmt.Fprintln(&out, d)
+		}
+	case "json":
+		err = writeJSON(&out, diagnostics)
+	case "sarif":
+		err = writeJSON(&out, sarifReport(diagnostics))
+	}
+	if err == nil {
+		err = writeOutput(opts.Output, out.Bytes(), stdout)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitFailed
+	}
+	if len(diagnostics) > 0 {
+		return exitFailed
+	}
+	return exitOK
+}
+
+// lint returns the diagnostics of the documents of a file
+func (opts *lintOptions) lint(in input) []diagnostic {
+	var diagnostics []diagnostic
+	decoder := yaml.NewDecoder(bytes.NewReader(in.Data))
+	for {
+		doc := &yaml.Node{}
+		if err := decoder.Decode(doc); err == io.EOF {
+			break
+		} else if err != nil {
+			// The rest of the file can't be parsed
+			return append(diagnostics, diagnostic{File: in.Name, Line: yamlErrorLine(err), Type: diagnosticYAMLError, Message: err.Error()})
+		}
+		diagnostics = append(diagnostics, opts.lintDocument(in.Name, doc)...)
+	}
+	return diagnostics
+}
+
+var unknownFieldRegexp = regexp.MustCompile(`unknown field "(.*)"`)
+
+// lintDocument returns the diagnostics of a document, documents of other API groups are ignored
+func (opts *lintOptions) lintDocument(file string, doc *yaml.Node) []diagnostic {
+	root := documentRoot(doc)
+	gvk, ok := documentKind(root)
+	if !ok || gvk.Group != loggingv1beta1.GroupVersion.Group {
+		return nil
+	}
+
+	atDocument := diagnostic{File: file, Line: root.Line, Column: root.Column, Object: gvk.Kind, Type: diagnosticDecodeError}
+	obj, err := decodeStrict(root, gvk)
+	if err != nil {
+		// Point to the unknown field, as the decoder doesn't know where it is
+		if match := unknownFieldRegexp.FindStringSubmatch(err.Error()); match != nil {
+			if key := findKey(root, match[1]); key != nil {
+				atDocument.Line, atDocument.Column = key.Line, key.Column
+			}
+		}
+		atDocument.Message = err.Error()
+		return []diagnostic{atDocument}
+	}
+	return opts.validate(atDocument, root, obj)
+}
+
+// documentKind returns the kind of the object of a document
+func documentKind(root *yaml.Node) (schema.GroupVersionKind, bool) {
+	var typeMeta struct {
+		APIVersion string `yaml:"apiVersion"`
+		Kind       string `yaml:"kind"`
+	}
+	if root.Kind != yaml.MappingNode || root.Decode(&typeMeta) != nil {
+		return schema.GroupVersionKind{}, false
+	}
+	gv, err := schema.ParseGroupVersion(typeMeta.APIVersion)
+	if err != nil {
+		return schema.GroupVersionKind{}, false
+	}
+	return gv.WithKind(typeMeta.Kind), true
+}
+
+// decodeStrict decodes a document into an object of the scheme, unknown fields are an error
+func decodeStrict(root *yaml.Node, gvk schema.GroupVersionKind) (runtime.Object, error) {
+	obj, err := scheme.New(gvk)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	if err := root.Decode(&value); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// validate returns the diagnostics of the rules of a LokiRule or GlobalLokiRule
+func (opts *lintOptions) validate(atDocument diagnostic, root *yaml.Node, obj runtime.Object) []diagnostic {
+	var err error
+	switch obj := obj.(type) {
+	case *loggingv1beta1.LokiRule:
+		namespace := obj.Namespace
+		if namespace == "" {
+			namespace = opts.Namespace
+		}
+		var enforced []*labels.Matcher
+		var granted map[string][]string
+		if namespace != "" {
+			enforced = []*labels.Matcher{{Type: labels.MatchEqual, Name: opts.NamespaceLabel, Value: namespace}}
+			granted = map[string][]string{opts.NamespaceLabel: splitList(opts.Granted)}
+		}
+		atDocument.Object = fmt.Sprintf("LokiRule %s/%s", namespace, obj.Name)
+		_, err = obj.ValidateExpressionsWith(enforced, granted, opts.Durations)
+	case *loggingv1beta1.GlobalLokiRule:
+		atDocument.Object = "GlobalLokiRule " + obj.Name
+		_, err = obj.ValidateExpressions(opts.Durations)
+	default:
+		return nil
+	}
+	if err == nil {
+		return nil
+	}
+
+	var ruleErrs loggingv1beta1.RuleErrors
+	if !goerrors.As(err, &ruleErrs) {
+		atDocument.Type = diagnosticDecodeError
+		atDocument.Message = err.Error()
+		return []diagnostic{atDocument}
+	}
+	diagnostics := make([]diagnostic, 0, len(ruleErrs))
+	for _, ruleErr := range ruleErrs {
+		d := atDocument
+		node := nodeAt(root, ruleErr.Field.Field)
+		d.Line, d.Column = node.Line, node.Column
+		d.Field = ruleErr.Field.Field
+		d.Rule = ruleErr.Rule
+		d.Type = string(ruleErr.Field.Type)
+		d.Message = ruleErr.Field.Detail
+		diagnostics = append(diagnostics, d)
+	}
+	return diagnostics
+}
+
+// documentRoot returns the content of a document node
+func documentRoot(doc *yaml.Node) *yaml.Node {
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 {
+		return doc.Content[0]
+	}
+	return doc
+}
+
+// nodeAt returns the node of the field with the path, e.g. 'spec.groups[0].annotations[runbook.url]'.
+// When the field doesn't exist it returns the node of the closest parent.
+func nodeAt(root *yaml.Node, path string) *yaml.Node {
+	node := root
+	for _, segment := range fieldPathSegments(path) {
+		var child *yaml.Node
+		if i, err := strconv.Atoi(segment); err == nil && node.Kind == yaml.SequenceNode {
+			if i < len(node.Content) {
+				child = node.Content[i]
+			}
+		} else {
+			child = mappingValue(node, segment)
+		}
+		if child == nil {
+			return node
+		}
+		node = child
+	}
+	return node
+}
+
+// fieldPathSegments splits a field path into the names of the fields and the indices or keys
+// between brackets, e.g. 'spec', 'groups', '0', 'annotations' and 'runbook.url'. Keys may contain dots.
+func fieldPathSegments(path string) []string {
+	var segments []string
+	for path != "" {
+		switch path[0] {
+		case '.':
+			path = path[1:]
+		case '[':
+			end := strings.Index(path, "]")
+			if end < 0 {
+				return append(segments, path[1:])
+			}
+			segments = append(segments, path[1:end])
+			path = path[end+1:]
+		default:
+			end := strings.IndexAny(path, ".[")
+			if end < 0 {
+				end = len(path)
+			}
+			segments = append(segments, path[:end])
+			path = path[end:]
+		}
+	}
+	return segments
+}
+
+// findKey returns the first key of a mapping with the name, or nil
+func findKey(node *yaml.Node, name string) *yaml.Node {
+	for i, child := range node.Content {
+		if node.Kind == yaml.MappingNode && i%2 == 0 && child.Value == name {
+			return child
+		}
+		if key := findKey(child, name); key != nil {
+			return key
+		}
+	}
+	return nil
+}
+
+// mappingValue returns the value of the key of a mapping node, or nil
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+var yamlErrorLineRegexp = regexp.MustCompile(`line (\d+)`)
+
+// yamlErrorLine returns the line of a YAML syntax error, or 0
+func yamlErrorLine(err error) int {
+	if match := yamlErrorLineRegexp.FindStringSubmatch(err.Error()); match != nil {
+		line, _ := strconv.Atoi(match[1])
+		return line
+	}
+	return 0
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// SARIF 2.1.0 report, see https://docs.oasis-open.org/sarif/sarif/v2.1.0/sarif-v2.1.0.html
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver struct {
+		Name string `json:"name"`
+	} `json:"driver"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation struct {
+		ArtifactLocation struct {
+			URI string `json:"uri"`
+		} `json:"artifactLocation"`
+		Region *sarifRegion `json:"region,omitempty"`
+	} `json:"physicalLocation"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn,omitempty"`
+}
+
+// sarifReport returns the diagnostics as a SARIF report, e.g. for code scanning annotations
+func sarifReport(diagnostics []diagnostic) *sarifLog {
+	run := sarifRun{Results: make([]sarifResult, 0, len(diagnostics))}
+	run.Tool.Driver.Name = "loki-rule-operator"
+	for _, d := range diagnostics {
+		var location sarifLocation
+		location.PhysicalLocation.ArtifactLocation.URI = d.File
+		if d.Line > 0 {
+			location.PhysicalLocation.Region = &sarifRegion{StartLine: d.Line, StartColumn: d.Column}
+		}
+		run.Results = append(run.Results, sarifResult{
+			RuleID:    d.Type,
+			Level:     "error",
+			Message:   sarifMessage{Text: d.summary()},
+			Locations: []sarifLocation{location},
+		})
+	}
+	return &sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{run},
+	}
+}
@@ -0,0 +1,175 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+const manifestsYAML = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ignored
+---
+apiVersion: logging.opsgy.com/v1beta1
+kind: LokiRule
+metadata:
+  name: nginx
+  namespace: prod
+spec:
+  groups:
+  - name: nginx
+    rules:
+    - alert: NginxErrors
+      expr: sum(rate({app="nginx"} |= "error" [5m])) > 10
+      for: 10m
+---
+apiVersion: logging.opsgy.com/v1beta1
+kind: LokiRule
+metadata:
+  name: api
+  namespace: prod
+spec:
+  groups:
+  - name: api
+    interval: 1x
+    rules:
+    - alert: ApiErrors
+      expr: count_over_time({namespace="dev"}[5m]) > 0
+      annotations:
+        summary: '{{ $labels.job }'
+---
+apiVersion: logging.opsgy.com/v1beta1
+kind: GlobalLokiRule
+metadata:
+  name: nodes
+spec:
+  groups:
+  - name: nodes
+    rules:
+    - alert: NodeErrors
+      exprr: count_over_time({job="node"}[5m]) > 0
+`
+
+func TestLint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "rules", "manifests.yaml")
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte(manifestsYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte("# Not YAML {"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := Lint([]string{"-f", dir}, nil, &stdout, &stderr); code != exitFailed {
+		t.Fatalf("expected exit code 1, got %d: %s", code, stderr.String())
+	}
+	expected := []string{
+		file + ":27:15: LokiRule prod/api: spec.groups[0].interval: api: invalid interval '1x': not a valid duration string: \"1x\"",
+		file + ":30:13: LokiRule prod/api: spec.groups[0].rules[0].expr: ApiErrors: 'namespace' selector should equals 'prod', got namespace=\"dev\" at position 17",
+		file + ":32:18: LokiRule prod/api: spec.groups[0].rules[0].annotations[summary]: ApiErrors: ",
+		file + ":43:7: GlobalLokiRule: json: unknown field \"exprr\"",
+	}
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d diagnostics, got %s", len(expected), stdout.String())
+	}
+	for i := range expected {
+		if !strings.HasPrefix(lines[i], expected[i]) {
+			t.Fatalf("expected diagnostic %q, got %q", expected[i], lines[i])
+		}
+	}
+
+	stdout.Reset()
+	if code := Lint([]string{"-format", "json", file}, nil, &stdout, &stderr); code != exitFailed {
+		t.Fatalf("expected exit code 1, got %d: %s", code, stderr.String())
+	}
+	var diagnostics []diagnostic
+	if err := json.Unmarshal(stdout.Bytes(), &diagnostics); err != nil {
+		t.Fatal(err)
+	}
+	if len(diagnostics) != 4 || diagnostics[1].Line != 30 || diagnostics[1].Type != "FieldValueInvalid" || diagnostics[1].Rule != "ApiErrors" {
+		t.Fatalf("unexpected diagnostics %v", diagnostics)
+	}
+
+	stdout.Reset()
+	if code := Lint([]string{"-format", "sarif", "-f", file}, nil, &stdout, &stderr); code != exitFailed {
+		t.Fatalf("expected exit code 1, got %d: %s", code, stderr.String())
+	}
+	report := &sarifLog{}
+	if err := json.Unmarshal(stdout.Bytes(), report); err != nil {
+		t.Fatal(err)
+	}
+	results := report.Runs[0].Results
+	if len(results) != 4 || results[1].Locations[0].PhysicalLocation.Region.StartLine != 30 || results[1].Locations[0].PhysicalLocation.ArtifactLocation.URI != file {
+		t.Fatalf("unexpected SARIF results %v", results)
+	}
+}
+
+func TestLintValid(t *testing.T) {
+	valid := strings.SplitN(manifestsYAML, "---\napiVersion: logging.opsgy.com/v1beta1\nkind: LokiRule\nmetadata:\n  name: api", 2)[0]
+	var stdout, stderr bytes.Buffer
+	if code := Lint(nil, strings.NewReader(valid), &stdout, &stderr); code != exitOK {
+		t.Fatalf("expected exit code 0, got %d: %s%s", code, stdout.String(), stderr.String())
+	}
+
+	// Without a namespace, the namespace isn't enforced unless given
+	withoutNamespace := strings.Replace(strings.Replace(valid, "  namespace: prod\n", "", 1), `app="nginx"`, `namespace="dev"`, 1)
+	if code := Lint(nil, strings.NewReader(withoutNamespace), &stdout, &stderr); code != exitOK {
+		t.Fatalf("expected exit code 0, got %d: %s%s", code, stdout.String(), stderr.String())
+	}
+	if code := Lint([]string{"-namespace", "prod"}, strings.NewReader(withoutNamespace), &stdout, &stderr); code != exitFailed {
+		t.Fatalf("expected exit code 1, got %d", code)
+	}
+
+	stdout.Reset()
+	if code := Lint(nil, strings.NewReader("groups: [\n"), &stdout, &stderr); code != exitFailed {
+		t.Fatalf("expected exit code 1, got %d", code)
+	}
+	if !strings.HasPrefix(stdout.String(), "-:1: ") {
+		t.Fatalf("expected the line of the YAML error, got %s", stdout.String())
+	}
+}
+
+// Keys between brackets may contain dots, like the names of annotations
+func TestNodeAt(t *testing.T) {
+	const manifest = `spec:
+  groups:
+  - name: api
+    rules:
+    - alert: ApiErrors
+      annotations:
+        runbook.url: https://example.com
+        summary: errors
+`
+	root := &yaml.Node{}
+	if err := yaml.Unmarshal([]byte(manifest), root); err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]int{
+		"spec.groups[0].rules[0].annotations[runbook.url]": 7,
+		"spec.groups[0].rules[0].annotations[summary]":     8,
+		"spec.groups[0].rules[0].alert":                    5,
+		"spec.groups[0].rules[0].annotations[missing]":     7,
+		"spec.groups[1].name":                              3,
+	}
+	for path, line := range tests {
+		if node := nodeAt(documentRoot(root), path); node.Line != line {
+			t.Fatalf("expected %s at line %d, got %d", path, line, node.Line)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+	"github.com/opsgy/loki-rule-operator/controllers"
+)
+
+// renderOptions are the flags of the render command
+type renderOptions struct {
+	RuleFlags
+	Files  stringsFlag
+	Output string
+}
+
+const renderDescription = `
+Renders the rules files the operator writes into the rules ConfigMaps, for the LokiRules and
+GlobalLokiRules in multi-document YAML files. The rules are reconciled by the controllers of the
+operator against an in-memory cluster, so they are validated, enforced, labeled, named and
+assigned to tenants and ConfigMaps exactly like in a cluster, given the same flags as the manager.
+Namespaces and LokiRuleGrants in the files are used for the enforcement, labels and tenants,
+other namespaces have no labels or annotations. Reads stdin when no files are given.
+Writes the ConfigMaps to stdout, or with -o the files to '<dir>/<tenant>/<key>' like the ruler
+mounts them. Exits with 1 when a rule is invalid, the valid rules are still rendered.`
+
+// Render is the render command
+func Render(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	opts := &renderOptions{}
+	flags := newFlagSet("render", "[flags] [-f file|dir]...", renderDescription, stderr)
+	opts.RuleFlags.Bind(flags)
+	flags.Var(&opts.Files, "f", "File or directory with the manifests, can be repeated")
+	flags.StringVar(&opts.Output, "o", "", "Directory to write the rules files to, by default the ConfigMaps are written to stdout")
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	labelPolicy, err := opts.Labels()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+
+	paths := append(opts.Files, flags.Args()...)
+	files, err := expandPaths(paths)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitFailed
+	}
+	var inputs []input
+	if len(paths) == 0 || len(files) > 0 {
+		if inputs, err = readInputs(files, stdin); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitFailed
+		}
+	}
+	objs, err := decodeObjects(inputs)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitFailed
+	}
+
+	ctx := context.Background()
+	cluster, err := newRenderCluster(ctx, objs, &opts.RuleFlags, labelPolicy)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitFailed
+	}
+	failed := false
+	for _, obj := range cluster.rules {
+		if err := cluster.reconcile(ctx, obj); err != nil {
+			fmt.Fprintf(stderr, "%s %s: %s\n", obj.GetObjectKind().GroupVersionKind().Kind, client.ObjectKeyFromObject(obj), err)
+			failed = true
+		}
+	}
+
+	if opts.Output != "" {
+		err = cluster.writeFiles(ctx, opts.Output)
+	} else {
+		err = cluster.writeConfigMaps(ctx, stdout)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitFailed
+	}
+	if failed {
+		return exitFailed
+	}
+	return exitOK
+}
+
+// decodeObjects returns the LokiRules, GlobalLokiRules, LokiRuleGrants and Namespaces in the files
+func decodeObjects(inputs []input) ([]client.Object, error) {
+	var objs []client.Object
+	for _, in := range inputs {
+		decoder := yamlv3.NewDecoder(bytes.NewReader(in.Data))
+		for {
+			doc := &yamlv3.Node{}
+			if err := decoder.Decode(doc); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("%s: %w", in.Name, err)
+			}
+			root := documentRoot(doc)
+			gvk, ok := documentKind(root)
+			if !ok || (gvk.Group != loggingv1beta1.GroupVersion.Group && gvk != v1.SchemeGroupVersion.WithKind("Namespace")) {
+				continue
+			}
+			obj, err := decodeStrict(root, gvk)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", in.Name, root.Line, err)
+			}
+			switch obj.(type) {
+			case *loggingv1beta1.LokiRule, *loggingv1beta1.GlobalLokiRule, *loggingv1beta1.LokiRuleGrant, *v1.Namespace:
+				clientObj := obj.(client.Object)
+				// The in-memory cluster sets the resource version
+				clientObj.SetResourceVersion("")
+				objs = append(objs, clientObj)
+			}
+		}
+	}
+	return objs, nil
+}
+
+// renderCluster is an in-memory cluster with the controllers of the operator
+type renderCluster struct {
+	client    client.Client
+	clientset *k8sfake.Clientset
+	sink      *controllers.ConfigMapSink
+	// rules are the LokiRules and GlobalLokiRules, in the order of the names of their rules
+	rules []client.Object
+
+	lokiRules       *controllers.LokiRuleReconciler
+	globalLokiRules *controllers.GlobalLokiRuleReconciler
+}
+
+func newRenderCluster(ctx context.Context, objs []client.Object, flags *RuleFlags, labelPolicy *controllers.LabelPolicy) (*renderCluster, error) {
+	cluster := &renderCluster{clientset: k8sfake.NewSimpleClientset()}
+
+	// Every namespace of a LokiRule exists
+	namespaces := make(map[string]bool)
+	for _, obj := range objs {
+		if ns, ok := obj.(*v1.Namespace); ok {
+			namespaces[ns.Name] = true
+		}
+	}
+	for _, obj := range objs {
+		switch obj.(type) {
+		case *loggingv1beta1.LokiRule:
+			if obj.GetNamespace() == "" {
+				return nil, fmt.Errorf("LokiRule %s has no namespace", obj.GetName())
+			}
+			if !namespaces[obj.GetNamespace()] {
+				namespaces[obj.GetNamespace()] = true
+				objs = append(objs, &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: obj.GetNamespace()}})
+			}
+			cluster.rules = append(cluster.rules, obj)
+		case *loggingv1beta1.GlobalLokiRule:
+			cluster.rules = append(cluster.rules, obj)
+		}
+	}
+	sort.Slice(cluster.rules, func(i, j int) bool {
+		return controllers.RuleName(cluster.rules[i]) < controllers.RuleName(cluster.rules[j])
+	})
+	cluster.client = fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+
+	var err error
+	if cluster.sink, err = flags.ConfigMapSink(ctx, cluster.clientset); err != nil {
+		return nil, err
+	}
+	tenants := flags.Tenants(cluster.client)
+	recorder := &record.FakeRecorder{}
+	cluster.lokiRules = &controllers.LokiRuleReconciler{
+		Client:      cluster.client,
+		Log:         logf.NullLogger{},
+		Scheme:      scheme,
+		Sink:        cluster.sink,
+		Tenants:     tenants,
+		Labels:      labelPolicy,
+		Recorder:    recorder,
+		Enforcement: flags.Enforcement(),
+		Durations:   flags.Durations,
+	}
+	cluster.globalLokiRules = &controllers.GlobalLokiRuleReconciler{
+		Client:    cluster.client,
+		Log:       logf.NullLogger{},
+		Scheme:    scheme,
+		Sink:      cluster.sink,
+		Tenants:   tenants,
+		Labels:    labelPolicy,
+		Recorder:  recorder,
+		Durations: flags.Durations,
+	}
+	return cluster, nil
+}
+
+// reconcile reconciles a LokiRule or GlobalLokiRule and returns why its rules are invalid
+func (c *renderCluster) reconcile(ctx context.Context, obj client.Object) error {
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(obj)}
+	var err error
+	switch obj.(type) {
+	case *loggingv1beta1.LokiRule:
+		_, err = c.lokiRules.Reconcile(ctx, req)
+	case *loggingv1beta1.GlobalLokiRule:
+		_, err = c.globalLokiRules.Reconcile(ctx, req)
+	}
+	if err != nil {
+		return err
+	}
+
+	var valid bool
+	var message string
+	switch obj.(type) {
+	case *loggingv1beta1.LokiRule:
+		lokiRule := &loggingv1beta1.LokiRule{}
+		err = c.client.Get(ctx, req.NamespacedName, lokiRule)
+		valid, message = lokiRule.Status.Valid, lokiRule.Status.Message
+	case *loggingv1beta1.GlobalLokiRule:
+		globalLokiRule := &loggingv1beta1.GlobalLokiRule{}
+		err = c.client.Get(ctx, types.NamespacedName{Name: req.Name}, globalLokiRule)
+		valid, message = globalLokiRule.Status.Valid, globalLokiRule.Status.Message
+	}
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return fmt.Errorf("%s", message)
+	}
+	return nil
+}
+
+// configMaps returns the rules ConfigMaps, by name
+func (c *renderCluster) configMaps(ctx context.Context) ([]v1.ConfigMap, error) {
+	list, err := c.clientset.CoreV1().ConfigMaps(c.sink.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list.Items, func(i, j int) bool {
+		return list.Items[i].Name < list.Items[j].Name
+	})
+	return list.Items, nil
+}
+
+// configMapManifest is the manifest of a rules ConfigMap
+type configMapManifest struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Metadata   struct {
+		Name      string            `yaml:"name"`
+		Namespace string            `yaml:"namespace"`
+		Labels    map[string]string `yaml:"labels,omitempty"`
+	} `yaml:"metadata"`
+	Data map[string]string `yaml:"data,omitempty"`
+}
+
+// writeConfigMaps writes the manifests of the rules ConfigMaps
+func (c *renderCluster) writeConfigMaps(ctx context.Context, w io.Writer) error {
+	cms, err := c.configMaps(ctx)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	for i, cm := range cms {
+		if i > 0 {
+			out.WriteString("---\n")
+		}
+		m := &configMapManifest{APIVersion: "v1", Kind: "ConfigMap", Data: cm.Data}
+		m.Metadata.Name, m.Metadata.Namespace, m.Metadata.Labels = cm.Name, cm.Namespace, cm.Labels
+		data, err := yaml.Marshal(m)
+		if err != nil {
+			return err
+		}
+		out.Write(data)
+	}
+	_, err = w.Write(out.Bytes())
+	return err
+}
+
+// writeFiles writes the rules files to '<dir>/<tenant>/<key>'
+func (c *renderCluster) writeFiles(ctx context.Context, dir string) error {
+	return c.readFiles(ctx, func(file controllers.RuleFile, data string) error {
+		path := filepath.Join(dir, file.Tenant, file.Key)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(path, []byte(data), 0644)
+	})
+}
+
+// ruleGroups returns the rendered rule groups of all tenants
+func (c *renderCluster) ruleGroups(ctx context.Context) ([]*loggingv1beta1.LokiRuleGroup, error) {
+	var groups []*loggingv1beta1.LokiRuleGroup
+	err := c.readFiles(ctx, func(file controllers.RuleFile, data string) error {
+		spec := &loggingv1beta1.LokiRuleSpec{}
+		if err := yaml.Unmarshal([]byte(data), spec); err != nil {
+			return fmt.Errorf("%s/%s: %w", file.Tenant, file.Key, err)
+		}
+		groups = append(groups, spec.Groups...)
+		return nil
+	})
+	return groups, err
+}
+
+// readFiles calls fn with every rules file in the rules ConfigMaps
+func (c *renderCluster) readFiles(ctx context.Context, fn func(file controllers.RuleFile, data string) error) error {
+	cms, err := c.configMaps(ctx)
+	if err != nil {
+		return err
+	}
+	data := make(map[string]map[string]string, len(cms))
+	for _, cm := range cms {
+		data[cm.Name] = cm.Data
+	}
+	files, err := c.sink.ListFiles(ctx)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := fn(file, data[file.ConfigMap][file.Key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
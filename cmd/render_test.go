@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+const renderYAML = `apiVersion: v1
+kind: Namespace
+metadata:
+  name: prod
+  labels:
+    team: payments
+  annotations:
+    logging.opsgy.com/tenant: team-a
+---
+apiVersion: logging.opsgy.com/v1beta1
+kind: LokiRule
+metadata:
+  name: nginx
+  namespace: prod
+spec:
+  groups:
+  - name: nginx
+    rules:
+    - alert: NginxErrors
+      expr: sum(rate({app="nginx"} |= "error" [5m])) > 10
+---
+apiVersion: logging.opsgy.com/v1beta1
+kind: LokiRule
+metadata:
+  name: api
+  namespace: dev
+spec:
+  groups:
+  - name: api
+    rules:
+    - alert: ApiErrors
+      expr: count_over_time({namespace="prod"}[5m]) > 0
+---
+apiVersion: logging.opsgy.com/v1beta1
+kind: GlobalLokiRule
+metadata:
+  name: nodes
+spec:
+  groups:
+  - name: nodes
+    rules:
+    - record: node:errors:rate5m
+      expr: sum by (node) (rate({job="node"} |= "error" [5m]))
+`
+
+func TestRender(t *testing.T) {
+	args := []string{"-rules-configmap", "loki/loki-rules", "-external-label", "team={{ .Labels.team }}"}
+	var stdout, stderr bytes.Buffer
+	if code := Render(args, strings.NewReader(renderYAML), &stdout, &stderr); code != exitFailed {
+		t.Fatalf("expected exit code 1 for the invalid rule, got %d: %s", code, stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "LokiRule dev/api: ApiErrors: 'namespace' selector should equals 'dev'") {
+		t.Fatalf("expected the invalid rule to be reported, got %s", stderr.String())
+	}
+
+	docs := strings.Split(stdout.String(), "---\n")
+	if len(docs) != 2 {
+		t.Fatalf("expected the ConfigMaps of 2 tenants, got %s", stdout.String())
+	}
+	cms := make(map[string]*configMapManifest)
+	for _, doc := range docs {
+		cm := &configMapManifest{}
+		if err := yaml.Unmarshal([]byte(doc), cm); err != nil {
+			t.Fatal(err)
+		}
+		if cm.Metadata.Namespace != "loki" || cm.Metadata.Labels["app.kubernetes.io/managed-by"] != "loki-rule-operator" {
+			t.Fatalf("unexpected metadata of ConfigMap %v", cm.Metadata)
+		}
+		cms[cm.Metadata.Name] = cm
+	}
+	nginx := cms["loki-rules-team-a"].Data["lokirule__prod__nginx.yaml"]
+	for _, expected := range []string{`{app="nginx", namespace="prod"}`, "team: payments", "group: nginx"} {
+		if !strings.Contains(nginx, expected) {
+			t.Fatalf("expected %q in the rules of the LokiRule, got %s", expected, nginx)
+		}
+	}
+	if nodes := cms["loki-rules"].Data["globallokirule__nodes.yaml"]; !strings.Contains(nodes, "record: node:errors:rate5m") {
+		t.Fatalf("expected the rules of the GlobalLokiRule in the default tenant, got %v", cms["loki-rules"].Data)
+	}
+}
+
+func TestRenderFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "render")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "rules.yaml")
+	if err := ioutil.WriteFile(input, []byte(renderYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(dir, "out")
+	var stdout, stderr bytes.Buffer
+	if code := Render([]string{"-default-tenant", "main", "-f", input, "-o", output}, nil, &stdout, &stderr); code != exitFailed {
+		t.Fatalf("expected exit code 1 for the invalid rule, got %d: %s", code, stderr.String())
+	}
+	for _, file := range []string{"team-a/lokirule__prod__nginx.yaml", "main/globallokirule__nodes.yaml"} {
+		data, err := ioutil.ReadFile(filepath.Join(output, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(data), "groups:\n") {
+			t.Fatalf("expected a rules file in %s, got %s", file, data)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(output, "main", "lokirule__dev__api.yaml")); !os.IsNotExist(err) {
+		t.Fatalf("expected the invalid rules not to be rendered, got %v", err)
+	}
+}
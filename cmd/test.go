@@ -0,0 +1,519 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/grafana/loki/pkg/iter"
+	"github.com/grafana/loki/pkg/logproto"
+	"github.com/grafana/loki/pkg/logql"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/rules"
+	"gopkg.in/yaml.v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+	"github.com/opsgy/loki-rule-operator/controllers"
+)
+
+// testOptions are the flags of the test command
+type testOptions struct {
+	RuleFlags
+}
+
+const testDescription = `
+Runs unit tests of the alerting rules of LokiRules and GlobalLokiRules, like 'promtool test rules'
+does for Prometheus. A test file lists the files or directories with the manifests, relative to
+the test file, and the tests. Every test has log streams with the lines at a time after the start
+of the test, and the alerts that should fire at an evaluation time. The rules are rendered like
+the render command does, given the same flags as the manager, and the rule groups are evaluated
+at their interval with the LogQL engine of Loki against the log streams in memory, so the 'for'
+durations, labels and annotation templates are applied like the ruler does. Reports the alerts
+that don't match and exits with 1 when a test fails.`
+
+// Test is the test command
+func Test(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	opts := &testOptions{}
+	flags := newFlagSet("test", "[flags] test-file...", testDescription, stderr)
+	opts.RuleFlags.Bind(flags)
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	labelPolicy, err := opts.Labels()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+	if flags.NArg() == 0 {
+		fmt.Fprintln(stderr, "no test files given")
+		return exitUsage
+	}
+
+	failed := false
+	for _, file := range flags.Args() {
+		failures, err := opts.runTestFile(file, labelPolicy)
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %s\n", file, err)
+			failed = true
+			continue
+		}
+		if len(failures) > 0 {
+			for _, failure := range failures {
+				fmt.Fprintf(stdout, "%s: %s\n", file, failure)
+			}
+			failed = true
+			continue
+		}
+		fmt.Fprintf(stdout, "%s: ok\n", file)
+	}
+	if failed {
+		return exitFailed
+	}
+	return exitOK
+}
+
+// testFile is a file with unit tests of the alerting rules, in the format of promtool
+type testFile struct {
+	// RuleFiles are the files or directories with the manifests, relative to the test file
+	RuleFiles []string `yaml:"rule_files"`
+	// EvaluationInterval of the rule groups without an interval, defaults to 1m like the ruler
+	EvaluationInterval model.Duration `yaml:"evaluation_interval,omitempty"`
+	Tests              []ruleTest     `yaml:"tests"`
+}
+
+type ruleTest struct {
+	Name           string          `yaml:"name,omitempty"`
+	InputStreams   []inputStream   `yaml:"input_streams"`
+	AlertRuleTests []alertRuleTest `yaml:"alert_rule_test"`
+}
+
+// inputStream is a log stream of a test
+type inputStream struct {
+	Labels  map[string]string `yaml:"labels"`
+	Entries []inputEntry      `yaml:"entries"`
+}
+
+// inputEntry is a log line at a time after the start of the test, repeated Count times every Interval
+type inputEntry struct {
+	Ts       model.Duration `yaml:"ts"`
+	Line     string         `yaml:"line"`
+	Count    int            `yaml:"count,omitempty"`
+	Interval model.Duration `yaml:"interval,omitempty"`
+}
+
+// alertRuleTest are the alerts of an alerting rule that should fire at the evaluation time
+type alertRuleTest struct {
+	EvalTime  model.Duration `yaml:"eval_time"`
+	Alertname string         `yaml:"alertname"`
+	ExpAlerts []expAlert     `yaml:"exp_alerts"`
+}
+
+type expAlert struct {
+	// ExpLabels are the labels of the alert, without the alertname
+	ExpLabels      map[string]string `yaml:"exp_labels"`
+	ExpAnnotations map[string]string `yaml:"exp_annotations"`
+}
+
+// testStart is the time at the start of every test, like promtool
+var testStart = time.Unix(0, 0).UTC()
+
+// runTestFile runs the tests in the file and returns the failures
+func (opts *testOptions) runTestFile(file string, labelPolicy *controllers.LabelPolicy) ([]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	tf := &testFile{}
+	if err := yaml.UnmarshalStrict(data, tf); err != nil {
+		return nil, err
+	}
+	if tf.EvaluationInterval == 0 {
+		tf.EvaluationInterval = model.Duration(time.Minute)
+	}
+	groups, err := opts.renderRuleGroups(filepath.Dir(file), tf.RuleFiles, labelPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	var failures []string
+	for i, test := range tf.Tests {
+		name := test.Name
+		if name == "" {
+			name = fmt.Sprintf("tests[%d]", i)
+		}
+		errs, err := test.run(groups, time.Duration(tf.EvaluationInterval))
+		if err != nil {
+			return nil, fmt.Errorf("test %q: %w", name, err)
+		}
+		for _, e := range errs {
+			failures = append(failures, fmt.Sprintf("test %q: %s", name, e))
+		}
+	}
+	return failures, nil
+}
+
+// renderRuleGroups renders the rule groups of the LokiRules and GlobalLokiRules in the files, of all tenants
+func (opts *testOptions) renderRuleGroups(dir string, ruleFiles []string, labelPolicy *controllers.LabelPolicy) ([]*loggingv1beta1.LokiRuleGroup, error) {
+	if len(ruleFiles) == 0 {
+		return nil, fmt.Errorf("no rule_files given")
+	}
+	paths := make([]string, 0, len(ruleFiles))
+	for _, ruleFile := range ruleFiles {
+		if !filepath.IsAbs(ruleFile) {
+			ruleFile = filepath.Join(dir, ruleFile)
+		}
+		paths = append(paths, ruleFile)
+	}
+	files, err := expandPaths(paths)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no manifests found in %s", strings.Join(ruleFiles, ", "))
+	}
+	inputs, err := readInputs(files, nil)
+	if err != nil {
+		return nil, err
+	}
+	objs, err := decodeObjects(inputs)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	cluster, err := newRenderCluster(ctx, objs, &opts.RuleFlags, labelPolicy)
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range cluster.rules {
+		if err := cluster.reconcile(ctx, obj); err != nil {
+			return nil, fmt.Errorf("%s %s: %w", obj.GetObjectKind().GroupVersionKind().Kind, client.ObjectKeyFromObject(obj), err)
+		}
+	}
+	return cluster.ruleGroups(ctx)
+}
+
+// run evaluates the rule groups against the input streams and returns the alerts that don't match
+func (test *ruleTest) run(groups []*loggingv1beta1.LokiRuleGroup, defaultInterval time.Duration) ([]string, error) {
+	querier, err := newStreamQuerier(test.InputStreams)
+	if err != nil {
+		return nil, err
+	}
+	evalGroups, err := newEvalGroups(groups, defaultInterval)
+	if err != nil {
+		return nil, err
+	}
+	query := engineQueryFunc(logql.NewEngine(logql.EngineOpts{}, querier))
+
+	// The alerts are checked in the order of their evaluation times
+	alertTests := make([]alertRuleTest, len(test.AlertRuleTests))
+	copy(alertTests, test.AlertRuleTests)
+	sort.SliceStable(alertTests, func(i, j int) bool {
+		return alertTests[i].EvalTime < alertTests[j].EvalTime
+	})
+
+	ctx := context.Background()
+	var failures []string
+	for _, alertTest := range alertTests {
+		evalTime := time.Duration(alertTest.EvalTime)
+		found := false
+		var got []string
+		for _, group := range evalGroups {
+			if err := group.evalUntil(ctx, evalTime, query); err != nil {
+				return nil, err
+			}
+			for _, rule := range group.rules {
+				if rule.Name() != alertTest.Alertname {
+					continue
+				}
+				found = true
+				for _, alert := range rule.ActiveAlerts() {
+					if alert.State == rules.StateFiring {
+						got = append(got, formatAlert(alert.Labels, alert.Annotations))
+					}
+				}
+			}
+		}
+		if !found {
+			failures = append(failures, fmt.Sprintf("%s at %s: no alerting rule with this name", alertTest.Alertname, alertTest.EvalTime))
+			continue
+		}
+
+		var expected []string
+		for _, exp := range alertTest.ExpAlerts {
+			lbs := labels.NewBuilder(labels.FromMap(exp.ExpLabels)).Set(labels.AlertName, alertTest.Alertname).Labels()
+			expected = append(expected, formatAlert(lbs, labels.FromMap(exp.ExpAnnotations)))
+		}
+		sort.Strings(expected)
+		sort.Strings(got)
+		if strings.Join(expected, "\n") != strings.Join(got, "\n") {
+			failures = append(failures, fmt.Sprintf("%s at %s:\n  expected:%s\n  got:%s",
+				alertTest.Alertname, alertTest.EvalTime, formatAlerts(expected), formatAlerts(got)))
+		}
+	}
+	return failures, nil
+}
+
+func formatAlert(lbs labels.Labels, annotations labels.Labels) string {
+	return lbs.String() + " annotations: " + annotations.String()
+}
+
+func formatAlerts(alerts []string) string {
+	if len(alerts) == 0 {
+		return " none"
+	}
+	return "\n    " + strings.Join(alerts, "\n    ")
+}
+
+// evalGroup is a rule group that is evaluated at its interval from the start of the test
+type evalGroup struct {
+	name     string
+	interval time.Duration
+	// next is the time of the next evaluation after the start of the test
+	next  time.Duration
+	rules []*rules.AlertingRule
+}
+
+// newEvalGroups returns the alerting rules of the rule groups, recording rules can't be tested
+func newEvalGroups(groups []*loggingv1beta1.LokiRuleGroup, defaultInterval time.Duration) ([]*evalGroup, error) {
+	evalGroups := make([]*evalGroup, 0, len(groups))
+	for _, group := range groups {
+		g := &evalGroup{name: group.Name, interval: defaultInterval}
+		if group.Interval != "" {
+			interval, err := model.ParseDuration(group.Interval)
+			if err != nil {
+				return nil, fmt.Errorf("group %s: %w", group.Name, err)
+			}
+			g.interval = time.Duration(interval)
+		}
+		for _, rule := range group.Rules {
+			if rule.Alert == "" {
+				continue
+			}
+			expr, err := logql.ParseExpr(rule.Expr)
+			if err != nil {
+				return nil, fmt.Errorf("group %s: %s: %w", group.Name, rule.Alert, err)
+			}
+			var hold model.Duration
+			if rule.For != "" {
+				if hold, err = model.ParseDuration(rule.For); err != nil {
+					return nil, fmt.Errorf("group %s: %s: %w", group.Name, rule.Alert, err)
+				}
+			}
+			g.rules = append(g.rules, rules.NewAlertingRule(rule.Alert, exprAdapter{expr}, time.Duration(hold),
+				labels.FromMap(rule.Labels), labels.FromMap(rule.Annotations), nil, false, log.NewNopLogger()))
+		}
+		evalGroups = append(evalGroups, g)
+	}
+	return evalGroups, nil
+}
+
+// evalUntil evaluates the rules of the group at every interval up to and including the time
+func (g *evalGroup) evalUntil(ctx context.Context, until time.Duration, query rules.QueryFunc) error {
+	for ; g.next <= until; g.next += g.interval {
+		for _, rule := range g.rules {
+			if _, err := rule.Eval(ctx, testStart.Add(g.next), query, nil); err != nil {
+				return fmt.Errorf("group %s: %s at %s: %w", g.name, rule.Name(), model.Duration(g.next), err)
+			}
+		}
+	}
+	return nil
+}
+
+// engineQueryFunc runs the instant queries of the rules with the LogQL engine, like the ruler does
+func engineQueryFunc(engine *logql.Engine) rules.QueryFunc {
+	return func(ctx context.Context, qs string, t time.Time) (promql.Vector, error) {
+		params := logql.NewLiteralParams(qs, t, t, 0, 0, logproto.FORWARD, 0, nil)
+		res, err := engine.Query(params).Exec(ctx)
+		if err != nil {
+			return nil, err
+		}
+		switch v := res.Data.(type) {
+		case promql.Vector:
+			return v, nil
+		case promql.Scalar:
+			return promql.Vector{promql.Sample{Point: promql.Point(v), Metric: labels.Labels{}}}, nil
+		default:
+			return nil, errors.New("rule result is not a vector or scalar")
+		}
+	}
+}
+
+// exprAdapter makes a LogQL expression usable as the expression of an alerting rule
+type exprAdapter struct {
+	logql.Expr
+}
+
+func (exprAdapter) PositionRange() parser.PositionRange { return parser.PositionRange{} }
+func (exprAdapter) PromQLExpr()                         {}
+func (exprAdapter) Type() parser.ValueType              { return parser.ValueTypeVector }
+
+// fixtureStream is an input stream of a test, with the entries in the order of their time
+type fixtureStream struct {
+	labels  labels.Labels
+	entries []logproto.Entry
+}
+
+// streamQuerier is a LogQL querier of the input streams of a test in memory
+type streamQuerier struct {
+	streams []fixtureStream
+}
+
+func newStreamQuerier(inputs []inputStream) (*streamQuerier, error) {
+	q := &streamQuerier{}
+	for i, input := range inputs {
+		if len(input.Labels) == 0 {
+			return nil, fmt.Errorf("input_streams[%d]: a stream needs labels", i)
+		}
+		for name := range input.Labels {
+			if !model.LabelName(name).IsValid() {
+				return nil, fmt.Errorf("input_streams[%d]: invalid label name %q", i, name)
+			}
+		}
+		stream := fixtureStream{labels: labels.FromMap(input.Labels)}
+		for j, entry := range input.Entries {
+			count := entry.Count
+			if count == 0 {
+				count = 1
+			} else if count < 0 {
+				return nil, fmt.Errorf("input_streams[%d].entries[%d]: count can't be negative", i, j)
+			}
+			for n := 0; n < count; n++ {
+				ts := testStart.Add(time.Duration(entry.Ts) + time.Duration(n)*time.Duration(entry.Interval))
+				stream.entries = append(stream.entries, logproto.Entry{Timestamp: ts, Line: entry.Line})
+			}
+		}
+		sort.SliceStable(stream.entries, func(a, b int) bool {
+			return stream.entries[a].Timestamp.Before(stream.entries[b].Timestamp)
+		})
+		q.streams = append(q.streams, stream)
+	}
+	return q, nil
+}
+
+// matching returns the streams that match all the matchers
+func (q *streamQuerier) matching(matchers []*labels.Matcher) []fixtureStream {
+	var streams []fixtureStream
+outer:
+	for _, stream := range q.streams {
+		for _, matcher := range matchers {
+			if !matcher.Matches(stream.labels.Get(matcher.Name)) {
+				continue outer
+			}
+		}
+		streams = append(streams, stream)
+	}
+	return streams
+}
+
+// inRange returns whether the entry is in the time range of a query, the end is excluded like in Loki
+func inRange(entry logproto.Entry, start, end time.Time) bool {
+	return !entry.Timestamp.Before(start) && entry.Timestamp.Before(end)
+}
+
+// SelectLogs returns the lines of the streams matching the selector, after the pipeline of the query
+func (q *streamQuerier) SelectLogs(ctx context.Context, req logql.SelectLogParams) (iter.EntryIterator, error) {
+	selector, err := req.LogSelector()
+	if err != nil {
+		return nil, err
+	}
+	pipeline, err := selector.Pipeline()
+	if err != nil {
+		return nil, err
+	}
+	byLabels := make(map[string]*logproto.Stream)
+	var keys []string
+	for _, stream := range q.matching(selector.Matchers()) {
+		for _, entry := range stream.entries {
+			if !inRange(entry, req.Start, req.End) {
+				continue
+			}
+			line, lbs, ok := pipeline.Process([]byte(entry.Line), stream.labels)
+			if !ok {
+				continue
+			}
+			key := lbs.String()
+			if _, ok := byLabels[key]; !ok {
+				byLabels[key] = &logproto.Stream{Labels: key}
+				keys = append(keys, key)
+			}
+			byLabels[key].Entries = append(byLabels[key].Entries, logproto.Entry{Timestamp: entry.Timestamp, Line: string(line)})
+		}
+	}
+	streams := make([]logproto.Stream, 0, len(keys))
+	for _, key := range keys {
+		stream := byLabels[key]
+		sort.SliceStable(stream.Entries, func(i, j int) bool {
+			if req.Direction == logproto.BACKWARD {
+				return stream.Entries[i].Timestamp.After(stream.Entries[j].Timestamp)
+			}
+			return stream.Entries[i].Timestamp.Before(stream.Entries[j].Timestamp)
+		})
+		streams = append(streams, *stream)
+	}
+	return iter.NewStreamsIterator(ctx, streams, req.Direction), nil
+}
+
+// SelectSamples returns the samples extracted from the lines of the streams matching the selector
+func (q *streamQuerier) SelectSamples(ctx context.Context, req logql.SelectSampleParams) (iter.SampleIterator, error) {
+	expr, err := req.Expr()
+	if err != nil {
+		return nil, err
+	}
+	extractor, err := expr.Extractor()
+	if err != nil {
+		return nil, err
+	}
+	bySeries := make(map[string]*logproto.Series)
+	var keys []string
+	for _, stream := range q.matching(expr.Selector().Matchers()) {
+		for _, entry := range stream.entries {
+			if !inRange(entry, req.Start, req.End) {
+				continue
+			}
+			value, lbs, ok := extractor.Process([]byte(entry.Line), stream.labels)
+			if !ok {
+				continue
+			}
+			key := lbs.String()
+			if _, ok := bySeries[key]; !ok {
+				bySeries[key] = &logproto.Series{Labels: key}
+				keys = append(keys, key)
+			}
+			bySeries[key].Samples = append(bySeries[key].Samples, logproto.Sample{Timestamp: entry.Timestamp.UnixNano(), Value: value})
+		}
+	}
+	series := make([]logproto.Series, 0, len(keys))
+	for _, key := range keys {
+		sort.Stable(bySeries[key])
+		series = append(series, *bySeries[key])
+	}
+	return iter.NewMultiSeriesIterator(ctx, series), nil
+}
@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testRulesYAML = `apiVersion: logging.opsgy.com/v1beta1
+kind: LokiRule
+metadata:
+  name: nginx
+  namespace: prod
+spec:
+  groups:
+  - name: nginx
+    rules:
+    - alert: NginxErrors
+      expr: sum by (app) (count_over_time({app="nginx"} |= "error" [5m])) > 3
+      for: 2m
+      labels:
+        severity: warning
+      annotations:
+        summary: '{{ $labels.app }} logged {{ $value }} errors'
+    - record: app:errors:count5m
+      expr: sum by (app) (count_over_time({app="nginx"} |= "error" [5m]))
+`
+
+const testFileYAML = `rule_files:
+- rules
+tests:
+- name: errors
+  input_streams:
+  - labels:
+      app: nginx
+      namespace: prod
+    entries:
+    - ts: 30s
+      line: GET /index.html 500 error
+      count: 5
+      interval: 5s
+    - ts: 40s
+      line: GET /index.html 200 ok
+  # The namespace is enforced on the expression, the errors of dev don't count
+  - labels:
+      app: nginx
+      namespace: dev
+    entries:
+    - ts: 30s
+      line: GET /index.html 500 error
+      count: 10
+  alert_rule_test:
+  - eval_time: 10m
+    alertname: NginxErrors
+  - eval_time: 2m
+    alertname: NginxErrors
+  - eval_time: 3m
+    alertname: NginxErrors
+    exp_alerts:
+    - exp_labels:
+        app: nginx
+        severity: warning
+      exp_annotations:
+        summary: nginx logged 5 errors
+`
+
+func TestTest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "rules"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "rules", "nginx.yaml"), []byte(testRulesYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "nginx_test.yaml")
+	if err := ioutil.WriteFile(file, []byte(testFileYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := Test([]string{file}, nil, &stdout, &stderr); code != exitOK {
+		t.Fatalf("expected exit code 0, got %d: %s%s", code, stdout.String(), stderr.String())
+	}
+	if stdout.String() != file+": ok\n" {
+		t.Fatalf("unexpected output %s", stdout.String())
+	}
+
+	// The alert is still pending at 2m and fires without the severity of the test
+	failing := strings.Replace(strings.Replace(testFileYAML, "eval_time: 3m", "eval_time: 2m", 1), "        severity: warning\n", "", 1)
+	if err := ioutil.WriteFile(file, []byte(failing+"  - eval_time: 1m\n    alertname: Unknown\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stdout.Reset()
+	if code := Test([]string{file}, nil, &stdout, &stderr); code != exitFailed {
+		t.Fatalf("expected exit code 1, got %d: %s%s", code, stdout.String(), stderr.String())
+	}
+	expected := file + `: test "errors": Unknown at 1m: no alerting rule with this name
+` + file + `: test "errors": NginxErrors at 2m:
+  expected:
+    {alertname="NginxErrors", app="nginx"} annotations: {summary="nginx logged 5 errors"}
+  got: none
+`
+	if stdout.String() != expected {
+		t.Fatalf("expected %s, got %s", expected, stdout.String())
+	}
+}
+
+func TestTestInvalidRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rules := strings.Replace(testRulesYAML, "for: 2m", "for: 2x", 1)
+	if err := ioutil.WriteFile(filepath.Join(dir, "rules.yaml"), []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "nginx_test.yaml")
+	if err := ioutil.WriteFile(file, []byte(strings.Replace(testFileYAML, "- rules\n", "- rules.yaml\n", 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := Test([]string{file}, nil, &stdout, &stderr); code != exitFailed {
+		t.Fatalf("expected exit code 1, got %d", code)
+	}
+	if !strings.HasPrefix(stderr.String(), file+": LokiRule prod/nginx: ") {
+		t.Fatalf("expected the invalid LokiRule, got %s", stderr.String())
+	}
+}
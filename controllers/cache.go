@@ -0,0 +1,102 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+)
+
+// NewScopedCache returns a cache that only watches the LokiRules in the given namespaces.
+// All other objects, like GlobalLokiRules and Namespaces, are cluster scoped or needed
+// cluster wide and are cached in all namespaces.
+// The namespace and rule selectors of the RuleScope aren't applied to the watches, as the
+// rules that leave the selectors still have to be seen to remove their rules and finalizer.
+func NewScopedCache(namespaces []string) cache.NewCacheFunc {
+	return func(config *rest.Config, opts cache.Options) (cache.Cache, error) {
+		clusterCache, err := cache.New(config, opts)
+		if err != nil {
+			return nil, err
+		}
+		rulesCache, err := cache.MultiNamespacedCacheBuilder(namespaces)(config, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &scopedCache{Cache: clusterCache, rules: rulesCache}, nil
+	}
+}
+
+// scopedCache serves the LokiRules from the namespaced cache and all other objects from the cluster wide cache
+type scopedCache struct {
+	cache.Cache
+	rules cache.Cache
+}
+
+var _ cache.Cache = &scopedCache{}
+
+func (c *scopedCache) cacheFor(obj runtime.Object) cache.Cache {
+	switch obj.(type) {
+	case *loggingv1beta1.LokiRule, *loggingv1beta1.LokiRuleList:
+		return c.rules
+	}
+	return c.Cache
+}
+
+func (c *scopedCache) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	return c.cacheFor(obj).Get(ctx, key, obj)
+}
+
+func (c *scopedCache) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	return c.cacheFor(list).List(ctx, list, opts...)
+}
+
+func (c *scopedCache) GetInformer(ctx context.Context, obj client.Object) (cache.Informer, error) {
+	return c.cacheFor(obj).GetInformer(ctx, obj)
+}
+
+func (c *scopedCache) GetInformerForKind(ctx context.Context, gvk schema.GroupVersionKind) (cache.Informer, error) {
+	if gvk.GroupKind() == loggingv1beta1.GroupVersion.WithKind("LokiRule").GroupKind() {
+		return c.rules.GetInformerForKind(ctx, gvk)
+	}
+	return c.Cache.GetInformerForKind(ctx, gvk)
+}
+
+func (c *scopedCache) IndexField(ctx context.Context, obj client.Object, field string, extractValue client.IndexerFunc) error {
+	return c.cacheFor(obj).IndexField(ctx, obj, field, extractValue)
+}
+
+func (c *scopedCache) Start(ctx context.Context) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.rules.Start(ctx)
+	}()
+	if err := c.Cache.Start(ctx); err != nil {
+		return err
+	}
+	return <-errs
+}
+
+func (c *scopedCache) WaitForCacheSync(ctx context.Context) bool {
+	return c.rules.WaitForCacheSync(ctx) && c.Cache.WaitForCacheSync(ctx)
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+)
+
+// Reasons of the events emitted when the rules are removed from the sink
+const (
+	// EventReasonDeleted is used when the rule is deleted
+	EventReasonDeleted = "Deleted"
+	// EventReasonOutOfScope is used when the rule is no longer selected by the operator
+	EventReasonOutOfScope = "OutOfScope"
+)
+
+// ruleConditions sets the conditions of a LokiRule or GlobalLokiRule status
+type ruleConditions struct {
+	conditions *[]metav1.Condition
+	generation int64
+}
+
+func (c ruleConditions) set(conditionType string, status metav1.ConditionStatus, reason string, message string) {
+	meta.SetStatusCondition(c.conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: c.generation,
+		Reason:             reason,
+		Message:            message,
+	})
+	// SetStatusCondition doesn't update the observed generation of an existing condition
+	meta.FindStatusCondition(*c.conditions, conditionType).ObservedGeneration = c.generation
+}
+
+// invalid marks the rules as invalid. The Synced condition is left as is,
+// as the previous valid generation of the rules stays in the sink.
+func (c ruleConditions) invalid(reason string, err error) {
+	c.set(loggingv1beta1.ConditionValidated, metav1.ConditionFalse, reason, err.Error())
+	c.set(loggingv1beta1.ConditionReady, metav1.ConditionFalse, reason, err.Error())
+}
+
+// syncFailed marks the valid rules as not stored in the sink
+func (c ruleConditions) syncFailed(err error) {
+	reason := loggingv1beta1.ReasonSyncFailed
+	if IsConfigMapConflict(err) {
+		reason = loggingv1beta1.ReasonConfigMapConflict
+	}
+	c.set(loggingv1beta1.ConditionValidated, metav1.ConditionTrue, loggingv1beta1.ReasonValid, "")
+	c.set(loggingv1beta1.ConditionSynced, metav1.ConditionFalse, reason, err.Error())
+	c.set(loggingv1beta1.ConditionReady, metav1.ConditionFalse, reason, err.Error())
+}
+
+// synced marks the valid rules as stored in the sink, if any, and in the LokiRulerTargets
+func (c ruleConditions) synced(tenant string, location *RuleLocation, targets []loggingv1beta1.RuleTargetStatus) {
+	var stored []string
+	if location != nil && location.ConfigMap != "" {
+		stored = append(stored, fmt.Sprintf("%s of ConfigMap %s of tenant %s", location.Key, location.ConfigMap, tenant))
+	} else if location != nil {
+		stored = append(stored, fmt.Sprintf("rule namespace %s of tenant %s", location.Key, tenant))
+	}
+	if len(targets) > 0 {
+		names := make([]string, 0, len(targets))
+		for _, target := range targets {
+			names = append(names, target.Name)
+		}
+		stored = append(stored, "LokiRulerTargets "+strings.Join(names, ", "))
+	}
+	message := "Rules are not selected by any LokiRulerTarget"
+	if len(stored) > 0 {
+		message = "Rules are stored in " + strings.Join(stored, " and in ")
+	}
+	c.set(loggingv1beta1.ConditionValidated, metav1.ConditionTrue, loggingv1beta1.ReasonValid, "")
+	c.set(loggingv1beta1.ConditionSynced, metav1.ConditionTrue, loggingv1beta1.ReasonSynced, message)
+	c.set(loggingv1beta1.ConditionReady, metav1.ConditionTrue, loggingv1beta1.ReasonSynced, message)
+}
+
+// recordReadyEvent emits an event when the Ready condition changed, or when other rules were synced.
+// Reconciles that don't change the outcome don't emit events.
+func recordReadyEvent(recorder record.EventRecorder, obj runtime.Object, oldConditions []metav1.Condition, conditions []metav1.Condition, rulesChanged bool) {
+	ready := meta.FindStatusCondition(conditions, loggingv1beta1.ConditionReady)
+	if ready == nil {
+		return
+	}
+	old := meta.FindStatusCondition(oldConditions, loggingv1beta1.ConditionReady)
+	if old != nil && old.Status == ready.Status && old.Reason == ready.Reason && old.Message == ready.Message {
+		if ready.Status != metav1.ConditionTrue || !rulesChanged {
+			return
+		}
+	}
+
+	eventType := v1.EventTypeWarning
+	if ready.Status == metav1.ConditionTrue {
+		eventType = v1.EventTypeNormal
+	}
+	recorder.Event(obj, eventType, ready.Reason, ready.Message)
+}
@@ -0,0 +1,101 @@
+package controllers
+
+import (
+	"errors"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+)
+
+func TestRuleConditions(t *testing.T) {
+	var conditions []metav1.Condition
+
+	ruleConditions{&conditions, 1}.synced("fake", &RuleLocation{ConfigMap: "loki-rules", Key: "default-nginx.yml"}, nil)
+	for _, conditionType := range []string{loggingv1beta1.ConditionValidated, loggingv1beta1.ConditionSynced, loggingv1beta1.ConditionReady} {
+		if !meta.IsStatusConditionTrue(conditions, conditionType) {
+			t.Fatalf("expected %s to be true", conditionType)
+		}
+	}
+
+	ruleConditions{&conditions, 2}.invalid(loggingv1beta1.ReasonInvalidExpression, errors.New("parse error"))
+	ready := meta.FindStatusCondition(conditions, loggingv1beta1.ConditionReady)
+	if ready.Status != metav1.ConditionFalse || ready.Reason != loggingv1beta1.ReasonInvalidExpression || ready.Message != "parse error" {
+		t.Fatalf("unexpected Ready condition: %+v", ready)
+	}
+	if ready.ObservedGeneration != 2 {
+		t.Fatalf("expected observed generation 2, got %d", ready.ObservedGeneration)
+	}
+	// The previous generation is still synced
+	synced := meta.FindStatusCondition(conditions, loggingv1beta1.ConditionSynced)
+	if synced.Status != metav1.ConditionTrue || synced.ObservedGeneration != 1 {
+		t.Fatalf("unexpected Synced condition: %+v", synced)
+	}
+
+	ruleConditions{&conditions, 3}.syncFailed(errors.New("ruler unavailable"))
+	if !meta.IsStatusConditionTrue(conditions, loggingv1beta1.ConditionValidated) {
+		t.Fatal("expected Validated to be true")
+	}
+	if !meta.IsStatusConditionFalse(conditions, loggingv1beta1.ConditionSynced) {
+		t.Fatal("expected Synced to be false")
+	}
+	if reason := meta.FindStatusCondition(conditions, loggingv1beta1.ConditionReady).Reason; reason != loggingv1beta1.ReasonSyncFailed {
+		t.Fatalf("expected reason %s, got %s", loggingv1beta1.ReasonSyncFailed, reason)
+	}
+
+	targets := []loggingv1beta1.RuleTargetStatus{{Name: "staging"}, {Name: "production"}}
+	ruleConditions{&conditions, 4}.synced("fake", &RuleLocation{Key: "default-nginx"}, targets)
+	expected := "Rules are stored in rule namespace default-nginx of tenant fake and in LokiRulerTargets staging, production"
+	if message := meta.FindStatusCondition(conditions, loggingv1beta1.ConditionReady).Message; message != expected {
+		t.Fatalf("expected message %q, got %q", expected, message)
+	}
+	ruleConditions{&conditions, 5}.synced("", nil, nil)
+	expected = "Rules are not selected by any LokiRulerTarget"
+	if message := meta.FindStatusCondition(conditions, loggingv1beta1.ConditionReady).Message; message != expected {
+		t.Fatalf("expected message %q, got %q", expected, message)
+	}
+}
+
+func TestRecordReadyEvent(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	lokiRule := &loggingv1beta1.LokiRule{}
+	location := RuleLocation{ConfigMap: "loki-rules", Key: "default-nginx.yml"}
+
+	var synced []metav1.Condition
+	ruleConditions{&synced, 1}.synced("fake", &location, nil)
+	var invalid []metav1.Condition
+	ruleConditions{&invalid, 2}.invalid(loggingv1beta1.ReasonInvalidExpression, errors.New("parse error"))
+
+	tests := []struct {
+		name         string
+		old          []metav1.Condition
+		new          []metav1.Condition
+		rulesChanged bool
+		event        string
+	}{
+		{"first sync", nil, synced, true, "Normal Synced Rules are stored in default-nginx.yml of ConfigMap loki-rules of tenant fake"},
+		{"steady state", synced, synced, false, ""},
+		{"rules changed", synced, synced, true, "Normal Synced Rules are stored in default-nginx.yml of ConfigMap loki-rules of tenant fake"},
+		{"became invalid", synced, invalid, false, "Warning InvalidExpression parse error"},
+		{"still invalid", invalid, invalid, false, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recordReadyEvent(recorder, lokiRule, test.old, test.new, test.rulesChanged)
+			select {
+			case event := <-recorder.Events:
+				if event != test.event {
+					t.Fatalf("expected event %q, got %q", test.event, event)
+				}
+			default:
+				if test.event != "" {
+					t.Fatalf("expected event %q", test.event)
+				}
+			}
+		})
+	}
+}
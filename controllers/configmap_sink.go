@@ -0,0 +1,644 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	goerrors "errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+)
+
+// DefaultConfigMapMaxSize leaves some headroom below the 1 MiB limit Kubernetes
+// puts on the data of a ConfigMap
+const DefaultConfigMapMaxSize = 1000 * 1000
+
+// DefaultConfigMapMaxShards matches the shards mounted by the projected volume of the deploy documentation
+const DefaultConfigMapMaxShards = 3
+
+// ConfigMapSink stores the rule groups as a file in a ConfigMap,
+// which should be mounted into the Loki ruler.
+// Every tenant gets its own ConfigMap, to be mounted at /rules/<tenant>/ of the ruler.
+//
+// When a ConfigMap is full, the files are spread over shards named '<name>.1', '<name>.2', etc.
+// A file stays in the shard it was assigned to until it no longer fits. Shards that become
+// empty are removed, except for the first one.
+type ConfigMapSink struct {
+	Clientset kubernetes.Interface
+	// Name of the ConfigMap of the default tenant, other tenants use '<Name>-<tenant>'
+	Name          string
+	Namespace     string
+	DefaultTenant string
+	// MaxSize is the maximum size in bytes of the data of a shard
+	MaxSize int
+	// MaxShards is the maximum number of ConfigMaps per tenant
+	MaxShards int
+}
+
+var _ RuleSink = &ConfigMapSink{}
+
+// SetupConfigMapSink returns the sink of the rules ConfigMap in the format '<namespace>/<name>',
+// it creates the rules ConfigMap if it doesn't exist yet
+func SetupConfigMapSink(ctx context.Context, clientset kubernetes.Interface, rulesCM string, defaultTenant string) (*ConfigMapSink, error) {
+	rulesCMParts := strings.Split(rulesCM, "/")
+	if len(rulesCMParts) != 2 {
+		return nil, fmt.Errorf("invalid value for --rules-configmap")
+	}
+
+	// Create cm if not exists
+	_, err := clientset.CoreV1().ConfigMaps(rulesCMParts[0]).Get(ctx, rulesCMParts[1], metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			labelMap := make(map[string]string)
+			labelMap["app.kubernetes.io/managed-by"] = "loki-rule-operator"
+			dataMap := make(map[string]string)
+
+			cm := &v1.ConfigMap{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "ConfigMap",
+					APIVersion: "v1",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      rulesCMParts[1],
+					Namespace: rulesCMParts[0],
+					Labels:    labelMap,
+				},
+				Data: dataMap,
+			}
+			_, err := clientset.CoreV1().ConfigMaps(rulesCMParts[0]).Create(ctx, cm, metav1.CreateOptions{})
+			if err != nil {
+				return nil, fmt.Errorf("failed to create configmap: %w", err)
+			}
+		} else {
+			return nil, fmt.Errorf("failed to get configmap: %w", err)
+		}
+	}
+
+	return &ConfigMapSink{
+		Clientset:     clientset,
+		Name:          rulesCMParts[1],
+		Namespace:     rulesCMParts[0],
+		DefaultTenant: defaultTenant,
+	}, nil
+}
+
+// ConfigMapName returns the name of the first ConfigMap that holds the rules of the tenant
+func (s *ConfigMapSink) ConfigMapName(tenant string) string {
+	if tenant == "" || tenant == s.DefaultTenant {
+		return s.Name
+	}
+	return s.Name + "-" + tenant
+}
+
+// ShardName returns the name of the ConfigMap of the given shard of a tenant
+func (s *ConfigMapSink) ShardName(tenant string, index int) string {
+	if index == 0 {
+		return s.ConfigMapName(tenant)
+	}
+	return s.ConfigMapName(tenant) + "." + strconv.Itoa(index)
+}
+
+// FileName returns the key of the rules file of a rule in the ConfigMap
+func (s *ConfigMapSink) FileName(name string) string {
+	return name + ruleFileExtension
+}
+
+// Apply implements RuleSink
+func (s *ConfigMapSink) Apply(ctx context.Context, tenant string, name string, groups []*loggingv1beta1.LokiRuleGroup) (RuleLocation, error) {
+	change, err := s.applyChange(tenant, name, groups)
+	if err != nil {
+		return RuleLocation{}, err
+	}
+	s.write(ctx, []*fileChange{change})
+	return change.location, change.err
+}
+
+// Delete implements RuleSink
+func (s *ConfigMapSink) Delete(ctx context.Context, tenant string, name string) error {
+	change := s.deleteChange(tenant, name)
+	s.write(ctx, []*fileChange{change})
+	return change.err
+}
+
+// DeleteLocation implements RuleSink.
+// The ConfigMap could be from before the name of the ConfigMaps was changed.
+func (s *ConfigMapSink) DeleteLocation(ctx context.Context, tenant string, location RuleLocation) error {
+	change := s.deleteLocationChange(tenant, location)
+	if change == nil {
+		return nil
+	}
+	s.write(ctx, []*fileChange{change})
+	return change.err
+}
+
+// DeleteAll removes the rules stored under the names from all tenants in a single write,
+// e.g. to remove the rules from the previous destination of a LokiRulerTarget
+func (s *ConfigMapSink) DeleteAll(ctx context.Context, names []string) error {
+	changes := s.deleteAllChanges(names)
+	s.write(ctx, changes)
+	for _, change := range changes {
+		if change.err != nil {
+			return change.err
+		}
+	}
+	return nil
+}
+
+// fileChange is a change to a rules file. Changes are applied to the shards in memory,
+// after which the changed shards are written at once.
+type fileChange struct {
+	tenant   string
+	fileName string
+	// data of the file, or nil to delete it
+	data *string
+	// configMap restricts a delete to a single ConfigMap
+	configMap string
+
+	// location and err are the result of the change
+	location RuleLocation
+	err      error
+	done     chan struct{}
+}
+
+func (s *ConfigMapSink) applyChange(tenant string, name string, groups []*loggingv1beta1.LokiRuleGroup) (*fileChange, error) {
+	fileName := s.FileName(name)
+	data, err := renderRules(groups)
+	if err != nil {
+		return nil, err
+	}
+	if fileSize(fileName, string(data)) > s.MaxSize {
+		return nil, fmt.Errorf("rules are %d bytes, which exceeds the maximum ConfigMap size of %d bytes", len(data), s.MaxSize)
+	}
+	content := string(data)
+	return &fileChange{tenant: tenant, fileName: fileName, data: &content, done: make(chan struct{})}, nil
+}
+
+func (s *ConfigMapSink) deleteChange(tenant string, name string) *fileChange {
+	return &fileChange{tenant: tenant, fileName: s.FileName(name), done: make(chan struct{})}
+}
+
+func (s *ConfigMapSink) deleteAllChanges(names []string) []*fileChange {
+	changes := make([]*fileChange, 0, len(names))
+	for _, name := range names {
+		changes = append(changes, s.deleteChange("", name))
+	}
+	return changes
+}
+
+func (s *ConfigMapSink) deleteLocationChange(tenant string, location RuleLocation) *fileChange {
+	if location.ConfigMap == "" {
+		return nil
+	}
+	return &fileChange{tenant: tenant, fileName: location.Key, configMap: location.ConfigMap, done: make(chan struct{})}
+}
+
+// write applies the changes tenant by tenant and writes every changed ConfigMap of a tenant once.
+// When a ConfigMap was changed by someone else in the meantime, the ConfigMaps of the tenant are
+// read again and its changes are retried. The result of every change is stored in the change, so
+// an error of one tenant (e.g. a ConfigMap managed by someone else) only fails the changes of that tenant.
+func (s *ConfigMapSink) write(ctx context.Context, changes []*fileChange) {
+	for _, change := range changes {
+		change.location = RuleLocation{}
+		change.err = nil
+	}
+	tenants, err := s.changedTenants(ctx, changes)
+	if err != nil {
+		for _, change := range changes {
+			if change.tenant == "" {
+				change.err = err
+			}
+		}
+	}
+	for _, tenant := range tenants {
+		err := retry.OnError(retry.DefaultRetry, isWriteConflict, func() error {
+			return s.writeTenant(ctx, tenant, changes)
+		})
+		if err == nil {
+			continue
+		}
+		for _, change := range changes {
+			if change.tenant == tenant || (change.tenant == "" && change.err == nil) {
+				change.err = err
+			}
+		}
+	}
+}
+
+func isWriteConflict(err error) bool {
+	return errors.IsConflict(err) || errors.IsAlreadyExists(err)
+}
+
+// changedTenants returns the tenants of the changes, changes without a tenant apply to all the tenants.
+// When the tenants can't be listed, the tenants of the other changes are still returned.
+func (s *ConfigMapSink) changedTenants(ctx context.Context, changes []*fileChange) ([]string, error) {
+	var tenants []string
+	seen := make(map[string]bool)
+	addTenant := func(tenant string) {
+		if !seen[tenant] {
+			seen[tenant] = true
+			tenants = append(tenants, tenant)
+		}
+	}
+	var allTenants []string
+	var err error
+	for _, change := range changes {
+		if change.tenant != "" {
+			addTenant(change.tenant)
+			continue
+		}
+		if allTenants == nil && err == nil {
+			if allTenants, err = s.listTenants(ctx); err != nil {
+				continue
+			}
+			for _, tenant := range allTenants {
+				addTenant(tenant)
+			}
+		}
+	}
+	return tenants, err
+}
+
+// writeTenant applies the changes of the tenant, including those without a tenant
+func (s *ConfigMapSink) writeTenant(ctx context.Context, tenant string, changes []*fileChange) error {
+	shards, err := s.listShards(ctx, tenant)
+	if err != nil {
+		return err
+	}
+	var foreign []*fileChange
+	for _, change := range changes {
+		if change.tenant != "" && change.tenant != tenant {
+			continue
+		}
+		if change.data != nil {
+			shards, change.err = s.putFile(tenant, shards, change)
+		} else if !deleteFile(shards, change) {
+			foreign = append(foreign, change)
+		}
+	}
+	if err := s.flush(ctx, shards); err != nil {
+		return err
+	}
+	for _, change := range foreign {
+		if err := s.deleteFromConfigMap(ctx, change.configMap, change.fileName); isWriteConflict(err) {
+			return err
+		} else if err != nil {
+			change.err = err
+		}
+	}
+	return nil
+}
+
+// putFile stores the file in the shards, and returns the shards including a new one when needed
+func (s *ConfigMapSink) putFile(tenant string, shards []*configMapShard, change *fileChange) ([]*configMapShard, error) {
+	fileName, data := change.fileName, *change.data
+
+	// Keep the file in its current shard, as long as it fits
+	var current *configMapShard
+	for _, shard := range shards {
+		if _, ok := shard.cm.Data[fileName]; ok {
+			current = shard
+			break
+		}
+	}
+	target := current
+	if current != nil && current.size()-fileSize(fileName, current.cm.Data[fileName])+fileSize(fileName, data) > s.MaxSize {
+		target = nil
+	}
+
+	// Otherwise move the file to the first shard with enough room, or create a new shard
+	if target == nil {
+		for _, shard := range shards {
+			if shard != current && shard.size()+fileSize(fileName, data) <= s.MaxSize {
+				target = shard
+				break
+			}
+		}
+	}
+	if target == nil {
+		index := nextShardIndex(shards)
+		if index >= s.MaxShards {
+			return shards, fmt.Errorf("all %d ConfigMaps of tenant %s are full", s.MaxShards, tenant)
+		}
+		target = &configMapShard{index: index, cm: s.newShard(tenant, index), created: true}
+		shards = append(shards, target)
+	}
+
+	if value, ok := target.cm.Data[fileName]; !ok || value != data {
+		if target.cm.Data == nil {
+			target.cm.Data = make(map[string]string)
+		}
+		target.cm.Data[fileName] = data
+		target.dirty = true
+	}
+	// Remove the file from the other shards, which also cleans up after an interrupted move
+	for _, shard := range shards {
+		if _, ok := shard.cm.Data[fileName]; ok && shard != target {
+			delete(shard.cm.Data, fileName)
+			shard.dirty = true
+		}
+	}
+	change.location = RuleLocation{ConfigMap: target.cm.Name, Key: fileName}
+	return shards, nil
+}
+
+// deleteFile removes the file from the shards. It returns false when the change
+// targets a ConfigMap that is not one of the shards.
+func deleteFile(shards []*configMapShard, change *fileChange) bool {
+	found := change.configMap == ""
+	for _, shard := range shards {
+		if change.configMap != "" && shard.cm.Name != change.configMap {
+			continue
+		}
+		found = true
+		if _, ok := shard.cm.Data[change.fileName]; ok {
+			delete(shard.cm.Data, change.fileName)
+			shard.dirty = true
+		}
+	}
+	return found
+}
+
+// flush writes the changed shards. Shards that became empty are removed, except for the first one.
+func (s *ConfigMapSink) flush(ctx context.Context, shards []*configMapShard) error {
+	for _, shard := range shards {
+		if !shard.dirty {
+			continue
+		}
+		var err error
+		switch {
+		case shard.created && len(shard.cm.Data) == 0:
+			continue
+		case shard.created:
+			shard.cm, err = s.Clientset.CoreV1().ConfigMaps(s.Namespace).Create(ctx, shard.cm, metav1.CreateOptions{})
+		case len(shard.cm.Data) == 0 && shard.index > 0:
+			err = s.Clientset.CoreV1().ConfigMaps(s.Namespace).Delete(ctx, shard.cm.Name, metav1.DeleteOptions{})
+			if err == nil || errors.IsNotFound(err) {
+				configMapSize.DeleteLabelValues(shard.cm.Name, s.tenantOf(shard.cm))
+				shard.dirty = false
+				continue
+			}
+		default:
+			shard.cm, err = s.Clientset.CoreV1().ConfigMaps(s.Namespace).Update(ctx, shard.cm, metav1.UpdateOptions{})
+		}
+		if err != nil {
+			return err
+		}
+		shard.dirty, shard.created = false, false
+		s.observeSize(shard.cm)
+	}
+	return nil
+}
+
+// deleteFromConfigMap removes the file from a ConfigMap that is not one of the current shards
+func (s *ConfigMapSink) deleteFromConfigMap(ctx context.Context, name string, fileName string) error {
+	cm, err := s.Clientset.CoreV1().ConfigMaps(s.Namespace).Get(ctx, name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := s.checkManagedBy(cm); err != nil {
+		return err
+	}
+	if _, ok := cm.Data[fileName]; !ok {
+		return nil
+	}
+	delete(cm.Data, fileName)
+	shard := &configMapShard{index: shardIndex(cm.Name), cm: cm, dirty: true}
+	return s.flush(ctx, []*configMapShard{shard})
+}
+
+// shardIndex returns the index of a shard from its name '<name>.<index>'
+func shardIndex(name string) int {
+	i := strings.LastIndex(name, ".")
+	if i < 0 {
+		return 0
+	}
+	index, err := strconv.Atoi(name[i+1:])
+	if err != nil || index <= 0 {
+		return 0
+	}
+	return index
+}
+
+// RuleFile is a rules file in one of the ConfigMaps of the sink
+type RuleFile struct {
+	Tenant    string
+	ConfigMap string
+	Key       string
+}
+
+// ListFiles returns the rules files in the ConfigMaps of all tenants
+func (s *ConfigMapSink) ListFiles(ctx context.Context) ([]RuleFile, error) {
+	tenants, err := s.listTenants(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var files []RuleFile
+	for _, tenant := range tenants {
+		shards, err := s.listShards(ctx, tenant)
+		if err != nil {
+			return nil, err
+		}
+		for _, shard := range shards {
+			for key := range shard.cm.Data {
+				files = append(files, RuleFile{Tenant: tenant, ConfigMap: shard.cm.Name, Key: key})
+			}
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].ConfigMap != files[j].ConfigMap {
+			return files[i].ConfigMap < files[j].ConfigMap
+		}
+		return files[i].Key < files[j].Key
+	})
+	return files, nil
+}
+
+// ReadFile returns the content of a rules file returned by ListFiles
+func (s *ConfigMapSink) ReadFile(ctx context.Context, file RuleFile) (string, error) {
+	cm, err := s.Clientset.CoreV1().ConfigMaps(s.Namespace).Get(ctx, file.ConfigMap, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	data, ok := cm.Data[file.Key]
+	if !ok {
+		return "", fmt.Errorf("rules file '%s' not found in ConfigMap %s/%s", file.Key, s.Namespace, file.ConfigMap)
+	}
+	return data, nil
+}
+
+type configMapShard struct {
+	index int
+	cm    *v1.ConfigMap
+	// dirty is set when the data was changed in memory
+	dirty bool
+	// created is set when the shard doesn't exist yet
+	created bool
+}
+
+// size returns the size of the shard as counted by the Kubernetes API
+func (shard *configMapShard) size() int {
+	size := 0
+	for key, value := range shard.cm.Data {
+		size += fileSize(key, value)
+	}
+	return size
+}
+
+func fileSize(fileName string, data string) int {
+	return len(fileName) + len(data)
+}
+
+func nextShardIndex(shards []*configMapShard) int {
+	if len(shards) == 0 {
+		return 0
+	}
+	return shards[len(shards)-1].index + 1
+}
+
+// listShards returns the existing shards of a tenant, ordered by index
+func (s *ConfigMapSink) listShards(ctx context.Context, tenant string) ([]*configMapShard, error) {
+	var shards []*configMapShard
+
+	// The first shard is checked separately, as it could be created by someone else
+	cm, err := s.Clientset.CoreV1().ConfigMaps(s.Namespace).Get(ctx, s.ShardName(tenant, 0), metav1.GetOptions{})
+	if err == nil {
+		if err := s.checkManagedBy(cm); err != nil {
+			return nil, err
+		}
+		shards = append(shards, &configMapShard{index: 0, cm: cm})
+	} else if !errors.IsNotFound(err) {
+		return nil, err
+	}
+
+	cms, err := s.Clientset.CoreV1().ConfigMaps(s.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: "app.kubernetes.io/managed-by=loki-rule-operator",
+	})
+	if err != nil {
+		return nil, err
+	}
+	prefix := s.ConfigMapName(tenant) + "."
+	for i := range cms.Items {
+		cm := &cms.Items[i]
+		if !strings.HasPrefix(cm.Name, prefix) {
+			continue
+		}
+		index, err := strconv.Atoi(strings.TrimPrefix(cm.Name, prefix))
+		if err != nil || index <= 0 {
+			continue
+		}
+		shards = append(shards, &configMapShard{index: index, cm: cm})
+	}
+
+	sort.Slice(shards, func(i, j int) bool {
+		return shards[i].index < shards[j].index
+	})
+	configMapMaxSize.Set(float64(s.MaxSize))
+	for _, shard := range shards {
+		s.observeSize(shard.cm)
+	}
+	return shards, nil
+}
+
+// listTenants returns the tenants that have a ConfigMap
+func (s *ConfigMapSink) listTenants(ctx context.Context) ([]string, error) {
+	tenants := []string{s.DefaultTenant}
+	cms, err := s.Clientset.CoreV1().ConfigMaps(s.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: "app.kubernetes.io/managed-by=loki-rule-operator," + TenantKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, cm := range cms.Items {
+		tenant := cm.Labels[TenantKey]
+		if tenant != s.DefaultTenant && cm.Name == s.ConfigMapName(tenant) {
+			tenants = append(tenants, tenant)
+		}
+	}
+	return tenants, nil
+}
+
+// newShard returns a new, not yet created, shard of the tenant
+func (s *ConfigMapSink) newShard(tenant string, index int) *v1.ConfigMap {
+	labelMap := make(map[string]string)
+	labelMap["app.kubernetes.io/managed-by"] = "loki-rule-operator"
+	if s.ConfigMapName(tenant) != s.Name {
+		labelMap[TenantKey] = tenant
+	}
+
+	return &v1.ConfigMap{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "ConfigMap",
+			APIVersion: "v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      s.ShardName(tenant, index),
+			Namespace: s.Namespace,
+			Labels:    labelMap,
+		},
+		Data: make(map[string]string),
+	}
+}
+
+// observeSize updates the size metric of the ConfigMap
+func (s *ConfigMapSink) observeSize(cm *v1.ConfigMap) {
+	shard := &configMapShard{cm: cm}
+	configMapSize.WithLabelValues(cm.Name, s.tenantOf(cm)).Set(float64(shard.size()))
+}
+
+func (s *ConfigMapSink) tenantOf(cm *v1.ConfigMap) string {
+	if tenant, ok := cm.Labels[TenantKey]; ok {
+		return tenant
+	}
+	return s.DefaultTenant
+}
+
+func (s *ConfigMapSink) checkManagedBy(cm *v1.ConfigMap) error {
+	if _, ok := cm.Labels["app.kubernetes.io/managed-by"]; !ok {
+		return &ConfigMapConflictError{fmt.Sprintf("ConfigMap %s/%s is missing label app.kubernetes.io/managed-by", cm.Namespace, cm.Name)}
+	} else if cm.Labels["app.kubernetes.io/managed-by"] != "loki-rule-operator" {
+		return &ConfigMapConflictError{fmt.Sprintf("ConfigMap %s/%s is managed by someone else", cm.Namespace, cm.Name)}
+	}
+	return nil
+}
+
+// ConfigMapConflictError is returned when a ConfigMap the rules should be stored in
+// is not managed by the operator
+type ConfigMapConflictError struct {
+	msg string
+}
+
+func (e *ConfigMapConflictError) Error() string {
+	return e.msg
+}
+
+// IsConfigMapConflict returns true if the error is a ConfigMapConflictError
+func IsConfigMapConflict(err error) bool {
+	var conflict *ConfigMapConflictError
+	return goerrors.As(err, &conflict)
+}
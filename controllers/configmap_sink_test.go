@@ -0,0 +1,88 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestConfigMapSinkShards(t *testing.T) {
+	clientset := k8sfake.NewSimpleClientset(rulesConfigMap("loki-rules", ""))
+	sink := &ConfigMapSink{Clientset: clientset, Name: "loki-rules", Namespace: "loki", DefaultTenant: "fake", MaxSize: 150, MaxShards: 2}
+	ctx := context.Background()
+
+	first, err := sink.Apply(ctx, "fake", "prod-a", testGroups("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := sink.Apply(ctx, "fake", "prod-b", testGroups("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ConfigMap != "loki-rules" || second.ConfigMap != "loki-rules.1" {
+		t.Fatalf("expected the rules to be spread over 2 shards, got %v and %v", first, second)
+	}
+	if _, err := sink.Apply(ctx, "fake", "prod-c", testGroups("c")); err == nil {
+		t.Fatal("expected an error when all shards are full")
+	}
+
+	if err := sink.Delete(ctx, "", "prod-b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clientset.CoreV1().ConfigMaps("loki").Get(ctx, "loki-rules.1", metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Fatalf("expected the empty shard to be removed, got %v", err)
+	}
+}
+
+// A file stays in the shard it was assigned to, new files go to the first shard with room
+func TestConfigMapSinkShardAssignment(t *testing.T) {
+	clientset := k8sfake.NewSimpleClientset(rulesConfigMap("loki-rules", ""))
+	sink := &ConfigMapSink{Clientset: clientset, Name: "loki-rules", Namespace: "loki", DefaultTenant: "fake", MaxSize: 150, MaxShards: DefaultConfigMapMaxShards}
+	ctx := context.Background()
+
+	for _, name := range []string{"prod-a", "prod-b", "prod-c"} {
+		if _, err := sink.Apply(ctx, "fake", name, testGroups(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := sink.Apply(ctx, "fake", "prod-d", testGroups("d")); err == nil {
+		t.Fatalf("expected an error when all %d shards are full", DefaultConfigMapMaxShards)
+	}
+
+	// The first shard is kept when it becomes empty, the file of prod-b stays where it is
+	if err := sink.Delete(ctx, "fake", "prod-a"); err != nil {
+		t.Fatal(err)
+	}
+	location, err := sink.Apply(ctx, "fake", "prod-b", testGroups("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.ConfigMap != "loki-rules.1" {
+		t.Fatalf("expected prod-b to stay in loki-rules.1, got %v", location)
+	}
+	location, err = sink.Apply(ctx, "fake", "prod-d", testGroups("d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.ConfigMap != "loki-rules" {
+		t.Fatalf("expected prod-d to use the room in loki-rules, got %v", location)
+	}
+}
+
+func TestShardIndex(t *testing.T) {
+	tests := map[string]int{
+		"loki-rules":       0,
+		"loki-rules.1":     1,
+		"loki-rules-ops.2": 2,
+		"loki.rules":       0,
+		"loki-rules.0":     0,
+	}
+	for name, index := range tests {
+		if got := shardIndex(name); got != index {
+			t.Fatalf("expected index %d for %s, got %d", index, name, got)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+)
+
+// Finalizer makes sure the rules of a LokiRule or GlobalLokiRule are removed
+// from the sink before the object is deleted
+const Finalizer = "logging.opsgy.com/finalizer"
+
+// InstanceFinalizer returns the finalizer of a named instance of the operator. Instances that
+// manage different rules each have their own finalizer, so they never remove each other's.
+// An instance without a name uses Finalizer.
+func InstanceFinalizer(instance string) string {
+	if instance == "" {
+		return Finalizer
+	}
+	return Finalizer + "-" + instance
+}
+
+// ValidateInstance returns an error if the name of the instance can't be used in its finalizer
+func ValidateInstance(instance string) error {
+	if instance == "" {
+		return nil
+	}
+	if errs := validation.IsQualifiedName(InstanceFinalizer(instance)); len(errs) > 0 {
+		return fmt.Errorf("invalid instance %q: %s", instance, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// cleanupRules removes the rules of a deleted LokiRule or GlobalLokiRule from the location
+// recorded in its status, as well as from where the current configuration would store them.
+func cleanupRules(ctx context.Context, sink RuleSink, tenant string, name string, location RuleLocation) error {
+	if tenant != "" && location.Key != "" {
+		if err := sink.DeleteLocation(ctx, tenant, location); err != nil {
+			return err
+		}
+	}
+	return sink.Delete(ctx, tenant, name)
+}
+
+// RemoveFinalizers removes the finalizer from all LokiRules, GlobalLokiRules and LokiRulerTargets
+// without cleaning up their rules, so they can be deleted once the operator is uninstalled.
+// It returns the number of objects it removed the finalizer from.
+func RemoveFinalizers(ctx context.Context, c client.Client, finalizer string) (int, error) {
+	var objects []client.Object
+	lokiRules := &loggingv1beta1.LokiRuleList{}
+	if err := c.List(ctx, lokiRules); err != nil {
+		return 0, err
+	}
+	for i := range lokiRules.Items {
+		objects = append(objects, &lokiRules.Items[i])
+	}
+	globalLokiRules := &loggingv1beta1.GlobalLokiRuleList{}
+	if err := c.List(ctx, globalLokiRules); err != nil {
+		return 0, err
+	}
+	for i := range globalLokiRules.Items {
+		objects = append(objects, &globalLokiRules.Items[i])
+	}
+	targets := &loggingv1beta1.LokiRulerTargetList{}
+	if err := c.List(ctx, targets); err != nil {
+		return 0, err
+	}
+	for i := range targets.Items {
+		objects = append(objects, &targets.Items[i])
+	}
+
+	removed := 0
+	for _, obj := range objects {
+		if !controllerutil.ContainsFinalizer(obj, finalizer) {
+			continue
+		}
+		patch := client.MergeFrom(obj.DeepCopyObject().(client.Object))
+		controllerutil.RemoveFinalizer(obj, finalizer)
+		if err := c.Patch(ctx, obj, patch); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
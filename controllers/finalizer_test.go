@@ -0,0 +1,53 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+)
+
+func TestRemoveFinalizers(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := loggingv1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	lokiRule := &loggingv1beta1.LokiRule{}
+	lokiRule.Name, lokiRule.Namespace = "nginx", "prod"
+	lokiRule.Finalizers = []string{Finalizer, "example.com/other"}
+	withoutFinalizer := &loggingv1beta1.LokiRule{}
+	withoutFinalizer.Name, withoutFinalizer.Namespace = "api", "prod"
+	globalLokiRule := &loggingv1beta1.GlobalLokiRule{}
+	globalLokiRule.Name = "nodes"
+	globalLokiRule.Finalizers = []string{Finalizer}
+
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(lokiRule, withoutFinalizer, globalLokiRule).Build()
+	removed, err := RemoveFinalizers(context.Background(), c, Finalizer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Fatalf("expected 2 removed finalizers, got %d", removed)
+	}
+
+	gotLokiRule := &loggingv1beta1.LokiRule{}
+	if err := c.Get(context.Background(), client.ObjectKeyFromObject(lokiRule), gotLokiRule); err != nil {
+		t.Fatal(err)
+	}
+	if len(gotLokiRule.Finalizers) != 1 || gotLokiRule.Finalizers[0] != "example.com/other" {
+		t.Fatalf("expected only the other finalizer to be kept, got %v", gotLokiRule.Finalizers)
+	}
+	gotGlobalLokiRule := &loggingv1beta1.GlobalLokiRule{}
+	if err := c.Get(context.Background(), client.ObjectKeyFromObject(globalLokiRule), gotGlobalLokiRule); err != nil {
+		t.Fatal(err)
+	}
+	if controllerutil.ContainsFinalizer(gotGlobalLokiRule, Finalizer) {
+		t.Fatal("expected the finalizer to be removed")
+	}
+}
@@ -18,17 +18,23 @@ package controllers
 
 import (
 	"context"
-	"fmt"
 
 	"github.com/go-logr/logr"
-	"gopkg.in/yaml.v2"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/client-go/kubernetes"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
 )
@@ -36,17 +42,26 @@ import (
 // GlobalLokiRuleReconciler reconciles a GlobalLokiRule object
 type GlobalLokiRuleReconciler struct {
 	client.Client
-	Log                     logr.Logger
-	Scheme                  *runtime.Scheme
-	Clientset               *kubernetes.Clientset
-	RulesConfigMapName      string
-	RulesConfigMapNamespace string
-	ExternalLabels          []Label
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Sink     RuleSink
+	Tenants  *TenantResolver
+	Labels   *LabelPolicy
+	Recorder record.EventRecorder
+	Scope    *RuleScope
+	// Durations are the bounds of the intervals and 'for' durations of the rules
+	Durations loggingv1beta1.DurationBounds
+	// Targets are the LokiRulerTargets the rules are stored in, next to the Sink
+	Targets *RuleTargets
+	// MaxConcurrentReconciles allows the changes of multiple rules to be written in one batch
+	MaxConcurrentReconciles int
 }
 
 // +kubebuilder:rbac:groups=logging.opsgy.com,resources=globallokirules,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=logging.opsgy.com,resources=globallokirules/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=logging.opsgy.com,resources=globallokirules/finalizers,verbs=update
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups=logging.opsgy.com,resources=lokirulertargets,verbs=get;list;watch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -61,131 +76,225 @@ func (r *GlobalLokiRuleReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 	_ = r.Log.WithValues("globallokirule", req.NamespacedName)
 
 	// your logic here
-	fileName := req.Namespace + "-" + req.Name + ".yml"
+	name := GlobalLokiRuleName(req.Name)
 	lokiRule := &loggingv1beta1.GlobalLokiRule{}
 	err := r.Get(ctx, req.NamespacedName, lokiRule)
 	if err != nil {
 		if errors.IsNotFound(err) {
-			// Remove item from configmap
-			cm, err := r.Clientset.CoreV1().ConfigMaps(r.RulesConfigMapNamespace).Get(ctx, r.RulesConfigMapName, metav1.GetOptions{})
-			if err != nil {
-				if errors.IsNotFound(err) {
-					// do nothing
-					return ctrl.Result{}, nil
+			// Remove rules of a GlobalLokiRule that was deleted without the finalizer
+			if r.Sink != nil {
+				if err := r.Sink.Delete(ctx, "", name); err != nil {
+					return ctrl.Result{Requeue: true}, err
 				}
-				return ctrl.Result{Requeue: true}, err
-			}
-
-			if _, ok := cm.Labels["app.kubernetes.io/managed-by"]; !ok {
-				return ctrl.Result{Requeue: true}, fmt.Errorf("ConfigMap %s/%s is missing label app.kubernetes.io/managed-by", r.RulesConfigMapNamespace, r.RulesConfigMapName)
-			} else if cm.Labels["app.kubernetes.io/managed-by"] != "loki-rule-operator" {
-				return ctrl.Result{Requeue: true}, fmt.Errorf("ConfigMap %s/%s is managed by someone else", r.RulesConfigMapNamespace, r.RulesConfigMapName)
 			}
-
-			if cm.Data != nil {
-				_, exists := cm.Data[fileName]
-				if exists {
-					delete(cm.Data, fileName)
-					_, err = r.Clientset.CoreV1().ConfigMaps(r.RulesConfigMapNamespace).Update(ctx, cm, metav1.UpdateOptions{})
-					if err != nil {
-						return ctrl.Result{Requeue: true}, err
-					}
-				}
+			if err := r.Targets.Delete(ctx, name); err != nil {
+				return ctrl.Result{Requeue: true}, err
 			}
 			return ctrl.Result{}, nil
 		}
 		return ctrl.Result{}, err
 	}
 
-	// Evaluate rules
-	spec, err := lokiRule.ValidateExpressions()
+	inScope, err := r.Scope.Contains(ctx, lokiRule)
 	if err != nil {
-		lokiRule.Status.Valid = false
-		lokiRule.Status.Message = err.Error()
-		r.Client.Status().Update(context.TODO(), lokiRule)
-		return ctrl.Result{}, nil
+		return ctrl.Result{}, err
 	}
-	if !lokiRule.Status.Valid {
-		lokiRule.Status.Valid = true
-		lokiRule.Status.Message = ""
-		r.Client.Status().Update(context.TODO(), lokiRule)
+	if !lokiRule.DeletionTimestamp.IsZero() {
+		return r.finalize(ctx, lokiRule, name, EventReasonDeleted, "Rules are removed")
 	}
-	lokiRule.Spec = *spec
-
-	// Add external labels
-	if r.ExternalLabels != nil && len(r.ExternalLabels) > 0 {
-		for _, group := range lokiRule.Spec.Groups {
-			for _, rule := range group.Rules {
-				if rule.Labels == nil {
-					rule.Labels = make(map[string]string)
-				}
-				for _, label := range r.ExternalLabels {
-					rule.Labels[label.Name] = label.Value
-				}
-				rule.Labels["group"] = group.Name
-			}
+	if !inScope {
+		return r.finalize(ctx, lokiRule, name, EventReasonOutOfScope, "Rules are removed, the GlobalLokiRule is no longer selected by the operator")
+	}
+	if !controllerutil.ContainsFinalizer(lokiRule, r.Scope.Finalizer()) {
+		controllerutil.AddFinalizer(lokiRule, r.Scope.Finalizer())
+		if err := r.Update(ctx, lokiRule); err != nil {
+			return ctrl.Result{}, err
 		}
 	}
 
-	// Marshal rules
-	data, err := yaml.Marshal(&lokiRule.Spec)
+	status := lokiRule.Status.DeepCopy()
+	status.ObservedGeneration = lokiRule.Generation
+	conditions := ruleConditions{&status.Conditions, lokiRule.Generation}
+
+	// Evaluate rules
+	spec, err := lokiRule.ValidateExpressions(r.Durations)
 	if err != nil {
-		lokiRule.Status.Message = err.Error()
-		r.Client.Status().Update(context.TODO(), lokiRule)
-		return ctrl.Result{}, err
+		status.Valid = false
+		status.Message = err.Error()
+		conditions.invalid(loggingv1beta1.ReasonInvalidExpression, err)
+		syncErrors.WithLabelValues("GlobalLokiRule", SyncErrorValidation).Inc()
+		return ctrl.Result{}, r.updateStatus(ctx, lokiRule, status)
 	}
+	lokiRule.Spec = *spec
 
-	// Update ConfigMap
-	cm, err := r.Clientset.CoreV1().ConfigMaps(r.RulesConfigMapNamespace).Get(ctx, r.RulesConfigMapName, metav1.GetOptions{})
+	// Determine tenant
+	tenant, err := r.Tenants.Resolve(ctx, "", lokiRule.Spec.Tenant)
 	if err != nil {
-		if errors.IsNotFound(err) {
-			labelMap := make(map[string]string)
-			labelMap["app.kubernetes.io/managed-by"] = "loki-rule-operator"
-			dataMap := make(map[string]string)
-			dataMap[fileName] = string(data)
-
-			cm := &v1.ConfigMap{
-				TypeMeta: metav1.TypeMeta{
-					Kind:       "ConfigMap",
-					APIVersion: "v1",
-				},
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      r.RulesConfigMapName,
-					Namespace: r.RulesConfigMapNamespace,
-					Labels:    labelMap,
-				},
-				Data: dataMap,
+		if IsInvalidTenant(err) {
+			status.Valid = false
+			status.Message = err.Error()
+			conditions.invalid(loggingv1beta1.ReasonInvalidTenant, err)
+			syncErrors.WithLabelValues("GlobalLokiRule", SyncErrorValidation).Inc()
+			// The rules may no longer be stored for the tenant they were stored for before
+			if err := r.removeRules(ctx, name, status); err != nil {
+				return r.syncFailed(ctx, lokiRule, status, err)
 			}
-			_, err := r.Clientset.CoreV1().ConfigMaps(r.RulesConfigMapNamespace).Create(ctx, cm, metav1.CreateOptions{})
-			if err != nil {
-				return ctrl.Result{Requeue: true}, err
-			}
-		} else {
-			return ctrl.Result{Requeue: true}, err
+			return ctrl.Result{}, r.updateStatus(ctx, lokiRule, status)
 		}
-	} else {
-		if _, ok := cm.Labels["app.kubernetes.io/managed-by"]; !ok {
-			return ctrl.Result{Requeue: true}, fmt.Errorf("ConfigMap %s/%s is missing label app.kubernetes.io/managed-by", r.RulesConfigMapNamespace, r.RulesConfigMapName)
-		} else if cm.Labels["app.kubernetes.io/managed-by"] != "loki-rule-operator" {
-			return ctrl.Result{Requeue: true}, fmt.Errorf("ConfigMap %s/%s is managed by someone else", r.RulesConfigMapNamespace, r.RulesConfigMapName)
+		return ctrl.Result{Requeue: true}, err
+	}
+
+	// Add labels
+	source := LabelSource{Name: lokiRule.Name}
+	groups, err := r.Labels.Apply(lokiRule.Spec.Groups, source)
+	if err != nil {
+		if IsLabelConflict(err) {
+			status.Valid = false
+			status.Message = err.Error()
+			conditions.invalid(loggingv1beta1.ReasonLabelConflict, err)
+			syncErrors.WithLabelValues("GlobalLokiRule", SyncErrorValidation).Inc()
+			return ctrl.Result{}, r.updateStatus(ctx, lokiRule, status)
 		}
+		return ctrl.Result{}, err
+	}
+	status.Valid = true
+	status.Message = ""
 
-		if cm.Data == nil {
-			cm.Data = make(map[string]string)
+	// Store rules
+	var location *RuleLocation
+	if r.Sink != nil {
+		previous := RuleLocation{ConfigMap: status.ConfigMap, Key: status.Key}
+		stored, err := r.store(ctx, status.Tenant, tenant, name, groups)
+		if err != nil {
+			return r.syncFailed(ctx, lokiRule, status, err)
+		}
+		if err := migrateLocation(ctx, r.Sink, status.Tenant, previous, stored); err != nil {
+			return r.syncFailed(ctx, lokiRule, status, err)
 		}
-		cm.Data[fileName] = string(data)
-		_, err := r.Clientset.CoreV1().ConfigMaps(r.RulesConfigMapNamespace).Update(ctx, cm, metav1.UpdateOptions{})
+		hash, err := hashRules(groups)
 		if err != nil {
+			return ctrl.Result{}, err
+		}
+		status.Tenant = tenant
+		status.ConfigMap = stored.ConfigMap
+		status.Key = stored.Key
+		status.Hash = hash
+		location = &stored
+	}
+	status.Targets, err = r.Targets.Sync(ctx, lokiRule, name, lokiRule.Spec.Tenant, r.Labels.Renderer(staticRules(lokiRule.Spec.Groups), source), status.Targets)
+	if err != nil {
+		return r.syncFailed(ctx, lokiRule, status, err)
+	}
+	conditions.synced(tenant, location, status.Targets)
+	lastSyncTimestamp.WithLabelValues("GlobalLokiRule").SetToCurrentTime()
+	if err := r.updateStatus(ctx, lokiRule, status); err != nil {
+		return ctrl.Result{Requeue: true}, err
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// finalize removes the rules from the sink and then the finalizer, so the GlobalLokiRule can be deleted
+// or be managed by another instance of the operator
+func (r *GlobalLokiRuleReconciler) finalize(ctx context.Context, lokiRule *loggingv1beta1.GlobalLokiRule, name string, reason string, message string) (ctrl.Result, error) {
+	if !controllerutil.ContainsFinalizer(lokiRule, r.Scope.Finalizer()) {
+		return ctrl.Result{}, nil
+	}
+	if r.Sink != nil {
+		location := RuleLocation{ConfigMap: lokiRule.Status.ConfigMap, Key: lokiRule.Status.Key}
+		if err := cleanupRules(ctx, r.Sink, lokiRule.Status.Tenant, name, location); err != nil {
 			return ctrl.Result{Requeue: true}, err
 		}
 	}
+	if err := r.Targets.Cleanup(ctx, name, lokiRule.Status.Targets); err != nil {
+		return ctrl.Result{Requeue: true}, err
+	}
+	r.Recorder.Event(lokiRule, v1.EventTypeNormal, reason, message)
 
+	controllerutil.RemoveFinalizer(lokiRule, r.Scope.Finalizer())
+	if err := r.Update(ctx, lokiRule); err != nil {
+		return ctrl.Result{Requeue: true}, err
+	}
 	return ctrl.Result{}, nil
 }
 
+// removeRules removes the stored rules from the sink and the targets, and their locations from the status
+func (r *GlobalLokiRuleReconciler) removeRules(ctx context.Context, name string, status *loggingv1beta1.GlobalLokiRuleStatus) error {
+	if r.Sink != nil && status.Tenant != "" {
+		location := RuleLocation{ConfigMap: status.ConfigMap, Key: status.Key}
+		if err := cleanupRules(ctx, r.Sink, status.Tenant, name, location); err != nil {
+			return err
+		}
+	}
+	if err := r.Targets.Cleanup(ctx, name, status.Targets); err != nil {
+		return err
+	}
+	status.Tenant, status.ConfigMap, status.Key, status.Hash = "", "", "", ""
+	status.Targets = nil
+	return nil
+}
+
+// syncFailed reports that the rules couldn't be stored and requeues the GlobalLokiRule
+func (r *GlobalLokiRuleReconciler) syncFailed(ctx context.Context, lokiRule *loggingv1beta1.GlobalLokiRule, status *loggingv1beta1.GlobalLokiRuleStatus, err error) (ctrl.Result, error) {
+	conditions := ruleConditions{&status.Conditions, lokiRule.Generation}
+	conditions.syncFailed(err)
+	syncErrors.WithLabelValues("GlobalLokiRule", syncErrorReason(err)).Inc()
+	if statusErr := r.updateStatus(ctx, lokiRule, status); statusErr != nil {
+		r.Log.Error(statusErr, "unable to update status", "globallokirule", client.ObjectKeyFromObject(lokiRule))
+	}
+	return ctrl.Result{Requeue: true}, err
+}
+
+// store applies the rules to the sink, after removing them from the previous tenant
+func (r *GlobalLokiRuleReconciler) store(ctx context.Context, oldTenant string, tenant string, name string, groups []*loggingv1beta1.LokiRuleGroup) (RuleLocation, error) {
+	if oldTenant != "" && oldTenant != tenant {
+		// Moved to another tenant
+		if err := r.Sink.Delete(ctx, oldTenant, name); err != nil {
+			return RuleLocation{}, err
+		}
+	}
+	return r.Sink.Apply(ctx, tenant, name, groups)
+}
+
+// updateStatus updates the status of the GlobalLokiRule when it changed
+// and emits an event when the outcome of the reconcile changed
+func (r *GlobalLokiRuleReconciler) updateStatus(ctx context.Context, lokiRule *loggingv1beta1.GlobalLokiRule, status *loggingv1beta1.GlobalLokiRuleStatus) error {
+	if equality.Semantic.DeepEqual(&lokiRule.Status, status) {
+		return nil
+	}
+	oldStatus := lokiRule.Status
+	lokiRule.Status = *status
+	if err := r.Client.Status().Update(ctx, lokiRule); err != nil {
+		return err
+	}
+	rulesChanged := oldStatus.Hash != status.Hash || !equality.Semantic.DeepEqual(oldStatus.Targets, status.Targets)
+	recordReadyEvent(r.Recorder, lokiRule, oldStatus.Conditions, status.Conditions, rulesChanged)
+	return nil
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *GlobalLokiRuleReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&loggingv1beta1.GlobalLokiRule{}).
+		For(&loggingv1beta1.GlobalLokiRule{}, builder.WithPredicates(r.Scope.Predicate())).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
+		Watches(&source.Kind{Type: &loggingv1beta1.LokiRulerTarget{}}, handler.EnqueueRequestsFromMapFunc(r.allGlobalLokiRules),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
 		Complete(r)
 }
+
+// allGlobalLokiRules enqueues all the GlobalLokiRules, so changes to a LokiRulerTarget are picked up
+func (r *GlobalLokiRuleReconciler) allGlobalLokiRules(obj client.Object) []reconcile.Request {
+	lokiRules := &loggingv1beta1.GlobalLokiRuleList{}
+	if err := r.List(context.TODO(), lokiRules); err != nil {
+		r.Log.Error(err, "unable to list GlobalLokiRules", "lokirulertarget", obj.GetName())
+		return nil
+	}
+
+	requests := make([]reconcile.Request, 0, len(lokiRules.Items))
+	for _, lokiRule := range lokiRules.Items {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Name: lokiRule.Name},
+		})
+	}
+	return requests
+}
@@ -0,0 +1,46 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+)
+
+// GrantedNamespaces returns the other namespaces that granted the LokiRules of the namespace
+// access to their log streams with a LokiRuleGrant
+func GrantedNamespaces(ctx context.Context, c client.Reader, namespace string) ([]string, error) {
+	grants := &loggingv1beta1.LokiRuleGrantList{}
+	if err := c.List(ctx, grants); err != nil {
+		return nil, err
+	}
+
+	var namespaces []string
+	seen := map[string]bool{namespace: true}
+	for _, grant := range grants.Items {
+		if !seen[grant.Namespace] && grant.Grants(namespace) {
+			seen[grant.Namespace] = true
+			namespaces = append(namespaces, grant.Namespace)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+)
+
+func TestGrantedNamespaces(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := loggingv1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	grant := func(namespace string, name string, from ...string) *loggingv1beta1.LokiRuleGrant {
+		grant := &loggingv1beta1.LokiRuleGrant{}
+		grant.Namespace, grant.Name = namespace, name
+		for _, ns := range from {
+			grant.Spec.From = append(grant.Spec.From, loggingv1beta1.LokiRuleGrantFrom{Namespace: ns})
+		}
+		return grant
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		grant("ingress", "app", "app", "web"),
+		grant("monitoring", "teams", "web", "app"),
+		grant("monitoring", "app", "app"),
+		grant("kube-system", "web", "web"),
+		grant("app", "self", "app"),
+	).Build()
+
+	namespaces, err := GrantedNamespaces(context.Background(), c, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"ingress", "monitoring"}; !reflect.DeepEqual(namespaces, expected) {
+		t.Fatalf("expected %v, got %v", expected, namespaces)
+	}
+}
@@ -1,6 +1,250 @@
 package controllers
 
+import (
+	"bytes"
+	goerrors "errors"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	v1 "k8s.io/api/core/v1"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+)
+
 type Label struct {
 	Name  string
 	Value string
 }
+
+// labelsFromMap returns the labels sorted by name
+func labelsFromMap(m map[string]string) []Label {
+	labels := make([]Label, 0, len(m))
+	for name, value := range m {
+		labels = append(labels, Label{Name: name, Value: value})
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+	return labels
+}
+
+// Labels added to the rules by the operator, next to the external labels
+const (
+	GroupLabel             = "group"
+	RuleNamespaceLabel     = "lokirule_namespace"
+	RuleNameLabel          = "lokirule_name"
+	labelTemplateDelimiter = "{{"
+)
+
+// LabelConflict decides which value is kept when the operator adds a label that a rule already has
+type LabelConflict string
+
+const (
+	// LabelConflictOperatorWins overwrites the label of the rule
+	LabelConflictOperatorWins LabelConflict = "operator-wins"
+	// LabelConflictRuleWins keeps the label of the rule
+	LabelConflictRuleWins LabelConflict = "rule-wins"
+	// LabelConflictReject makes the rule invalid
+	LabelConflictReject LabelConflict = "reject"
+)
+
+// ParseLabelConflict returns the LabelConflict of a flag value
+func ParseLabelConflict(value string) (LabelConflict, error) {
+	switch conflict := LabelConflict(value); conflict {
+	case LabelConflictOperatorWins, LabelConflictRuleWins, LabelConflictReject:
+		return conflict, nil
+	}
+	return "", fmt.Errorf("invalid label conflict '%s', should be one of %s, %s or %s",
+		value, LabelConflictOperatorWins, LabelConflictRuleWins, LabelConflictReject)
+}
+
+// LabelConflictError is returned when a rule has a label the operator adds and conflicts are rejected
+type LabelConflictError struct {
+	msg string
+}
+
+func (e *LabelConflictError) Error() string {
+	return e.msg
+}
+
+// IsLabelConflict returns true if the error is a LabelConflictError
+func IsLabelConflict(err error) bool {
+	var conflict *LabelConflictError
+	return goerrors.As(err, &conflict)
+}
+
+// LabelPolicy adds labels to the rules of the LokiRules and GlobalLokiRules before they are stored.
+// A nil LabelPolicy only adds the labels of the LokiRulerTargets.
+type LabelPolicy struct {
+	// ExternalLabels are added to every rule. A value can be a template of the namespace
+	// of the rule, e.g. '{{ .Labels.team }}' or '{{ index .Annotations "example.com/team" }}',
+	// labels with an empty value are not added.
+	ExternalLabels []Label
+	// Conflict decides what happens when a rule already has one of the labels, defaults to operator-wins
+	Conflict LabelConflict
+	// Group always adds the 'group' label with the name of the group,
+	// otherwise it is only added together with external labels
+	Group bool
+	// Provenance adds the 'lokirule_namespace' and 'lokirule_name' labels with the LokiRule
+	// or GlobalLokiRule the rule comes from
+	Provenance bool
+}
+
+// LabelSource is the LokiRule or GlobalLokiRule the labels are added to
+type LabelSource struct {
+	// Name of the LokiRule or GlobalLokiRule
+	Name string
+	// Namespace of the LokiRule, nil for GlobalLokiRules
+	Namespace *v1.Namespace
+}
+
+// labelTemplateData is the data the templates of the external labels are executed with
+type labelTemplateData struct {
+	// Name of the LokiRule or GlobalLokiRule
+	Name string
+	// Namespace of the LokiRule, empty for GlobalLokiRules
+	Namespace   string
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// Validate validates the templates of the external labels
+func (p *LabelPolicy) Validate() error {
+	if p == nil {
+		return nil
+	}
+	if p.Conflict != "" {
+		if _, err := ParseLabelConflict(string(p.Conflict)); err != nil {
+			return err
+		}
+	}
+	for _, label := range p.ExternalLabels {
+		if _, err := parseLabelTemplate(label); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ForTarget returns the policy for the rules stored in a LokiRulerTarget,
+// the external labels of the target replace the external labels of the policy
+func (p *LabelPolicy) ForTarget(target *loggingv1beta1.LokiRulerTarget) *LabelPolicy {
+	policy := &LabelPolicy{}
+	if p != nil {
+		*policy = *p
+	}
+	policy.ExternalLabels = labelsFromMap(target.Spec.ExternalLabels)
+	return policy
+}
+
+// Renderer returns a ruleRenderer that adds the labels of the policy, with the external labels of the
+// target, to the rules of render
+func (p *LabelPolicy) Renderer(render ruleRenderer, source LabelSource) ruleRenderer {
+	return func(target *loggingv1beta1.LokiRulerTarget) ([]*loggingv1beta1.LokiRuleGroup, error) {
+		groups, err := render(target)
+		if err != nil {
+			return nil, err
+		}
+		return p.ForTarget(target).Apply(groups, source)
+	}
+}
+
+// Apply returns a copy of the groups with the labels of the policy added to every rule
+func (p *LabelPolicy) Apply(groups []*loggingv1beta1.LokiRuleGroup, source LabelSource) ([]*loggingv1beta1.LokiRuleGroup, error) {
+	groups = (&loggingv1beta1.LokiRuleSpec{Groups: groups}).DeepCopy().Groups
+	if p == nil {
+		return groups, nil
+	}
+
+	labels, err := p.render(source)
+	if err != nil {
+		return nil, err
+	}
+	if p.Provenance {
+		if source.Namespace != nil {
+			labels = append(labels, Label{Name: RuleNamespaceLabel, Value: source.Namespace.Name})
+		}
+		labels = append(labels, Label{Name: RuleNameLabel, Value: source.Name})
+	}
+	group := p.Group || len(p.ExternalLabels) > 0
+	if len(labels) == 0 && !group {
+		return groups, nil
+	}
+
+	for _, g := range groups {
+		groupLabels := labels
+		if group {
+			groupLabels = append(groupLabels[:len(groupLabels):len(groupLabels)], Label{Name: GroupLabel, Value: g.Name})
+		}
+		for _, rule := range g.Rules {
+			if err := p.addLabels(rule, g.Name, groupLabels); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return groups, nil
+}
+
+// addLabels adds the labels to the rule, resolving conflicts with the labels of the rule
+func (p *LabelPolicy) addLabels(rule *loggingv1beta1.LokiGroupRule, group string, labels []Label) error {
+	if rule.Labels == nil {
+		rule.Labels = make(map[string]string, len(labels))
+	}
+	for _, label := range labels {
+		if value, ok := rule.Labels[label.Name]; ok && value != label.Value {
+			switch p.Conflict {
+			case LabelConflictRuleWins:
+				continue
+			case LabelConflictReject:
+				return &LabelConflictError{fmt.Sprintf("rule '%s' in group '%s' has label '%s=%s', which conflicts with '%s=%s' of the operator",
+					rule.Name(), group, label.Name, value, label.Name, label.Value)}
+			}
+		}
+		rule.Labels[label.Name] = label.Value
+	}
+	return nil
+}
+
+// render returns the external labels with their templates executed for the source
+func (p *LabelPolicy) render(source LabelSource) ([]Label, error) {
+	data := labelTemplateData{Name: source.Name}
+	if source.Namespace != nil {
+		data.Namespace = source.Namespace.Name
+		data.Labels = source.Namespace.Labels
+		data.Annotations = source.Namespace.Annotations
+	}
+
+	labels := make([]Label, 0, len(p.ExternalLabels))
+	for _, label := range p.ExternalLabels {
+		tmpl, err := parseLabelTemplate(label)
+		if err != nil {
+			return nil, err
+		}
+		if tmpl == nil {
+			labels = append(labels, label)
+			continue
+		}
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, data); err != nil {
+			return nil, fmt.Errorf("unable to render label '%s': %s", label.Name, err.Error())
+		}
+		if value := b.String(); value != "" {
+			labels = append(labels, Label{Name: label.Name, Value: value})
+		}
+	}
+	return labels, nil
+}
+
+// parseLabelTemplate returns the template of a label value, or nil when the value is not a template
+func parseLabelTemplate(label Label) (*template.Template, error) {
+	if !strings.Contains(label.Value, labelTemplateDelimiter) {
+		return nil, nil
+	}
+	tmpl, err := template.New(label.Name).Option("missingkey=zero").Parse(label.Value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template of label '%s': %s", label.Name, err.Error())
+	}
+	return tmpl, nil
+}
@@ -0,0 +1,159 @@
+package controllers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+)
+
+func TestLabelPolicyApply(t *testing.T) {
+	ns := &v1.Namespace{}
+	ns.Name = "prod"
+	ns.Labels = map[string]string{"team": "payments"}
+	ns.Annotations = map[string]string{"example.com/owner": "alice"}
+	prod := LabelSource{Name: "nginx", Namespace: ns}
+	global := LabelSource{Name: "nodes"}
+
+	tests := []struct {
+		name     string
+		policy   *LabelPolicy
+		source   LabelSource
+		labels   map[string]string
+		expected map[string]string
+		err      string
+	}{
+		{
+			name:     "nil policy",
+			source:   prod,
+			labels:   map[string]string{"severity": "critical"},
+			expected: map[string]string{"severity": "critical"},
+		},
+		{
+			name:     "external labels add the group",
+			policy:   &LabelPolicy{ExternalLabels: []Label{{Name: "cluster", Value: "eu-1"}}},
+			source:   prod,
+			expected: map[string]string{"cluster": "eu-1", "group": "nginx"},
+		},
+		{
+			name:     "group without external labels",
+			policy:   &LabelPolicy{Group: true},
+			source:   prod,
+			expected: map[string]string{"group": "nginx"},
+		},
+		{
+			name:     "provenance",
+			policy:   &LabelPolicy{Provenance: true},
+			source:   prod,
+			expected: map[string]string{"lokirule_namespace": "prod", "lokirule_name": "nginx"},
+		},
+		{
+			name:     "provenance of a GlobalLokiRule",
+			policy:   &LabelPolicy{Provenance: true},
+			source:   global,
+			expected: map[string]string{"lokirule_name": "nodes"},
+		},
+		{
+			name:     "operator wins by default",
+			policy:   &LabelPolicy{ExternalLabels: []Label{{Name: "cluster", Value: "eu-1"}}},
+			source:   prod,
+			labels:   map[string]string{"cluster": "us-1"},
+			expected: map[string]string{"cluster": "eu-1", "group": "nginx"},
+		},
+		{
+			name:     "rule wins",
+			policy:   &LabelPolicy{ExternalLabels: []Label{{Name: "cluster", Value: "eu-1"}}, Conflict: LabelConflictRuleWins},
+			source:   prod,
+			labels:   map[string]string{"cluster": "us-1"},
+			expected: map[string]string{"cluster": "us-1", "group": "nginx"},
+		},
+		{
+			name:     "reject allows the same value",
+			policy:   &LabelPolicy{ExternalLabels: []Label{{Name: "cluster", Value: "eu-1"}}, Conflict: LabelConflictReject},
+			source:   prod,
+			labels:   map[string]string{"cluster": "eu-1"},
+			expected: map[string]string{"cluster": "eu-1", "group": "nginx"},
+		},
+		{
+			name:   "reject",
+			policy: &LabelPolicy{Provenance: true, Conflict: LabelConflictReject},
+			source: prod,
+			labels: map[string]string{"lokirule_name": "other"},
+			err:    "rule 'Errors' in group 'nginx' has label 'lokirule_name=other', which conflicts with 'lokirule_name=nginx' of the operator",
+		},
+		{
+			name: "templates",
+			policy: &LabelPolicy{ExternalLabels: []Label{
+				{Name: "team", Value: "{{ .Labels.team }}"},
+				{Name: "owner", Value: `{{ index .Annotations "example.com/owner" }}`},
+				{Name: "source", Value: "{{ .Namespace }}/{{ .Name }}"},
+				{Name: "missing", Value: "{{ .Labels.missing }}"},
+			}},
+			source:   prod,
+			expected: map[string]string{"team": "payments", "owner": "alice", "source": "prod/nginx", "group": "nginx"},
+		},
+		{
+			name:     "templates of a GlobalLokiRule",
+			policy:   &LabelPolicy{ExternalLabels: []Label{{Name: "team", Value: "{{ .Labels.team }}"}}},
+			source:   global,
+			expected: map[string]string{"group": "nginx"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			groups := testGroups("nginx")
+			groups[0].Rules[0].Labels = test.labels
+			result, err := test.policy.Apply(groups, test.source)
+			if test.err != "" {
+				if err == nil || !IsLabelConflict(err) || err.Error() != test.err {
+					t.Fatalf("expected label conflict %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if labels := result[0].Rules[0].Labels; !reflect.DeepEqual(labels, test.expected) && !(len(labels) == 0 && len(test.expected) == 0) {
+				t.Fatalf("expected %v, got %v", test.expected, labels)
+			}
+			if !reflect.DeepEqual(groups[0].Rules[0].Labels, test.labels) {
+				t.Fatalf("expected the groups to be left as is, got %v", groups[0].Rules[0].Labels)
+			}
+		})
+	}
+}
+
+func TestLabelPolicyForTarget(t *testing.T) {
+	policy := &LabelPolicy{ExternalLabels: []Label{{Name: "cluster", Value: "eu-1"}}, Provenance: true}
+	target := &loggingv1beta1.LokiRulerTarget{}
+	target.Spec.ExternalLabels = map[string]string{"env": "staging"}
+
+	groups, err := policy.Renderer(staticRules(testGroups("nginx")), LabelSource{Name: "nodes"})(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"env": "staging", "group": "nginx", "lokirule_name": "nodes"}
+	if labels := groups[0].Rules[0].Labels; !reflect.DeepEqual(labels, expected) {
+		t.Fatalf("expected %v, got %v", expected, labels)
+	}
+	if len(policy.ExternalLabels) != 1 {
+		t.Fatal("expected the policy to be left as is")
+	}
+}
+
+func TestLabelPolicyValidate(t *testing.T) {
+	if err := (&LabelPolicy{ExternalLabels: []Label{{Name: "team", Value: "{{ .Labels.team }}"}}}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+	err := (&LabelPolicy{ExternalLabels: []Label{{Name: "team", Value: "{{ .Labels.team"}}}).Validate()
+	if err == nil || !strings.Contains(err.Error(), "invalid template of label 'team'") {
+		t.Fatalf("expected an invalid template, got %v", err)
+	}
+	if _, err := ParseLabelConflict("ignore"); err == nil {
+		t.Fatal("expected an invalid label conflict")
+	}
+}
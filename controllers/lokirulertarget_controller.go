@@ -0,0 +1,203 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+)
+
+// LokiRulerTargetReconciler reconciles a LokiRulerTarget object.
+// The rules are stored in the target by the LokiRule and GlobalLokiRule controllers,
+// this controller validates the target and counts the rules stored in it. It removes the
+// rules from the destination of a deleted or invalid target, and from the previous
+// destination when the destination changes.
+type LokiRulerTargetReconciler struct {
+	client.Client
+	Log     logr.Logger
+	Scheme  *runtime.Scheme
+	Targets *RuleTargets
+	// Scope of the operator, which provides the finalizer of the instance
+	Scope *RuleScope
+}
+
+// +kubebuilder:rbac:groups=logging.opsgy.com,resources=lokirulertargets,verbs=get;list;watch;update;patch
+// +kubebuilder:rbac:groups=logging.opsgy.com,resources=lokirulertargets/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=logging.opsgy.com,resources=lokirulertargets/finalizers,verbs=update
+
+// Reconcile updates the status of a LokiRulerTarget
+func (r *LokiRulerTargetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	target := &loggingv1beta1.LokiRulerTarget{}
+	if err := r.Get(ctx, req.NamespacedName, target); err != nil {
+		if errors.IsNotFound(err) {
+			r.Targets.Release(req.Name, nil)
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	if !target.DeletionTimestamp.IsZero() {
+		return r.finalize(ctx, target)
+	}
+	if !controllerutil.ContainsFinalizer(target, r.Scope.Finalizer()) {
+		controllerutil.AddFinalizer(target, r.Scope.Finalizer())
+		if err := r.Update(ctx, target); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	status := target.Status.DeepCopy()
+	status.ObservedGeneration = target.Generation
+	conditions := ruleConditions{&status.Conditions, target.Generation}
+	if err := validateTarget(target); err != nil {
+		if status.Destination != nil {
+			if err := r.Targets.CleanupDestination(ctx, target.Name, *status.Destination); err != nil {
+				return ctrl.Result{Requeue: true}, err
+			}
+			status.Destination = nil
+		}
+		r.Targets.Release(target.Name, nil)
+		status.LokiRules = 0
+		status.GlobalLokiRules = 0
+		conditions.set(loggingv1beta1.ConditionReady, metav1.ConditionFalse, loggingv1beta1.ReasonInvalidTarget, err.Error())
+		return ctrl.Result{}, r.updateStatus(ctx, target, status)
+	}
+
+	destination := targetDestination(target)
+	if previous := previousDestination(target); previous != nil {
+		if err := r.Targets.CleanupDestination(ctx, target.Name, *previous); err != nil {
+			return ctrl.Result{Requeue: true}, err
+		}
+	}
+	r.Targets.Release(target.Name, &destination)
+	status.Destination = &destination
+
+	lokiRules := &loggingv1beta1.LokiRuleList{}
+	if err := r.List(ctx, lokiRules); err != nil {
+		return ctrl.Result{}, err
+	}
+	status.LokiRules = 0
+	for _, lokiRule := range lokiRules.Items {
+		if storedInTarget(lokiRule.Status.Targets, target.Name) {
+			status.LokiRules++
+		}
+	}
+	globalLokiRules := &loggingv1beta1.GlobalLokiRuleList{}
+	if err := r.List(ctx, globalLokiRules); err != nil {
+		return ctrl.Result{}, err
+	}
+	status.GlobalLokiRules = 0
+	for _, globalLokiRule := range globalLokiRules.Items {
+		if storedInTarget(globalLokiRule.Status.Targets, target.Name) {
+			status.GlobalLokiRules++
+		}
+	}
+
+	var message string
+	if target.Spec.ConfigMap != nil {
+		message = fmt.Sprintf("Rules are stored in ConfigMap %s/%s", target.Spec.ConfigMap.Namespace, target.Spec.ConfigMap.Name)
+	} else {
+		message = fmt.Sprintf("Rules are stored in the Loki ruler at %s", target.Spec.Ruler.URL)
+	}
+	conditions.set(loggingv1beta1.ConditionReady, metav1.ConditionTrue, loggingv1beta1.ReasonValid, message)
+	return ctrl.Result{}, r.updateStatus(ctx, target, status)
+}
+
+// finalize removes the rules from the destination of a deleted target, before removing the finalizer
+func (r *LokiRulerTargetReconciler) finalize(ctx context.Context, target *loggingv1beta1.LokiRulerTarget) (ctrl.Result, error) {
+	if !controllerutil.ContainsFinalizer(target, r.Scope.Finalizer()) {
+		return ctrl.Result{}, nil
+	}
+	var destinations []loggingv1beta1.RulerTargetDestination
+	if validateTarget(target) == nil {
+		destinations = append(destinations, targetDestination(target))
+	}
+	if previous := previousDestination(target); previous != nil {
+		destinations = append(destinations, *previous)
+	}
+	for _, destination := range destinations {
+		if err := r.Targets.CleanupDestination(ctx, target.Name, destination); err != nil {
+			return ctrl.Result{Requeue: true}, err
+		}
+	}
+	r.Targets.Release(target.Name, nil)
+
+	controllerutil.RemoveFinalizer(target, r.Scope.Finalizer())
+	if err := r.Update(ctx, target); err != nil {
+		return ctrl.Result{Requeue: true}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// updateStatus updates the status of the LokiRulerTarget when it changed
+func (r *LokiRulerTargetReconciler) updateStatus(ctx context.Context, target *loggingv1beta1.LokiRulerTarget, status *loggingv1beta1.LokiRulerTargetStatus) error {
+	if equality.Semantic.DeepEqual(&target.Status, status) {
+		return nil
+	}
+	target.Status = *status
+	return r.Client.Status().Update(ctx, target)
+}
+
+func storedInTarget(targets []loggingv1beta1.RuleTargetStatus, name string) bool {
+	for _, target := range targets {
+		if target.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *LokiRulerTargetReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&loggingv1beta1.LokiRulerTarget{}).
+		Watches(&source.Kind{Type: &loggingv1beta1.LokiRule{}}, handler.EnqueueRequestsFromMapFunc(r.allTargets)).
+		Watches(&source.Kind{Type: &loggingv1beta1.GlobalLokiRule{}}, handler.EnqueueRequestsFromMapFunc(r.allTargets)).
+		Complete(r)
+}
+
+// allTargets enqueues all the LokiRulerTargets, so the number of rules stored in them is updated
+func (r *LokiRulerTargetReconciler) allTargets(obj client.Object) []reconcile.Request {
+	targets := &loggingv1beta1.LokiRulerTargetList{}
+	if err := r.List(context.TODO(), targets); err != nil {
+		r.Log.Error(err, "unable to list LokiRulerTargets")
+		return nil
+	}
+
+	requests := make([]reconcile.Request, 0, len(targets.Items))
+	for _, target := range targets.Items {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Name: target.Name},
+		})
+	}
+	return requests
+}
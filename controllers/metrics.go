@@ -0,0 +1,198 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+)
+
+const metricsNamespace = "loki_rule_operator"
+
+// Reasons of the sync errors metric
+const (
+	SyncErrorValidation        = "validation"
+	SyncErrorOwnershipConflict = "ownership_conflict"
+	SyncErrorAPI               = "api_error"
+)
+
+var (
+	syncErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sync_errors_total",
+		Help:      "Number of rules that failed to sync, by kind and reason.",
+	}, []string{"kind", "reason"})
+
+	lastSyncTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_sync_timestamp_seconds",
+		Help:      "Unix timestamp of the last successful sync of a rule, by kind.",
+	}, []string{"kind"})
+
+	configMapSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "configmap_size_bytes",
+		Help:      "Size in bytes of the data of a rules ConfigMap.",
+	}, []string{"configmap", "tenant"})
+
+	configMapMaxSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "configmap_max_size_bytes",
+		Help:      "Maximum size in bytes of the data of a rules ConfigMap.",
+	})
+
+	orphanedRuleFiles = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "orphaned_rule_files",
+		Help:      "Number of rules files without a LokiRule or GlobalLokiRule found by the last orphan sweep.",
+	})
+
+	orphanedRuleFilesRemoved = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "orphaned_rule_files_removed_total",
+		Help:      "Number of rules files without a LokiRule or GlobalLokiRule removed by the orphan sweep.",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(syncErrors, lastSyncTimestamp, configMapSize, configMapMaxSize,
+		orphanedRuleFiles, orphanedRuleFilesRemoved)
+}
+
+// syncErrorReason returns the reason of the sync errors metric for an error of the sink
+func syncErrorReason(err error) string {
+	if IsConfigMapConflict(err) {
+		return SyncErrorOwnershipConflict
+	}
+	return SyncErrorAPI
+}
+
+var (
+	rulesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "rules"),
+		"Number of LokiRules and GlobalLokiRules, by kind, namespace and validity (true, false or unknown).",
+		[]string{"kind", "namespace", "valid"}, nil)
+	renderedGroupsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "rendered_groups"),
+		"Number of rule groups of the valid LokiRules and GlobalLokiRules, by kind and namespace.",
+		[]string{"kind", "namespace"}, nil)
+	renderedRulesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "rendered_rules"),
+		"Number of alerting and recording rules of the valid LokiRules and GlobalLokiRules, by kind and namespace.",
+		[]string{"kind", "namespace"}, nil)
+)
+
+// RuleCollector reports the inventory of LokiRules and GlobalLokiRules.
+// The rules are listed from the cache of the manager on every scrape,
+// so deleted rules disappear from the metrics.
+type RuleCollector struct {
+	Client client.Reader
+	Log    logr.Logger
+}
+
+var _ prometheus.Collector = &RuleCollector{}
+
+// NewRuleCollector returns a RuleCollector for the given client
+func NewRuleCollector(c client.Reader, log logr.Logger) *RuleCollector {
+	return &RuleCollector{Client: c, Log: log}
+}
+
+// Describe implements prometheus.Collector
+func (c *RuleCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rulesDesc
+	ch <- renderedGroupsDesc
+	ch <- renderedRulesDesc
+}
+
+// ruleInventory counts the rules of a kind by namespace
+type ruleInventory struct {
+	rules  map[[2]string]int
+	groups map[string]int
+	count  map[string]int
+}
+
+func newRuleInventory() *ruleInventory {
+	return &ruleInventory{
+		rules:  make(map[[2]string]int),
+		groups: make(map[string]int),
+		count:  make(map[string]int),
+	}
+}
+
+// add counts a rule. Rules that are not validated yet have validity 'unknown'.
+func (inv *ruleInventory) add(namespace string, conditions []metav1.Condition, groups []*loggingv1beta1.LokiRuleGroup) {
+	validity := "unknown"
+	if validated := meta.FindStatusCondition(conditions, loggingv1beta1.ConditionValidated); validated != nil {
+		validity = strings.ToLower(string(validated.Status))
+	}
+	inv.rules[[2]string{namespace, validity}]++
+	if validity != "true" {
+		return
+	}
+	inv.groups[namespace] += len(groups)
+	for _, group := range groups {
+		inv.count[namespace] += len(group.Rules)
+	}
+}
+
+func (inv *ruleInventory) collect(ch chan<- prometheus.Metric, kind string) {
+	for key, value := range inv.rules {
+		ch <- prometheus.MustNewConstMetric(rulesDesc, prometheus.GaugeValue, float64(value), kind, key[0], key[1])
+	}
+	for namespace, value := range inv.groups {
+		ch <- prometheus.MustNewConstMetric(renderedGroupsDesc, prometheus.GaugeValue, float64(value), kind, namespace)
+	}
+	for namespace, value := range inv.count {
+		ch <- prometheus.MustNewConstMetric(renderedRulesDesc, prometheus.GaugeValue, float64(value), kind, namespace)
+	}
+}
+
+// Collect implements prometheus.Collector
+func (c *RuleCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx := context.Background()
+
+	lokiRules := &loggingv1beta1.LokiRuleList{}
+	if err := c.Client.List(ctx, lokiRules); err != nil {
+		c.Log.Error(err, "unable to list LokiRules")
+	} else {
+		inv := newRuleInventory()
+		for _, lokiRule := range lokiRules.Items {
+			inv.add(lokiRule.Namespace, lokiRule.Status.Conditions, lokiRule.Spec.Groups)
+		}
+		inv.collect(ch, "LokiRule")
+	}
+
+	globalLokiRules := &loggingv1beta1.GlobalLokiRuleList{}
+	if err := c.Client.List(ctx, globalLokiRules); err != nil {
+		c.Log.Error(err, "unable to list GlobalLokiRules")
+	} else {
+		inv := newRuleInventory()
+		for _, globalLokiRule := range globalLokiRules.Items {
+			inv.add("", globalLokiRule.Status.Conditions, globalLokiRule.Spec.Groups)
+		}
+		inv.collect(ch, "GlobalLokiRule")
+	}
+}
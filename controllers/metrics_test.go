@@ -0,0 +1,64 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+)
+
+func TestRuleCollector(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := loggingv1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	groups := []*loggingv1beta1.LokiRuleGroup{
+		{Name: "a", Rules: []*loggingv1beta1.LokiGroupRule{{Alert: "A"}, {Alert: "B"}}},
+		{Name: "b", Rules: []*loggingv1beta1.LokiGroupRule{{Record: "c"}}},
+	}
+	validated := func(status metav1.ConditionStatus) []metav1.Condition {
+		return []metav1.Condition{{Type: loggingv1beta1.ConditionValidated, Status: status}}
+	}
+
+	valid := &loggingv1beta1.LokiRule{Spec: loggingv1beta1.LokiRuleSpec{Groups: groups}}
+	valid.Name, valid.Namespace = "valid", "prod"
+	valid.Status.Conditions = validated(metav1.ConditionTrue)
+	invalid := &loggingv1beta1.LokiRule{Spec: loggingv1beta1.LokiRuleSpec{Groups: groups}}
+	invalid.Name, invalid.Namespace = "invalid", "prod"
+	invalid.Status.Conditions = validated(metav1.ConditionFalse)
+	pending := &loggingv1beta1.LokiRule{}
+	pending.Name, pending.Namespace = "pending", "dev"
+	global := &loggingv1beta1.GlobalLokiRule{Spec: loggingv1beta1.GlobalLokiRuleSpec{Groups: groups[:1]}}
+	global.Name = "global"
+	global.Status.Conditions = validated(metav1.ConditionTrue)
+
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(valid, invalid, pending, global).Build()
+	collector := NewRuleCollector(c, logf.Log)
+
+	expected := `
+# HELP loki_rule_operator_rendered_groups Number of rule groups of the valid LokiRules and GlobalLokiRules, by kind and namespace.
+# TYPE loki_rule_operator_rendered_groups gauge
+loki_rule_operator_rendered_groups{kind="GlobalLokiRule",namespace=""} 1
+loki_rule_operator_rendered_groups{kind="LokiRule",namespace="prod"} 2
+# HELP loki_rule_operator_rendered_rules Number of alerting and recording rules of the valid LokiRules and GlobalLokiRules, by kind and namespace.
+# TYPE loki_rule_operator_rendered_rules gauge
+loki_rule_operator_rendered_rules{kind="GlobalLokiRule",namespace=""} 2
+loki_rule_operator_rendered_rules{kind="LokiRule",namespace="prod"} 3
+# HELP loki_rule_operator_rules Number of LokiRules and GlobalLokiRules, by kind, namespace and validity (true, false or unknown).
+# TYPE loki_rule_operator_rules gauge
+loki_rule_operator_rules{kind="GlobalLokiRule",namespace="",valid="true"} 1
+loki_rule_operator_rules{kind="LokiRule",namespace="dev",valid="unknown"} 1
+loki_rule_operator_rules{kind="LokiRule",namespace="prod",valid="false"} 1
+loki_rule_operator_rules{kind="LokiRule",namespace="prod",valid="true"} 1
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,242 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"gopkg.in/yaml.v2"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+)
+
+// The rules of a LokiRule are stored under the name 'lokirule__<namespace>__<name>' and the rules of
+// a GlobalLokiRule under 'globallokirule__<name>', e.g. in the file 'lokirule__prod__nginx.yaml'.
+// Names and namespaces of Kubernetes objects can't contain underscores, so every name belongs
+// to exactly one object and can be parsed back with ParseRuleName.
+const (
+	ruleNameSeparator        = "__"
+	lokiRuleNamePrefix       = "lokirule"
+	globalLokiRuleNamePrefix = "globallokirule"
+	ruleFileExtension        = ".yaml"
+)
+
+// RuleRef is the LokiRule or GlobalLokiRule rules belong to
+type RuleRef struct {
+	// Kind is either LokiRule or GlobalLokiRule
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+// LokiRuleName returns the name the rules of a LokiRule are stored under
+func LokiRuleName(namespace string, name string) string {
+	return strings.Join([]string{lokiRuleNamePrefix, namespace, name}, ruleNameSeparator)
+}
+
+// GlobalLokiRuleName returns the name the rules of a GlobalLokiRule are stored under
+func GlobalLokiRuleName(name string) string {
+	return globalLokiRuleNamePrefix + ruleNameSeparator + name
+}
+
+// RuleName returns the name the rules of a LokiRule or GlobalLokiRule are stored under
+func RuleName(obj client.Object) string {
+	if _, ok := obj.(*loggingv1beta1.GlobalLokiRule); ok {
+		return GlobalLokiRuleName(obj.GetName())
+	}
+	return LokiRuleName(obj.GetNamespace(), obj.GetName())
+}
+
+// ParseRuleName returns the LokiRule or GlobalLokiRule of a name returned by RuleName,
+// or of the key of a rules file. It returns false for other names, like the names of the legacy scheme.
+// The orphan sweep uses it to find the owner of a rules file. Drift of a rules file doesn't need it:
+// the periodic reconcile of the owner rewrites the file under RuleName, and a file without an owner
+// can't drift back to a rule.
+func ParseRuleName(name string) (RuleRef, bool) {
+	name = strings.TrimSuffix(strings.TrimSuffix(name, ruleFileExtension), ".yml")
+	parts := strings.Split(name, ruleNameSeparator)
+	for _, part := range parts[1:] {
+		if part == "" {
+			return RuleRef{}, false
+		}
+	}
+	switch {
+	case len(parts) == 3 && parts[0] == lokiRuleNamePrefix:
+		return RuleRef{Kind: "LokiRule", Namespace: parts[1], Name: parts[2]}, true
+	case len(parts) == 2 && parts[0] == globalLokiRuleNamePrefix:
+		return RuleRef{Kind: "GlobalLokiRule", Name: parts[1]}, true
+	}
+	return RuleRef{}, false
+}
+
+// migrateLocation removes the rules of the tenant from their previous location, when they are
+// now stored under another key, e.g. when they were stored under a name of the legacy scheme.
+// Rules without a previous location are migrated on startup, see LegacyMigration.
+func migrateLocation(ctx context.Context, sink RuleSink, tenant string, previous RuleLocation, location RuleLocation) error {
+	if tenant == "" || previous.Key == "" || previous.Key == location.Key {
+		return nil
+	}
+	return sink.DeleteLocation(ctx, tenant, previous)
+}
+
+// legacyFileName returns the key of the legacy scheme, '<namespace>-<name>.yml' for LokiRules and
+// '-<name>.yml' for GlobalLokiRules, which isn't unique: 'a-b/c' and 'a/b-c' share 'a-b-c.yml'
+func legacyFileName(namespace string, name string) string {
+	return namespace + "-" + name + ".yml"
+}
+
+// LegacyMigration moves the rules files of the legacy scheme to the names returned by RuleName.
+// The operator released with the legacy scheme didn't record the key in the status of the rules,
+// so the files are matched to the LokiRules and GlobalLokiRules by their legacy file name.
+//
+// The migration runs once the instance is elected as leader. The RuleStore waits for it with Done
+// before it writes, so the copy can't replace rules written by a reconcile.
+type LegacyMigration struct {
+	Client client.Client
+	Sink   *ConfigMapSink
+	Log    logr.Logger
+
+	done chan struct{}
+}
+
+var _ manager.Runnable = &LegacyMigration{}
+var _ manager.LeaderElectionRunnable = &LegacyMigration{}
+
+// NewLegacyMigration returns the migration of the legacy rules files in the ConfigMaps of the sink
+func NewLegacyMigration(c client.Client, sink *ConfigMapSink, log logr.Logger) *LegacyMigration {
+	return &LegacyMigration{
+		Client: c,
+		Sink:   sink,
+		Log:    log,
+		done:   make(chan struct{}),
+	}
+}
+
+// Start implements manager.Runnable. A failed migration stops the manager, instead of letting the
+// rules be written and the legacy files be removed by the orphan sweep. It's retried on the next start.
+func (m *LegacyMigration) Start(ctx context.Context) error {
+	migrated, err := m.Migrate(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to migrate the legacy rules files: %w", err)
+	}
+	m.Log.Info("migrated the legacy rules files", "files", migrated)
+	close(m.done)
+	return nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable
+func (m *LegacyMigration) NeedLeaderElection() bool {
+	return true
+}
+
+// Done is closed once all the legacy rules files are migrated
+func (m *LegacyMigration) Done() <-chan struct{} {
+	return m.done
+}
+
+// Migrate copies the rules of every legacy file to the name of its LokiRule or GlobalLokiRule,
+// records the new location in the status of the rule and removes the legacy file. It returns the
+// number of migrated files. Nothing else should write the rules ConfigMaps in the meantime, see Start.
+// Rules that already have a key in their status are migrated by their reconcile, see migrateLocation,
+// and files of unknown or ambiguous rules are left to the orphan sweep.
+func (m *LegacyMigration) Migrate(ctx context.Context) (int, error) {
+	files, err := m.Sink.ListFiles(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	owners := make(map[string][]client.Object)
+	lokiRules := &loggingv1beta1.LokiRuleList{}
+	if err := m.Client.List(ctx, lokiRules); err != nil {
+		return 0, err
+	}
+	for i := range lokiRules.Items {
+		if lokiRule := &lokiRules.Items[i]; lokiRule.Status.Key == "" {
+			key := legacyFileName(lokiRule.Namespace, lokiRule.Name)
+			owners[key] = append(owners[key], lokiRule)
+		}
+	}
+	globalLokiRules := &loggingv1beta1.GlobalLokiRuleList{}
+	if err := m.Client.List(ctx, globalLokiRules); err != nil {
+		return 0, err
+	}
+	for i := range globalLokiRules.Items {
+		if globalLokiRule := &globalLokiRules.Items[i]; globalLokiRule.Status.Key == "" {
+			key := legacyFileName("", globalLokiRule.Name)
+			owners[key] = append(owners[key], globalLokiRule)
+		}
+	}
+
+	migrated := 0
+	for _, file := range files {
+		objs := owners[file.Key]
+		if len(objs) == 0 {
+			continue
+		}
+		log := m.Log.WithValues("configmap", file.ConfigMap, "key", file.Key, "tenant", file.Tenant)
+		if len(objs) > 1 {
+			log.Info("legacy rules file matches multiple rules, leaving it to the orphan sweep")
+			continue
+		}
+		if err := m.migrate(ctx, file, objs[0]); err != nil {
+			return migrated, err
+		}
+		log.Info("migrated legacy rules file", "name", RuleName(objs[0]))
+		migrated++
+	}
+	return migrated, nil
+}
+
+// migrate copies the rules of the legacy file to the name of the rule and removes the legacy file
+func (m *LegacyMigration) migrate(ctx context.Context, file RuleFile, obj client.Object) error {
+	data, err := m.Sink.ReadFile(ctx, file)
+	if err != nil {
+		return err
+	}
+	spec := &loggingv1beta1.LokiRuleSpec{}
+	if err := yaml.Unmarshal([]byte(data), spec); err != nil {
+		return fmt.Errorf("invalid legacy rules file '%s': %w", file.Key, err)
+	}
+	location, err := m.Sink.Apply(ctx, file.Tenant, RuleName(obj), spec.Groups)
+	if err != nil {
+		return err
+	}
+
+	// The reconcile of an invalid rule can update its status in the meantime
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if err := m.Client.Get(ctx, client.ObjectKeyFromObject(obj), obj); err != nil {
+			return err
+		}
+		switch obj := obj.(type) {
+		case *loggingv1beta1.LokiRule:
+			obj.Status.Tenant, obj.Status.ConfigMap, obj.Status.Key = file.Tenant, location.ConfigMap, location.Key
+		case *loggingv1beta1.GlobalLokiRule:
+			obj.Status.Tenant, obj.Status.ConfigMap, obj.Status.Key = file.Tenant, location.ConfigMap, location.Key
+		}
+		return m.Client.Status().Update(ctx, obj)
+	})
+	if err != nil {
+		return err
+	}
+	return m.Sink.DeleteLocation(ctx, file.Tenant, RuleLocation{ConfigMap: file.ConfigMap, Key: file.Key})
+}
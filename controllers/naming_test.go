@@ -0,0 +1,216 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+)
+
+func TestRuleNames(t *testing.T) {
+	lokiRule := &loggingv1beta1.LokiRule{}
+	lokiRule.Name, lokiRule.Namespace = "nginx", "prod"
+	globalLokiRule := &loggingv1beta1.GlobalLokiRule{}
+	globalLokiRule.Name = "nodes"
+
+	tests := []struct {
+		name     string
+		expected RuleRef
+	}{
+		{RuleName(lokiRule), RuleRef{Kind: "LokiRule", Namespace: "prod", Name: "nginx"}},
+		{RuleName(globalLokiRule), RuleRef{Kind: "GlobalLokiRule", Name: "nodes"}},
+		{"lokirule__prod__nginx.yaml", RuleRef{Kind: "LokiRule", Namespace: "prod", Name: "nginx"}},
+		{"lokirule__prod__nginx.yml", RuleRef{Kind: "LokiRule", Namespace: "prod", Name: "nginx"}},
+		{"globallokirule__nodes.yaml", RuleRef{Kind: "GlobalLokiRule", Name: "nodes"}},
+	}
+	for _, test := range tests {
+		ref, ok := ParseRuleName(test.name)
+		if !ok || ref != test.expected {
+			t.Fatalf("expected %s to be parsed to %v, got %v", test.name, test.expected, ref)
+		}
+	}
+
+	for _, name := range []string{"prod-nginx.yml", "-nodes.yml", "lokirule__prod.yaml", "lokirule____nginx.yaml", "globallokirule__prod__nginx.yaml", "lokirule__prod__nginx__x.yaml"} {
+		if ref, ok := ParseRuleName(name); ok {
+			t.Fatalf("expected %s not to be parsed, got %v", name, ref)
+		}
+	}
+
+	// The legacy scheme stored both in 'a-b-c.yml'
+	if LokiRuleName("a-b", "c") == LokiRuleName("a", "b-c") {
+		t.Fatal("expected the names of different LokiRules to differ")
+	}
+	if LokiRuleName("", "nodes") == GlobalLokiRuleName("nodes") {
+		t.Fatal("expected the names of a LokiRule and a GlobalLokiRule to differ")
+	}
+}
+
+func TestMigrateLocation(t *testing.T) {
+	clientset := k8sfake.NewSimpleClientset(rulesConfigMap("loki-rules", "", "prod-nginx.yml"))
+	sink := &ConfigMapSink{Clientset: clientset, Name: "loki-rules", Namespace: "loki", DefaultTenant: "fake", MaxSize: DefaultConfigMapMaxSize, MaxShards: 1}
+	ctx := context.Background()
+
+	previous := RuleLocation{ConfigMap: "loki-rules", Key: "prod-nginx.yml"}
+	location, err := sink.Apply(ctx, "fake", LokiRuleName("prod", "nginx"), testGroups("nginx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateLocation(ctx, sink, "fake", previous, location); err != nil {
+		t.Fatal(err)
+	}
+	// Already migrated
+	if err := migrateLocation(ctx, sink, "fake", location, location); err != nil {
+		t.Fatal(err)
+	}
+
+	cm, err := clientset.CoreV1().ConfigMaps("loki").Get(ctx, "loki-rules", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cm.Data["prod-nginx.yml"]; ok {
+		t.Fatalf("expected the legacy key to be removed, got %v", cm.Data)
+	}
+	if _, ok := cm.Data["lokirule__prod__nginx.yaml"]; !ok {
+		t.Fatalf("expected the rules under the new key, got %v", cm.Data)
+	}
+}
+
+// The rules files of the released operator are moved to the new names of their rules
+func TestLegacyMigration(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := loggingv1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	lokiRule := &loggingv1beta1.LokiRule{}
+	lokiRule.Name, lokiRule.Namespace = "nginx", "prod"
+	globalLokiRule := &loggingv1beta1.GlobalLokiRule{}
+	globalLokiRule.Name = "nodes"
+	// 'a-b/c' and 'a/b-c' were both stored in 'a-b-c.yml'
+	first, second := &loggingv1beta1.LokiRule{}, &loggingv1beta1.LokiRule{}
+	first.Name, first.Namespace = "c", "a-b"
+	second.Name, second.Namespace = "b-c", "a"
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(lokiRule, globalLokiRule, first, second).Build()
+
+	// The ConfigMap as the released operator wrote it, without a tenant
+	cm := rulesConfigMap("loki-rules", "", "a-b-c.yml", "other.yml")
+	for key, name := range map[string]string{"prod-nginx.yml": "nginx", "-nodes.yml": "nodes"} {
+		data, err := renderRules(testGroups(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cm.Data[key] = string(data)
+	}
+	clientset := k8sfake.NewSimpleClientset(cm)
+	sink := &ConfigMapSink{Clientset: clientset, Name: "loki-rules", Namespace: "loki", DefaultTenant: "fake", MaxSize: DefaultConfigMapMaxSize, MaxShards: 1}
+	migration := NewLegacyMigration(c, sink, logf.Log)
+	ctx := context.Background()
+
+	migrated, err := migration.Migrate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated != 2 {
+		t.Fatalf("expected 2 migrated files, got %d", migrated)
+	}
+	got, err := clientset.CoreV1().ConfigMaps("loki").Get(ctx, "loki-rules", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, 0, len(got.Data))
+	for key := range got.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if expected := []string{"a-b-c.yml", "globallokirule__nodes.yaml", "lokirule__prod__nginx.yaml", "other.yml"}; !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("expected keys %v, got %v", expected, keys)
+	}
+	if expected, _ := renderRules(testGroups("nginx")); got.Data["lokirule__prod__nginx.yaml"] != string(expected) {
+		t.Fatalf("expected the rules to be copied, got %s", got.Data["lokirule__prod__nginx.yaml"])
+	}
+
+	// The status records the location, so the reconcile moves the rules when the tenant differs
+	if err := c.Get(ctx, client.ObjectKeyFromObject(lokiRule), lokiRule); err != nil {
+		t.Fatal(err)
+	}
+	if status := lokiRule.Status; status.Tenant != "fake" || status.ConfigMap != "loki-rules" || status.Key != "lokirule__prod__nginx.yaml" {
+		t.Fatalf("expected the location in the status, got %+v", status)
+	}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(globalLokiRule), globalLokiRule); err != nil {
+		t.Fatal(err)
+	}
+	if status := globalLokiRule.Status; status.Tenant != "fake" || status.Key != "globallokirule__nodes.yaml" {
+		t.Fatalf("expected the location in the status, got %+v", status)
+	}
+
+	// Nothing is left to migrate
+	if migrated, err = migration.Migrate(ctx); err != nil || migrated != 0 {
+		t.Fatalf("expected nothing to migrate, got %d, %v", migrated, err)
+	}
+}
+
+// The rule store only writes once the legacy rules files are migrated, and a failed migration
+// never lets it write
+func TestLegacyMigrationBeforeRuleStore(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := loggingv1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	lokiRule := &loggingv1beta1.LokiRule{}
+	lokiRule.Name, lokiRule.Namespace = "nginx", "prod"
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(lokiRule).Build()
+	clientset := k8sfake.NewSimpleClientset(rulesConfigMap("loki-rules", "", "prod-nginx.yml"))
+	sink := &ConfigMapSink{Clientset: clientset, Name: "loki-rules", Namespace: "loki", DefaultTenant: "fake", MaxSize: DefaultConfigMapMaxSize, MaxShards: 1}
+
+	// The first attempt can't list the rules files
+	failing := true
+	clientset.PrependReactor("list", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if failing {
+			return true, nil, fmt.Errorf("unavailable")
+		}
+		return false, nil, nil
+	})
+	migration := NewLegacyMigration(c, sink, logf.Log)
+	store := NewRuleStore(sink, logf.Log)
+	store.Debounce = 10 * time.Millisecond
+	store.Ready = migration.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go store.Start(ctx)
+
+	if err := migration.Start(ctx); err == nil {
+		t.Fatal("expected the failed migration to be reported")
+	}
+	timeout, cancelTimeout := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancelTimeout()
+	if _, err := store.Apply(timeout, "fake", RuleName(lokiRule), testGroups("nginx")); err != context.DeadlineExceeded {
+		t.Fatalf("expected the store to wait for the migration, got %v", err)
+	}
+
+	failing = false
+	if err := migration.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Apply(ctx, "fake", RuleName(lokiRule), testGroups("nginx")); err != nil {
+		t.Fatal(err)
+	}
+	cm, err := clientset.CoreV1().ConfigMaps("loki").Get(ctx, "loki-rules", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cm.Data["lokirule__prod__nginx.yaml"]; !ok || len(cm.Data) != 1 {
+		t.Fatalf("expected only the rules file under the new name, got %v", cm.Data)
+	}
+}
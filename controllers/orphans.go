@@ -0,0 +1,186 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+)
+
+// RuleFileSink is a RuleSink that stores the rules as files
+type RuleFileSink interface {
+	RuleSink
+	// ListFiles returns all the rules files of all tenants
+	ListFiles(ctx context.Context) ([]RuleFile, error)
+}
+
+// OrphanSweeper removes the rules files from the ConfigMaps of the sink that don't belong
+// to a LokiRule or GlobalLokiRule, e.g. of rules deleted while the operator was down.
+// It sweeps on startup and then every Interval.
+type OrphanSweeper struct {
+	Client client.Reader
+	Sink   RuleFileSink
+	// Scope of the operator, the rules of LokiRules and GlobalLokiRules out of scope are orphaned
+	Scope    *RuleScope
+	Interval time.Duration
+	// DryRun only logs and counts the orphaned files, without removing them
+	DryRun bool
+	Log    logr.Logger
+}
+
+var _ manager.Runnable = &OrphanSweeper{}
+var _ manager.LeaderElectionRunnable = &OrphanSweeper{}
+
+// Start implements manager.Runnable
+func (s *OrphanSweeper) Start(ctx context.Context) error {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := s.Sweep(ctx); err != nil {
+			s.Log.Error(err, "unable to sweep orphaned rules files")
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable
+func (s *OrphanSweeper) NeedLeaderElection() bool {
+	return true
+}
+
+// Sweep removes the orphaned rules files and returns them.
+// The files are listed before the owners, so the file of a rule created in between is never
+// seen without its owner.
+func (s *OrphanSweeper) Sweep(ctx context.Context) ([]RuleFile, error) {
+	files, err := s.Sink.ListFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	owners, err := s.owners(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []RuleFile
+	for _, file := range files {
+		if !strings.HasSuffix(file.Key, ".yml") && !strings.HasSuffix(file.Key, ".yaml") {
+			continue
+		}
+		if owners.owns(file) {
+			continue
+		}
+		orphans = append(orphans, file)
+	}
+	orphanedRuleFiles.Set(float64(len(orphans)))
+
+	for _, orphan := range orphans {
+		log := s.Log.WithValues("configmap", orphan.ConfigMap, "key", orphan.Key, "tenant", orphan.Tenant)
+		if s.DryRun {
+			log.Info("found orphaned rules file")
+			continue
+		}
+		log.Info("removing orphaned rules file")
+		if err := s.Sink.DeleteLocation(ctx, orphan.Tenant, RuleLocation{ConfigMap: orphan.ConfigMap, Key: orphan.Key}); err != nil {
+			return orphans, err
+		}
+		orphanedRuleFilesRemoved.Inc()
+	}
+	return orphans, nil
+}
+
+// ruleOwners are the tenants of the rules of the LokiRules and GlobalLokiRules, by the key of their
+// rules file in the status and by object. The tenant of rules that were never synced is empty,
+// which matches every tenant.
+type ruleOwners struct {
+	keys map[string]map[string]bool
+	refs map[RuleRef]map[string]bool
+}
+
+// owns returns whether the rules file belongs to a LokiRule or GlobalLokiRule. Files are matched by
+// the key in the status of the rule, which could be of the legacy naming scheme, and by parsing the key.
+func (o *ruleOwners) owns(file RuleFile) bool {
+	tenants := o.keys[file.Key]
+	if tenants[""] || tenants[file.Tenant] {
+		return true
+	}
+	if ref, ok := ParseRuleName(file.Key); ok {
+		tenants = o.refs[ref]
+		return tenants[""] || tenants[file.Tenant]
+	}
+	return false
+}
+
+func (o *ruleOwners) add(ref RuleRef, key string, tenant string) {
+	if o.refs[ref] == nil {
+		o.refs[ref] = make(map[string]bool)
+	}
+	o.refs[ref][tenant] = true
+	if key == "" {
+		return
+	}
+	if o.keys[key] == nil {
+		o.keys[key] = make(map[string]bool)
+	}
+	o.keys[key][tenant] = true
+}
+
+// owners returns the owners of the rules files of all LokiRules and GlobalLokiRules in scope
+func (s *OrphanSweeper) owners(ctx context.Context) (*ruleOwners, error) {
+	owners := &ruleOwners{keys: make(map[string]map[string]bool), refs: make(map[RuleRef]map[string]bool)}
+
+	lokiRules := &loggingv1beta1.LokiRuleList{}
+	if err := s.Client.List(ctx, lokiRules); err != nil {
+		return nil, err
+	}
+	for i := range lokiRules.Items {
+		lokiRule := &lokiRules.Items[i]
+		if inScope, err := s.Scope.Contains(ctx, lokiRule); err != nil {
+			return nil, err
+		} else if !inScope {
+			continue
+		}
+		ref := RuleRef{Kind: "LokiRule", Namespace: lokiRule.Namespace, Name: lokiRule.Name}
+		owners.add(ref, lokiRule.Status.Key, lokiRule.Status.Tenant)
+	}
+
+	globalLokiRules := &loggingv1beta1.GlobalLokiRuleList{}
+	if err := s.Client.List(ctx, globalLokiRules); err != nil {
+		return nil, err
+	}
+	for i := range globalLokiRules.Items {
+		globalLokiRule := &globalLokiRules.Items[i]
+		if inScope, err := s.Scope.Contains(ctx, globalLokiRule); err != nil {
+			return nil, err
+		} else if !inScope {
+			continue
+		}
+		ref := RuleRef{Kind: "GlobalLokiRule", Name: globalLokiRule.Name}
+		owners.add(ref, globalLokiRule.Status.Key, globalLokiRule.Status.Tenant)
+	}
+	return owners, nil
+}
@@ -0,0 +1,153 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+)
+
+func rulesConfigMap(name string, tenant string, keys ...string) *v1.ConfigMap {
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "loki",
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": "loki-rule-operator"},
+		},
+		Data: make(map[string]string),
+	}
+	if tenant != "" {
+		cm.Labels[TenantKey] = tenant
+	}
+	for _, key := range keys {
+		cm.Data[key] = "groups: []\n"
+	}
+	return cm
+}
+
+func TestOrphanSweeper(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := loggingv1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	lokiRule := &loggingv1beta1.LokiRule{}
+	lokiRule.Name, lokiRule.Namespace = "nginx", "prod"
+	// Stored under the legacy name, which is kept until the rule is synced again
+	lokiRule.Status.Tenant, lokiRule.Status.Key = "fake", "prod-nginx.yml"
+	movedRule := &loggingv1beta1.LokiRule{}
+	movedRule.Name, movedRule.Namespace = "api", "prod"
+	movedRule.Status.Tenant = "team-a"
+	globalLokiRule := &loggingv1beta1.GlobalLokiRule{}
+	globalLokiRule.Name = "nodes"
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(lokiRule, movedRule, globalLokiRule).Build()
+
+	clientset := k8sfake.NewSimpleClientset(
+		rulesConfigMap("loki-rules", "", "prod-nginx.yml", "lokirule__prod__api.yaml", "globallokirule__nodes.yaml", "lokirule__prod__deleted.yaml"),
+		rulesConfigMap("loki-rules.1", "", "old-naming.yml"),
+		rulesConfigMap("loki-rules-team-a", "team-a", "lokirule__prod__api.yaml"),
+	)
+	sink := &ConfigMapSink{Clientset: clientset, Name: "loki-rules", Namespace: "loki", DefaultTenant: "fake", MaxSize: DefaultConfigMapMaxSize, MaxShards: 2}
+
+	sweeper := &OrphanSweeper{Client: c, Sink: sink, DryRun: true, Log: logf.Log}
+	orphans, err := sweeper.Sweep(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []RuleFile{
+		{Tenant: "fake", ConfigMap: "loki-rules", Key: "lokirule__prod__api.yaml"},
+		{Tenant: "fake", ConfigMap: "loki-rules", Key: "lokirule__prod__deleted.yaml"},
+		{Tenant: "fake", ConfigMap: "loki-rules.1", Key: "old-naming.yml"},
+	}
+	if len(orphans) != len(expected) {
+		t.Fatalf("expected orphans %v, got %v", expected, orphans)
+	}
+	for i := range expected {
+		if orphans[i] != expected[i] {
+			t.Fatalf("expected orphans %v, got %v", expected, orphans)
+		}
+	}
+
+	// A dry run doesn't remove anything
+	files, err := sink.ListFiles(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 6 {
+		t.Fatalf("expected 6 files after a dry run, got %v", files)
+	}
+
+	sweeper.DryRun = false
+	if _, err := sweeper.Sweep(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	files, err = sink.ListFiles(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("expected 3 files after the sweep, got %v", files)
+	}
+	if _, err := clientset.CoreV1().ConfigMaps("loki").Get(context.Background(), "loki-rules.1", metav1.GetOptions{}); err == nil {
+		t.Fatal("expected the empty shard to be removed")
+	}
+}
+
+// syncingReader stores the rules of a new LokiRule right after the LokiRules were listed
+type syncingReader struct {
+	client.Reader
+	sync func()
+}
+
+func (r *syncingReader) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	err := r.Reader.List(ctx, list, opts...)
+	if _, ok := list.(*loggingv1beta1.LokiRuleList); ok && r.sync != nil {
+		r.sync()
+		r.sync = nil
+	}
+	return err
+}
+
+// The file of a rule created while sweeping is not removed
+func TestOrphanSweeperNewRule(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := loggingv1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).Build()
+	clientset := k8sfake.NewSimpleClientset(rulesConfigMap("loki-rules", ""))
+	sink := &ConfigMapSink{Clientset: clientset, Name: "loki-rules", Namespace: "loki", DefaultTenant: "fake", MaxSize: DefaultConfigMapMaxSize, MaxShards: 1}
+	ctx := context.Background()
+
+	reader := &syncingReader{Reader: c, sync: func() {
+		lokiRule := &loggingv1beta1.LokiRule{}
+		lokiRule.Name, lokiRule.Namespace = "nginx", "prod"
+		if err := c.Create(ctx, lokiRule); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sink.Apply(ctx, "fake", LokiRuleName("prod", "nginx"), testGroups("nginx")); err != nil {
+			t.Fatal(err)
+		}
+	}}
+	sweeper := &OrphanSweeper{Client: reader, Sink: sink, Log: logf.Log}
+	if orphans, err := sweeper.Sweep(ctx); err != nil {
+		t.Fatal(err)
+	} else if len(orphans) != 0 {
+		t.Fatalf("expected no orphans, got %v", orphans)
+	}
+	files, err := sink.ListFiles(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected the file of the new rule to be kept, got %v", files)
+	}
+}
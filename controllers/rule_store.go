@@ -0,0 +1,205 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+)
+
+// DefaultRuleStoreDebounce is how long the RuleStore collects changes before writing them
+const DefaultRuleStoreDebounce = time.Second
+
+// DefaultRuleStoreMaxBatch is the maximum number of changes the RuleStore writes at once
+const DefaultRuleStoreMaxBatch = 500
+
+var errRuleStoreStopped = errors.New("rule store is stopped")
+
+// RuleStore is the single writer of the rules ConfigMaps, which both the LokiRule and
+// GlobalLokiRule controllers submit their changes to.
+//
+// Changes are collected for Debounce after the first one (or until there are MaxBatch),
+// after which every changed ConfigMap is written once. Apply and Delete block until the
+// change is written, so the controllers can report the result in the status.
+type RuleStore struct {
+	*ConfigMapSink
+	Debounce time.Duration
+	MaxBatch int
+	// Ready delays the writes until it's closed, e.g. until the LegacyMigration is done. Nil doesn't delay.
+	Ready <-chan struct{}
+	Log   logr.Logger
+
+	changes chan *fileChange
+	stopped chan struct{}
+}
+
+var _ RuleSink = &RuleStore{}
+var _ manager.Runnable = &RuleStore{}
+var _ manager.LeaderElectionRunnable = &RuleStore{}
+
+// NewRuleStore returns a RuleStore that writes to the ConfigMaps of the sink
+func NewRuleStore(sink *ConfigMapSink, log logr.Logger) *RuleStore {
+	return &RuleStore{
+		ConfigMapSink: sink,
+		Debounce:      DefaultRuleStoreDebounce,
+		MaxBatch:      DefaultRuleStoreMaxBatch,
+		Log:           log,
+		changes:       make(chan *fileChange),
+		stopped:       make(chan struct{}),
+	}
+}
+
+// Apply implements RuleSink
+func (s *RuleStore) Apply(ctx context.Context, tenant string, name string, groups []*loggingv1beta1.LokiRuleGroup) (RuleLocation, error) {
+	change, err := s.applyChange(tenant, name, groups)
+	if err != nil {
+		return RuleLocation{}, err
+	}
+	if err := s.submit(ctx, change); err != nil {
+		return RuleLocation{}, err
+	}
+	return change.location, change.err
+}
+
+// Delete implements RuleSink
+func (s *RuleStore) Delete(ctx context.Context, tenant string, name string) error {
+	change := s.deleteChange(tenant, name)
+	if err := s.submit(ctx, change); err != nil {
+		return err
+	}
+	return change.err
+}
+
+// DeleteLocation implements RuleSink
+func (s *RuleStore) DeleteLocation(ctx context.Context, tenant string, location RuleLocation) error {
+	change := s.deleteLocationChange(tenant, location)
+	if change == nil {
+		return nil
+	}
+	if err := s.submit(ctx, change); err != nil {
+		return err
+	}
+	return change.err
+}
+
+// DeleteAll removes the rules stored under the names from all tenants,
+// the deletions are queued together so they are written in the same batch
+func (s *RuleStore) DeleteAll(ctx context.Context, names []string) error {
+	changes := s.deleteAllChanges(names)
+	if err := s.submit(ctx, changes...); err != nil {
+		return err
+	}
+	if failed := failedChanges(changes); len(failed) > 0 {
+		return failed[0].err
+	}
+	return nil
+}
+
+// submit queues the changes and waits until they are written
+func (s *RuleStore) submit(ctx context.Context, changes ...*fileChange) error {
+	for _, change := range changes {
+		select {
+		case s.changes <- change:
+		case <-s.stopped:
+			return errRuleStoreStopped
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	for _, change := range changes {
+		select {
+		case <-change.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Start implements manager.Runnable
+func (s *RuleStore) Start(ctx context.Context) error {
+	defer close(s.stopped)
+	if s.Ready != nil {
+		select {
+		case <-s.Ready:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	for {
+		var batch []*fileChange
+		select {
+		case change := <-s.changes:
+			batch = append(batch, change)
+		case <-ctx.Done():
+			return nil
+		}
+
+		timer := time.NewTimer(s.Debounce)
+	collect:
+		for len(batch) < s.MaxBatch {
+			select {
+			case change := <-s.changes:
+				batch = append(batch, change)
+			case <-timer.C:
+				break collect
+			case <-ctx.Done():
+				timer.Stop()
+				s.finish(batch, ctx.Err())
+				return nil
+			}
+		}
+		timer.Stop()
+
+		s.write(ctx, batch)
+		if failed := failedChanges(batch); len(failed) > 0 {
+			s.Log.Error(failed[0].err, "unable to write rules", "changes", len(batch), "failed", len(failed))
+		}
+		s.finish(batch, nil)
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable
+func (s *RuleStore) NeedLeaderElection() bool {
+	return true
+}
+
+// finish reports the result of every change to its submitter, err fails all the changes
+func (s *RuleStore) finish(batch []*fileChange, err error) {
+	for _, change := range batch {
+		if err != nil {
+			change.err = err
+		}
+		close(change.done)
+	}
+}
+
+func failedChanges(batch []*fileChange) []*fileChange {
+	var failed []*fileChange
+	for _, change := range batch {
+		if change.err != nil {
+			failed = append(failed, change)
+		}
+	}
+	return failed
+}
@@ -0,0 +1,201 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+)
+
+func testGroups(name string) []*loggingv1beta1.LokiRuleGroup {
+	return []*loggingv1beta1.LokiRuleGroup{{
+		Name:  name,
+		Rules: []*loggingv1beta1.LokiGroupRule{{Alert: "Errors", Expr: `count_over_time({app="api"}[5m]) > 0`}},
+	}}
+}
+
+// countWrites counts the create, update and delete calls on ConfigMaps
+func countWrites(clientset *k8sfake.Clientset) *int {
+	var mu sync.Mutex
+	writes := 0
+	for _, verb := range []string{"create", "update", "delete"} {
+		clientset.PrependReactor(verb, "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			mu.Lock()
+			writes++
+			mu.Unlock()
+			return false, nil, nil
+		})
+	}
+	return &writes
+}
+
+func TestRuleStoreBatchesChanges(t *testing.T) {
+	clientset := k8sfake.NewSimpleClientset(rulesConfigMap("loki-rules", ""))
+	writes := countWrites(clientset)
+	sink := &ConfigMapSink{Clientset: clientset, Name: "loki-rules", Namespace: "loki", DefaultTenant: "fake", MaxSize: DefaultConfigMapMaxSize, MaxShards: 1}
+	store := NewRuleStore(sink, logf.Log)
+	store.Debounce = 100 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go store.Start(ctx)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 200)
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("prod-rule-%d", i)
+			location, err := store.Apply(ctx, "fake", name, testGroups(name))
+			if err != nil {
+				errs <- err
+			} else if location.ConfigMap != "loki-rules" || location.Key != name+".yaml" {
+				errs <- fmt.Errorf("unexpected location %v", location)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	cm, err := clientset.CoreV1().ConfigMaps("loki").Get(ctx, "loki-rules", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cm.Data) != 200 {
+		t.Fatalf("expected 200 files, got %d", len(cm.Data))
+	}
+	if *writes > 5 {
+		t.Fatalf("expected the changes to be written in a few batches, got %d writes", *writes)
+	}
+}
+
+// The deletions of DeleteAll are written by the store, in a single batch
+func TestRuleStoreDeleteAll(t *testing.T) {
+	clientset := k8sfake.NewSimpleClientset(
+		rulesConfigMap("loki-rules", "", "prod-a.yaml", "prod-b.yaml", "prod-c.yaml"),
+		rulesConfigMap("loki-rules-team-a", "team-a", "prod-a.yaml", "prod-c.yaml"),
+	)
+	sink := &ConfigMapSink{Clientset: clientset, Name: "loki-rules", Namespace: "loki", DefaultTenant: "fake", MaxSize: DefaultConfigMapMaxSize, MaxShards: 1}
+	store := NewRuleStore(sink, logf.Log)
+	store.Debounce = time.Minute
+	store.MaxBatch = 2
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := store.DeleteAll(ctx, []string{"prod-a", "prod-b"}); err != context.DeadlineExceeded {
+		t.Fatalf("expected the deletions to wait for the store, got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go store.Start(ctx)
+	writes := countWrites(clientset)
+	if err := store.DeleteAll(ctx, []string{"prod-a", "prod-b"}); err != nil {
+		t.Fatal(err)
+	}
+	if *writes != 2 {
+		t.Fatalf("expected a single write per ConfigMap, got %d writes", *writes)
+	}
+	for name, expected := range map[string]string{"loki-rules": "prod-c.yaml", "loki-rules-team-a": "prod-c.yaml"} {
+		cm, err := clientset.CoreV1().ConfigMaps("loki").Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := cm.Data[expected]; !ok || len(cm.Data) != 1 {
+			t.Fatalf("expected only %s to be left in %s, got %v", expected, name, cm.Data)
+		}
+	}
+}
+
+func TestConfigMapSinkRetriesOnConflict(t *testing.T) {
+	clientset := k8sfake.NewSimpleClientset(rulesConfigMap("loki-rules", "", "prod-other.yml"))
+	conflicts := 0
+	clientset.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicts > 0 {
+			return false, nil, nil
+		}
+		conflicts++
+		// Someone else changed the ConfigMap in the meantime
+		cm := action.(k8stesting.UpdateAction).GetObject().(*v1.ConfigMap).DeepCopy()
+		cm.Data = map[string]string{"prod-other.yml": "groups: []\n", "prod-new.yml": "groups: []\n"}
+		if err := clientset.Tracker().Update(schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}, cm, "loki"); err != nil {
+			return true, nil, err
+		}
+		return true, nil, errors.NewConflict(schema.GroupResource{Resource: "configmaps"}, cm.Name, fmt.Errorf("the object has been modified"))
+	})
+	sink := &ConfigMapSink{Clientset: clientset, Name: "loki-rules", Namespace: "loki", DefaultTenant: "fake", MaxSize: DefaultConfigMapMaxSize, MaxShards: 1}
+
+	if _, err := sink.Apply(context.Background(), "fake", "prod-nginx", testGroups("nginx")); err != nil {
+		t.Fatal(err)
+	}
+	cm, err := clientset.CoreV1().ConfigMaps("loki").Get(context.Background(), "loki-rules", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"prod-other.yml", "prod-new.yml", "prod-nginx.yaml"} {
+		if _, ok := cm.Data[key]; !ok {
+			t.Fatalf("expected %s to be kept after the retry, got %v", key, cm.Data)
+		}
+	}
+}
+
+// A tenant whose ConfigMap is managed by someone else only fails its own changes
+func TestRuleStoreTenantErrors(t *testing.T) {
+	foreign := rulesConfigMap("loki-rules-team-b", "team-b")
+	delete(foreign.Labels, "app.kubernetes.io/managed-by")
+	clientset := k8sfake.NewSimpleClientset(rulesConfigMap("loki-rules", ""), foreign)
+	sink := &ConfigMapSink{Clientset: clientset, Name: "loki-rules", Namespace: "loki", DefaultTenant: "fake", MaxSize: DefaultConfigMapMaxSize, MaxShards: 1}
+	store := NewRuleStore(sink, logf.Log)
+	// Both changes end up in the same batch
+	store.Debounce = time.Minute
+	store.MaxBatch = 2
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go store.Start(ctx)
+
+	errs := make(map[string]error)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, tenant := range []string{"team-a", "team-b"} {
+		wg.Add(1)
+		go func(tenant string) {
+			defer wg.Done()
+			_, err := store.Apply(ctx, tenant, "prod-nginx", testGroups("nginx"))
+			mu.Lock()
+			errs[tenant] = err
+			mu.Unlock()
+		}(tenant)
+	}
+	wg.Wait()
+
+	if errs["team-a"] != nil {
+		t.Fatalf("expected the rules of team-a to be written, got %v", errs["team-a"])
+	}
+	if !IsConfigMapConflict(errs["team-b"]) {
+		t.Fatalf("expected a conflict for team-b, got %v", errs["team-b"])
+	}
+	cm, err := clientset.CoreV1().ConfigMaps("loki").Get(ctx, "loki-rules-team-a", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cm.Data["prod-nginx.yaml"]; !ok {
+		t.Fatalf("expected the rules file of team-a, got %v", cm.Data)
+	}
+}
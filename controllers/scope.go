@@ -0,0 +1,106 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// RuleScope selects the LokiRules and GlobalLokiRules managed by this instance of the operator,
+// so multiple instances can each manage the rules of their own Loki cluster or team.
+// A nil RuleScope selects all the rules.
+type RuleScope struct {
+	Client client.Reader
+	// Namespaces restricts the LokiRules to these namespaces, all namespaces when empty
+	Namespaces []string
+	// NamespaceSelector restricts the LokiRules to the namespaces with matching labels
+	NamespaceSelector labels.Selector
+	// RuleSelector restricts the LokiRules and GlobalLokiRules to the ones with matching labels
+	RuleSelector labels.Selector
+	// Instance names this instance of the operator in its finalizer, see InstanceFinalizer
+	Instance string
+}
+
+// Contains returns true if the rule is managed by this instance of the operator.
+// The namespace restrictions don't apply to GlobalLokiRules.
+func (s *RuleScope) Contains(ctx context.Context, obj client.Object) (bool, error) {
+	if s == nil {
+		return true, nil
+	}
+	if !s.matchesRuleSelector(obj) {
+		return false, nil
+	}
+	namespace := obj.GetNamespace()
+	if namespace == "" {
+		return true, nil
+	}
+	if len(s.Namespaces) > 0 && !containsString(s.Namespaces, namespace) {
+		return false, nil
+	}
+	if s.NamespaceSelector == nil || s.NamespaceSelector.Empty() {
+		return true, nil
+	}
+	ns := &v1.Namespace{}
+	if err := s.Client.Get(ctx, types.NamespacedName{Name: namespace}, ns); err != nil {
+		return false, err
+	}
+	return s.NamespaceSelector.Matches(labels.Set(ns.Labels)), nil
+}
+
+func (s *RuleScope) matchesRuleSelector(obj client.Object) bool {
+	return s.RuleSelector == nil || s.RuleSelector.Matches(labels.Set(obj.GetLabels()))
+}
+
+// Finalizer returns the finalizer this instance of the operator adds to the rules it manages
+func (s *RuleScope) Finalizer() string {
+	if s == nil {
+		return Finalizer
+	}
+	return InstanceFinalizer(s.Instance)
+}
+
+// Predicate filters the events of rules that are out of scope. Rules that still have the finalizer
+// of this instance pass, so the rules that went out of scope are removed.
+func (s *RuleScope) Predicate() predicate.Predicate {
+	if s == nil {
+		return predicate.Funcs{}
+	}
+	return predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		if controllerutil.ContainsFinalizer(obj, s.Finalizer()) {
+			return true
+		}
+		inScope, err := s.Contains(context.Background(), obj)
+		// The reconciler reports the error
+		return inScope || err != nil
+	})
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
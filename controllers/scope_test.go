@@ -0,0 +1,209 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+)
+
+func TestRuleScope(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	prod := &v1.Namespace{}
+	prod.Name, prod.Labels = "prod", map[string]string{"loki": "main"}
+	dev := &v1.Namespace{}
+	dev.Name = "dev"
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(prod, dev).Build()
+
+	lokiRule := func(namespace string, ruleLabels map[string]string) *loggingv1beta1.LokiRule {
+		lokiRule := &loggingv1beta1.LokiRule{}
+		lokiRule.Name, lokiRule.Namespace, lokiRule.Labels = "nginx", namespace, ruleLabels
+		return lokiRule
+	}
+	globalLokiRule := &loggingv1beta1.GlobalLokiRule{}
+	globalLokiRule.Name, globalLokiRule.Labels = "nodes", map[string]string{"team": "ops"}
+
+	tests := []struct {
+		name     string
+		scope    *RuleScope
+		rule     client.Object
+		expected bool
+	}{
+		{"nil scope", nil, lokiRule("dev", nil), true},
+		{"watched namespace", &RuleScope{Namespaces: []string{"prod"}}, lokiRule("prod", nil), true},
+		{"unwatched namespace", &RuleScope{Namespaces: []string{"prod"}}, lokiRule("dev", nil), false},
+		{"selected namespace", &RuleScope{NamespaceSelector: labels.SelectorFromSet(labels.Set{"loki": "main"})}, lokiRule("prod", nil), true},
+		{"unselected namespace", &RuleScope{NamespaceSelector: labels.SelectorFromSet(labels.Set{"loki": "main"})}, lokiRule("dev", nil), false},
+		{"selected rule", &RuleScope{RuleSelector: labels.SelectorFromSet(labels.Set{"team": "ops"})}, lokiRule("dev", map[string]string{"team": "ops"}), true},
+		{"unselected rule", &RuleScope{RuleSelector: labels.SelectorFromSet(labels.Set{"team": "ops"})}, lokiRule("dev", nil), false},
+		{"global rule ignores namespaces", &RuleScope{Namespaces: []string{"prod"}, RuleSelector: labels.SelectorFromSet(labels.Set{"team": "ops"})}, globalLokiRule, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.scope != nil {
+				test.scope.Client = c
+			}
+			inScope, err := test.scope.Contains(context.Background(), test.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if inScope != test.expected {
+				t.Fatalf("expected %v, got %v", test.expected, inScope)
+			}
+		})
+	}
+}
+
+func TestRuleScopePredicate(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	prod := &v1.Namespace{}
+	prod.Name, prod.Labels = "prod", map[string]string{"loki": "main"}
+	dev := &v1.Namespace{}
+	dev.Name = "dev"
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(prod, dev).Build()
+	scope := &RuleScope{
+		Client:            c,
+		NamespaceSelector: labels.SelectorFromSet(labels.Set{"loki": "main"}),
+		RuleSelector:      labels.SelectorFromSet(labels.Set{"team": "ops"}),
+		Instance:          "main",
+	}
+	selected := &loggingv1beta1.LokiRule{}
+	selected.Namespace, selected.Labels = "prod", map[string]string{"team": "ops"}
+	unselected := &loggingv1beta1.LokiRule{}
+	unselected.Namespace = "prod"
+	unselectedNamespace := selected.DeepCopy()
+	unselectedNamespace.Namespace = "dev"
+	wentOutOfScope := unselected.DeepCopy()
+	wentOutOfScope.Finalizers = []string{"logging.opsgy.com/finalizer-main"}
+	otherInstance := unselected.DeepCopy()
+	otherInstance.Finalizers = []string{Finalizer}
+
+	p := scope.Predicate()
+	if !p.Create(event.CreateEvent{Object: selected}) || p.Create(event.CreateEvent{Object: unselected}) {
+		t.Fatal("expected only creates of selected rules to pass")
+	}
+	if p.Create(event.CreateEvent{Object: unselectedNamespace}) {
+		t.Fatal("expected creates in unselected namespaces to be filtered")
+	}
+	if !p.Update(event.UpdateEvent{ObjectOld: selected, ObjectNew: wentOutOfScope}) {
+		t.Fatal("expected rules going out of scope to pass while they have the finalizer of the instance")
+	}
+	if p.Update(event.UpdateEvent{ObjectOld: unselected, ObjectNew: unselected}) {
+		t.Fatal("expected updates of unselected rules to be filtered")
+	}
+	if p.Update(event.UpdateEvent{ObjectOld: otherInstance, ObjectNew: otherInstance}) {
+		t.Fatal("expected updates of rules of other instances to be filtered")
+	}
+}
+
+// Two instances selecting different rules leave each other's rules and finalizers alone
+func TestRuleScopeInstances(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := loggingv1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	prod := &v1.Namespace{}
+	prod.Name = "prod"
+	lokiRule := &loggingv1beta1.LokiRule{
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "prod", Labels: map[string]string{"loki": "a"}},
+		Spec: loggingv1beta1.LokiRuleSpec{Groups: []*loggingv1beta1.LokiRuleGroup{{
+			Name:  "nginx",
+			Rules: []*loggingv1beta1.LokiGroupRule{{Alert: "NginxErrors", Expr: `count_over_time({app="nginx"}[5m]) > 0`}},
+		}}},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(prod, lokiRule).Build()
+	clientset := k8sfake.NewSimpleClientset(rulesConfigMap("loki-rules-a", ""), rulesConfigMap("loki-rules-b", ""))
+	reconciler := func(instance string) *LokiRuleReconciler {
+		return &LokiRuleReconciler{
+			Client:   c,
+			Log:      logf.Log,
+			Scheme:   scheme,
+			Sink:     &ConfigMapSink{Clientset: clientset, Name: "loki-rules-" + instance, Namespace: "loki", DefaultTenant: "fake", MaxSize: DefaultConfigMapMaxSize, MaxShards: 1},
+			Tenants:  &TenantResolver{Client: c, DefaultTenant: "fake"},
+			Recorder: &record.FakeRecorder{},
+			Scope:    &RuleScope{Client: c, RuleSelector: labels.SelectorFromSet(labels.Set{"loki": instance}), Instance: instance},
+		}
+	}
+	a, b := reconciler("a"), reconciler("b")
+	ctx := context.Background()
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(lokiRule)}
+
+	for _, r := range []*LokiRuleReconciler{a, b, a, b} {
+		if _, err := r.Reconcile(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := &loggingv1beta1.LokiRule{}
+	if err := c.Get(ctx, req.NamespacedName, got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Finalizers) != 1 || got.Finalizers[0] != "logging.opsgy.com/finalizer-a" {
+		t.Fatalf("expected only the finalizer of instance a, got %v", got.Finalizers)
+	}
+	cm, err := clientset.CoreV1().ConfigMaps("loki").Get(ctx, "loki-rules-a", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cm.Data) != 1 {
+		t.Fatalf("expected the rules to be kept by instance a, got %v", cm.Data)
+	}
+
+	// Moving the rule to instance b removes it from instance a
+	got.Labels["loki"] = "b"
+	if err := c.Update(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []*LokiRuleReconciler{a, b} {
+		if _, err := r.Reconcile(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Get(ctx, req.NamespacedName, got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Finalizers) != 1 || got.Finalizers[0] != "logging.opsgy.com/finalizer-b" {
+		t.Fatalf("expected only the finalizer of instance b, got %v", got.Finalizers)
+	}
+	for name, files := range map[string]int{"loki-rules-a": 0, "loki-rules-b": 1} {
+		cm, err := clientset.CoreV1().ConfigMaps("loki").Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cm.Data) != files {
+			t.Fatalf("expected %d files in %s, got %v", files, name, cm.Data)
+		}
+	}
+}
+
+func TestValidateInstance(t *testing.T) {
+	if err := ValidateInstance("main"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateInstance("Main Loki"); err == nil {
+		t.Fatal("expected an invalid instance")
+	}
+}
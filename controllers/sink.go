@@ -0,0 +1,118 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+	"github.com/opsgy/loki-rule-operator/pkg/ruler"
+)
+
+// RuleSink stores the rendered rule groups of a LokiRule or GlobalLokiRule
+type RuleSink interface {
+	// Apply stores the rule groups of the tenant under the given name, replacing the previous groups.
+	// It returns where the rules are stored.
+	Apply(ctx context.Context, tenant string, name string, groups []*loggingv1beta1.LokiRuleGroup) (RuleLocation, error)
+	// Delete removes all the rule groups of the tenant stored under the given name.
+	// When the tenant is empty, the rule groups are removed from all tenants known to the sink.
+	Delete(ctx context.Context, tenant string, name string) error
+	// DeleteLocation removes the rules of the tenant stored at a location returned by Apply,
+	// which could be different from where Apply currently stores them.
+	DeleteLocation(ctx context.Context, tenant string, location RuleLocation) error
+}
+
+// RuleLocation is where a sink stored the rules of a LokiRule or GlobalLokiRule
+type RuleLocation struct {
+	// ConfigMap (shard) the rules are stored in, empty if the sink doesn't use ConfigMaps
+	ConfigMap string
+	// Key of the rules file in the ConfigMap, or the rule namespace in the Loki ruler
+	Key string
+}
+
+// renderRules returns the rule groups in the format of a Loki rules file
+func renderRules(groups []*loggingv1beta1.LokiRuleGroup) ([]byte, error) {
+	return yaml.Marshal(&loggingv1beta1.LokiRuleSpec{Groups: groups})
+}
+
+// hashRules returns the SHA-256 hash of the rendered rule groups
+func hashRules(groups []*loggingv1beta1.LokiRuleGroup) (string, error) {
+	data, err := renderRules(groups)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// RulerSink stores the rule groups directly in the Loki ruler through its rules API.
+// Every LokiRule gets its own rule namespace in the ruler.
+type RulerSink struct {
+	Client        *ruler.Client
+	DefaultTenant string
+
+	mu      sync.Mutex
+	tenants map[string]bool
+}
+
+var _ RuleSink = &RulerSink{}
+
+// Apply implements RuleSink
+func (s *RulerSink) Apply(ctx context.Context, tenant string, name string, groups []*loggingv1beta1.LokiRuleGroup) (RuleLocation, error) {
+	s.mu.Lock()
+	if s.tenants == nil {
+		s.tenants = make(map[string]bool)
+	}
+	s.tenants[tenant] = true
+	s.mu.Unlock()
+
+	return RuleLocation{Key: name}, s.Client.WithTenant(tenant).Sync(ctx, name, groups)
+}
+
+// Delete implements RuleSink.
+// The ruler API can't list tenants, so with an empty tenant the rule groups are
+// removed from the default tenant and the tenants written to since startup.
+func (s *RulerSink) Delete(ctx context.Context, tenant string, name string) error {
+	tenants := []string{tenant}
+	if tenant == "" {
+		tenants = []string{s.DefaultTenant}
+		s.mu.Lock()
+		for t := range s.tenants {
+			if t != s.DefaultTenant {
+				tenants = append(tenants, t)
+			}
+		}
+		s.mu.Unlock()
+	}
+
+	for _, t := range tenants {
+		if err := s.Client.WithTenant(t).Sync(ctx, name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteLocation implements RuleSink
+func (s *RulerSink) DeleteLocation(ctx context.Context, tenant string, location RuleLocation) error {
+	return s.Client.WithTenant(tenant).Sync(ctx, location.Key, nil)
+}
@@ -0,0 +1,538 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+	"github.com/opsgy/loki-rule-operator/pkg/ruler"
+)
+
+// RuleTargets stores the rules of the LokiRules and GlobalLokiRules in the LokiRulerTargets
+// that select them, next to the sink configured by the flags of the operator.
+//
+// Every target gets its own sink, which is created when the target is first used and
+// recreated when its destination changes. ConfigMap targets get their own RuleStore.
+// The sink of the previous destination is kept until the LokiRulerTarget controller
+// removed the rules from it. A nil RuleTargets has no targets.
+type RuleTargets struct {
+	Client    client.Reader
+	Clientset kubernetes.Interface
+	Tenants   *TenantResolver
+	// Debounce of the RuleStores of the ConfigMap targets
+	Debounce time.Duration
+	Log      logr.Logger
+
+	mu sync.Mutex
+	// sinks of the current and previous destinations, by target
+	sinks   map[string][]*targetSink
+	ctx     context.Context
+	started chan struct{}
+}
+
+// ruleRenderer returns the rule groups to store in a target
+type ruleRenderer func(target *loggingv1beta1.LokiRulerTarget) ([]*loggingv1beta1.LokiRuleGroup, error)
+
+// staticRules stores the same rule groups in every target
+func staticRules(groups []*loggingv1beta1.LokiRuleGroup) ruleRenderer {
+	return func(*loggingv1beta1.LokiRulerTarget) ([]*loggingv1beta1.LokiRuleGroup, error) {
+		return groups, nil
+	}
+}
+
+type targetSink struct {
+	destination loggingv1beta1.RulerTargetDestination
+	sink        RuleSink
+	cancel      context.CancelFunc
+}
+
+var _ manager.Runnable = &RuleTargets{}
+var _ manager.LeaderElectionRunnable = &RuleTargets{}
+
+// NewRuleTargets returns the RuleTargets of the operator
+func NewRuleTargets(c client.Reader, clientset kubernetes.Interface, tenants *TenantResolver, log logr.Logger) *RuleTargets {
+	return &RuleTargets{
+		Client:    c,
+		Clientset: clientset,
+		Tenants:   tenants,
+		Debounce:  DefaultRuleStoreDebounce,
+		Log:       log,
+		sinks:     make(map[string][]*targetSink),
+		started:   make(chan struct{}),
+	}
+}
+
+// Start implements manager.Runnable. The RuleStores of the targets run until ctx is done.
+func (t *RuleTargets) Start(ctx context.Context) error {
+	t.mu.Lock()
+	t.ctx = ctx
+	close(t.started)
+	t.mu.Unlock()
+
+	<-ctx.Done()
+	return nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable
+func (t *RuleTargets) NeedLeaderElection() bool {
+	return true
+}
+
+// Sync stores the rules in the targets that select the rule, and removes them from the targets
+// that selected the rule before. It returns where the rules are stored, which includes the previous
+// location of the targets that failed. The rules in deleted and invalid targets are removed by
+// the LokiRulerTarget controller, their previous location is kept until the target is gone.
+func (t *RuleTargets) Sync(ctx context.Context, obj client.Object, name string, specTenant string, render ruleRenderer, previous []loggingv1beta1.RuleTargetStatus) ([]loggingv1beta1.RuleTargetStatus, error) {
+	if t == nil {
+		return nil, nil
+	}
+	targets := &loggingv1beta1.LokiRulerTargetList{}
+	if err := t.Client.List(ctx, targets); err != nil {
+		return previous, err
+	}
+	previousByName := make(map[string]loggingv1beta1.RuleTargetStatus, len(previous))
+	for _, status := range previous {
+		previousByName[status.Name] = status
+	}
+
+	var statuses []loggingv1beta1.RuleTargetStatus
+	var firstErr error
+	for i := range targets.Items {
+		target := &targets.Items[i]
+		old, stored := previousByName[target.Name]
+		status, selected, err := t.syncTarget(ctx, target, obj, name, specTenant, render, old, stored)
+		if err != nil {
+			t.Log.Error(err, "unable to store rules in LokiRulerTarget", "target", target.Name, "rule", name)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("LokiRulerTarget %s: %w", target.Name, err)
+			}
+			if stored {
+				statuses = append(statuses, old)
+			}
+		} else if selected {
+			statuses = append(statuses, status)
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses, firstErr
+}
+
+// syncTarget stores the rules in the target if it selects the rule, otherwise it removes
+// the rules that were stored before
+func (t *RuleTargets) syncTarget(ctx context.Context, target *loggingv1beta1.LokiRulerTarget, obj client.Object, name string, specTenant string, render ruleRenderer, old loggingv1beta1.RuleTargetStatus, stored bool) (loggingv1beta1.RuleTargetStatus, bool, error) {
+	if !target.DeletionTimestamp.IsZero() || validateTarget(target) != nil {
+		// The LokiRulerTarget controller removes the rules of deleted and invalid targets
+		return old, stored, nil
+	}
+	selected, err := t.selects(ctx, target, obj)
+	if err != nil {
+		return loggingv1beta1.RuleTargetStatus{}, false, err
+	}
+	if !selected && !stored {
+		return loggingv1beta1.RuleTargetStatus{}, false, nil
+	}
+	if !selected {
+		return loggingv1beta1.RuleTargetStatus{}, false, t.removeRules(ctx, target, name, old)
+	}
+	sink, err := t.sink(ctx, target)
+	if err != nil {
+		return loggingv1beta1.RuleTargetStatus{}, false, err
+	}
+
+	tenant, err := t.Tenants.ResolveDefault(ctx, obj.GetNamespace(), specTenant, t.defaultTenant(targetDestination(target)))
+	if err != nil {
+		return loggingv1beta1.RuleTargetStatus{}, false, err
+	}
+	if stored && old.Tenant != "" && old.Tenant != tenant {
+		// Moved to another tenant
+		if err := sink.Delete(ctx, old.Tenant, name); err != nil {
+			return loggingv1beta1.RuleTargetStatus{}, false, err
+		}
+	}
+	groups, err := render(target)
+	if err != nil {
+		return loggingv1beta1.RuleTargetStatus{}, false, err
+	}
+	location, err := sink.Apply(ctx, tenant, name, groups)
+	if err != nil {
+		return loggingv1beta1.RuleTargetStatus{}, false, err
+	}
+	if stored {
+		previous := RuleLocation{ConfigMap: old.ConfigMap, Key: old.Key}
+		if err := migrateLocation(ctx, sink, old.Tenant, previous, location); err != nil {
+			return loggingv1beta1.RuleTargetStatus{}, false, err
+		}
+	}
+	hash, err := hashRules(groups)
+	if err != nil {
+		return loggingv1beta1.RuleTargetStatus{}, false, err
+	}
+	return loggingv1beta1.RuleTargetStatus{
+		Name:      target.Name,
+		Tenant:    tenant,
+		ConfigMap: location.ConfigMap,
+		Key:       location.Key,
+		Hash:      hash,
+	}, true, nil
+}
+
+// Cleanup removes the rules from the targets they are stored in
+func (t *RuleTargets) Cleanup(ctx context.Context, name string, previous []loggingv1beta1.RuleTargetStatus) error {
+	if t == nil {
+		return nil
+	}
+	for _, status := range previous {
+		target := &loggingv1beta1.LokiRulerTarget{}
+		if err := t.Client.Get(ctx, types.NamespacedName{Name: status.Name}, target); err != nil {
+			if client.IgnoreNotFound(err) == nil {
+				continue
+			}
+			return err
+		}
+		if validateTarget(target) != nil {
+			continue
+		}
+		if err := t.removeRules(ctx, target, name, status); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeRules removes the rules from the target, including from the previous destination
+// of the target when they weren't removed from it yet
+func (t *RuleTargets) removeRules(ctx context.Context, target *loggingv1beta1.LokiRulerTarget, name string, old loggingv1beta1.RuleTargetStatus) error {
+	sink, err := t.sink(ctx, target)
+	if err != nil {
+		return err
+	}
+	location := RuleLocation{ConfigMap: old.ConfigMap, Key: old.Key}
+	if err := cleanupRules(ctx, sink, old.Tenant, name, location); err != nil {
+		return err
+	}
+	previous := previousDestination(target)
+	if previous == nil {
+		return nil
+	}
+	previousSink, err := t.destinationSink(ctx, target.Name, *previous)
+	if err != nil {
+		return err
+	}
+	return previousSink.Delete(ctx, "", name)
+}
+
+// CleanupDestination removes the rules stored in the target from a destination of the target,
+// e.g. its previous destination or the destination of a deleted target. The rules are found
+// by the targets in their status.
+func (t *RuleTargets) CleanupDestination(ctx context.Context, targetName string, destination loggingv1beta1.RulerTargetDestination) error {
+	if t == nil {
+		return nil
+	}
+	var objects []client.Object
+	lokiRules := &loggingv1beta1.LokiRuleList{}
+	if err := t.Client.List(ctx, lokiRules); err != nil {
+		return err
+	}
+	for i := range lokiRules.Items {
+		objects = append(objects, &lokiRules.Items[i])
+	}
+	globalLokiRules := &loggingv1beta1.GlobalLokiRuleList{}
+	if err := t.Client.List(ctx, globalLokiRules); err != nil {
+		return err
+	}
+	for i := range globalLokiRules.Items {
+		objects = append(objects, &globalLokiRules.Items[i])
+	}
+
+	var names []string
+	tenants := make(map[string][]string)
+	for _, obj := range objects {
+		for _, status := range ruleTargets(obj) {
+			if status.Name == targetName {
+				name := RuleName(obj)
+				names = append(names, name)
+				tenants[name] = append(tenants[name], status.Tenant)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	sink, err := t.destinationSink(ctx, targetName, destination)
+	if err != nil {
+		return err
+	}
+	if store, ok := sink.(*RuleStore); ok {
+		// All the tenants of the ConfigMaps in a single batch of the store
+		return store.DeleteAll(ctx, names)
+	}
+	for _, name := range names {
+		// The tenant in the status could already be the one of the current destination
+		for _, tenant := range append(tenants[name], "") {
+			if err := sink.Delete(ctx, tenant, name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ruleTargets returns the targets in the status of a LokiRule or GlobalLokiRule
+func ruleTargets(obj client.Object) []loggingv1beta1.RuleTargetStatus {
+	switch rule := obj.(type) {
+	case *loggingv1beta1.LokiRule:
+		return rule.Status.Targets
+	case *loggingv1beta1.GlobalLokiRule:
+		return rule.Status.Targets
+	}
+	return nil
+}
+
+// Delete removes the rules stored under the given name from all tenants of all targets,
+// for rules that were deleted without the finalizer
+func (t *RuleTargets) Delete(ctx context.Context, name string) error {
+	if t == nil {
+		return nil
+	}
+	targets := &loggingv1beta1.LokiRulerTargetList{}
+	if err := t.Client.List(ctx, targets); err != nil {
+		return err
+	}
+	for i := range targets.Items {
+		target := &targets.Items[i]
+		if validateTarget(target) != nil {
+			continue
+		}
+		sink, err := t.sink(ctx, target)
+		if err != nil {
+			return err
+		}
+		if err := sink.Delete(ctx, "", name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Release stops the sinks of the target, except for the sink of the destination to keep.
+// Without a destination to keep, all the sinks of a deleted or invalid target are stopped.
+func (t *RuleTargets) Release(name string, keep *loggingv1beta1.RulerTargetDestination) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var kept []*targetSink
+	for _, existing := range t.sinks[name] {
+		if keep != nil && reflect.DeepEqual(existing.destination, *keep) {
+			kept = append(kept, existing)
+			continue
+		}
+		existing.cancel()
+	}
+	if len(kept) == 0 {
+		delete(t.sinks, name)
+	} else {
+		t.sinks[name] = kept
+	}
+}
+
+// targetDestination returns where the target stores the rules
+func targetDestination(target *loggingv1beta1.LokiRulerTarget) loggingv1beta1.RulerTargetDestination {
+	return loggingv1beta1.RulerTargetDestination{
+		ConfigMap: target.Spec.ConfigMap,
+		Ruler:     target.Spec.Ruler,
+		Tenant:    target.Spec.Tenant,
+	}
+}
+
+// previousDestination returns the destination the target stored the rules in before its
+// destination changed, until the LokiRulerTarget controller removed the rules from it
+func previousDestination(target *loggingv1beta1.LokiRulerTarget) *loggingv1beta1.RulerTargetDestination {
+	previous := target.Status.Destination
+	if previous == nil || reflect.DeepEqual(*previous, targetDestination(target)) {
+		return nil
+	}
+	return previous
+}
+
+// sink returns the sink of the current destination of the target
+func (t *RuleTargets) sink(ctx context.Context, target *loggingv1beta1.LokiRulerTarget) (RuleSink, error) {
+	return t.destinationSink(ctx, target.Name, targetDestination(target))
+}
+
+// destinationSink returns the sink of a destination of the target, creating it when it's first used
+func (t *RuleTargets) destinationSink(ctx context.Context, name string, destination loggingv1beta1.RulerTargetDestination) (RuleSink, error) {
+	if destination.ConfigMap != nil {
+		// The RuleStore of the target runs until the operator stops or the destination changes
+		select {
+		case <-t.started:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, existing := range t.sinks[name] {
+		if reflect.DeepEqual(existing.destination, destination) {
+			return existing.sink, nil
+		}
+	}
+
+	if destination.Ruler != nil {
+		sink := &RulerSink{Client: ruler.NewClient(destination.Ruler.URL), DefaultTenant: t.defaultTenant(destination)}
+		t.sinks[name] = append(t.sinks[name], &targetSink{destination: destination, sink: sink, cancel: func() {}})
+		return sink, nil
+	}
+
+	cmSink := &ConfigMapSink{
+		Clientset:     t.Clientset,
+		Name:          destination.ConfigMap.Name,
+		Namespace:     destination.ConfigMap.Namespace,
+		DefaultTenant: t.defaultTenant(destination),
+		MaxSize:       destination.ConfigMap.MaxSize,
+		MaxShards:     destination.ConfigMap.MaxShards,
+	}
+	if cmSink.MaxSize == 0 {
+		cmSink.MaxSize = DefaultConfigMapMaxSize
+	}
+	if cmSink.MaxShards == 0 {
+		cmSink.MaxShards = DefaultConfigMapMaxShards
+	}
+	store := NewRuleStore(cmSink, t.Log.WithValues("target", name))
+	store.Debounce = t.Debounce
+	storeCtx, cancel := context.WithCancel(t.ctx)
+	go func() {
+		_ = store.Start(storeCtx)
+	}()
+	t.sinks[name] = append(t.sinks[name], &targetSink{destination: destination, sink: store, cancel: cancel})
+	return store, nil
+}
+
+func (t *RuleTargets) defaultTenant(destination loggingv1beta1.RulerTargetDestination) string {
+	if destination.Tenant != "" {
+		return destination.Tenant
+	}
+	return t.Tenants.DefaultTenant
+}
+
+// selects returns true if the target selects the rule. The namespace selector doesn't apply to GlobalLokiRules.
+func (t *RuleTargets) selects(ctx context.Context, target *loggingv1beta1.LokiRulerTarget, obj client.Object) (bool, error) {
+	ruleSelector, namespaceSelector, err := targetSelectors(target)
+	if err != nil {
+		return false, err
+	}
+	if !ruleSelector.Matches(labels.Set(obj.GetLabels())) {
+		return false, nil
+	}
+	if obj.GetNamespace() == "" || namespaceSelector.Empty() {
+		return true, nil
+	}
+	ns := &v1.Namespace{}
+	if err := t.Client.Get(ctx, types.NamespacedName{Name: obj.GetNamespace()}, ns); err != nil {
+		return false, err
+	}
+	return namespaceSelector.Matches(labels.Set(ns.Labels)), nil
+}
+
+// Enforcements returns the enforcement policies of the targets that select the rule by the name of the target,
+// for the webhook to validate the rule with them. Targets without an enforcement policy of their own are left out.
+func (t *RuleTargets) Enforcements(ctx context.Context, obj client.Object) (map[string]*loggingv1beta1.EnforcementPolicy, error) {
+	if t == nil {
+		return nil, nil
+	}
+	targets := &loggingv1beta1.LokiRulerTargetList{}
+	if err := t.Client.List(ctx, targets); err != nil {
+		return nil, err
+	}
+	policies := make(map[string]*loggingv1beta1.EnforcementPolicy)
+	for i := range targets.Items {
+		target := &targets.Items[i]
+		if target.Spec.Enforcement == nil || !target.DeletionTimestamp.IsZero() || validateTarget(target) != nil {
+			continue
+		}
+		selected, err := t.selects(ctx, target, obj)
+		if err != nil {
+			return nil, err
+		}
+		if selected {
+			policies[target.Name] = target.Spec.Enforcement
+		}
+	}
+	return policies, nil
+}
+
+// targetSelectors returns the rule and namespace selectors of the target, which select everything when empty
+func targetSelectors(target *loggingv1beta1.LokiRulerTarget) (labels.Selector, labels.Selector, error) {
+	ruleSelector := labels.Everything()
+	namespaceSelector := labels.Everything()
+	var err error
+	if target.Spec.RuleSelector != nil {
+		if ruleSelector, err = metav1.LabelSelectorAsSelector(target.Spec.RuleSelector); err != nil {
+			return nil, nil, fmt.Errorf("invalid ruleSelector: %w", err)
+		}
+	}
+	if target.Spec.NamespaceSelector != nil {
+		if namespaceSelector, err = metav1.LabelSelectorAsSelector(target.Spec.NamespaceSelector); err != nil {
+			return nil, nil, fmt.Errorf("invalid namespaceSelector: %w", err)
+		}
+	}
+	return ruleSelector, namespaceSelector, nil
+}
+
+// validateTarget returns an error if the target can't be used
+func validateTarget(target *loggingv1beta1.LokiRulerTarget) error {
+	spec := target.Spec
+	switch {
+	case spec.ConfigMap == nil && spec.Ruler == nil:
+		return fmt.Errorf("either configMap or ruler must be set")
+	case spec.ConfigMap != nil && spec.Ruler != nil:
+		return fmt.Errorf("only one of configMap and ruler can be set")
+	case spec.ConfigMap != nil && (spec.ConfigMap.Namespace == "" || spec.ConfigMap.Name == ""):
+		return fmt.Errorf("configMap requires a namespace and a name")
+	case spec.Ruler != nil && spec.Ruler.URL == "":
+		return fmt.Errorf("ruler requires a url")
+	}
+	if spec.Enforcement != nil {
+		for _, label := range spec.Enforcement.ExtraLabels {
+			if (label.FromLabel == "") == (label.FromAnnotation == "") {
+				return fmt.Errorf("exactly one of fromLabel and fromAnnotation must be set for label '%s'", label.Name)
+			}
+		}
+	}
+	_, _, err := targetSelectors(target)
+	return err
+}
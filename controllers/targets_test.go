@@ -0,0 +1,272 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+)
+
+func TestRuleTargetsSync(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := loggingv1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	prod := &v1.Namespace{}
+	prod.Name, prod.Labels = "prod", map[string]string{"env": "production"}
+	staging := &loggingv1beta1.LokiRulerTarget{}
+	staging.Name = "staging"
+	staging.Spec = loggingv1beta1.LokiRulerTargetSpec{
+		ConfigMap:      &loggingv1beta1.ConfigMapTarget{Namespace: "loki-staging", Name: "loki-rules"},
+		Tenant:         "staging",
+		RuleSelector:   &metav1.LabelSelector{MatchLabels: map[string]string{"staging": "true"}},
+		ExternalLabels: map[string]string{"cluster": "staging"},
+	}
+	production := &loggingv1beta1.LokiRulerTarget{}
+	production.Name = "production"
+	production.Spec = loggingv1beta1.LokiRulerTargetSpec{
+		ConfigMap:         &loggingv1beta1.ConfigMapTarget{Namespace: "loki-production", Name: "loki-rules"},
+		NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"env": "production"}},
+	}
+	invalid := &loggingv1beta1.LokiRulerTarget{}
+	invalid.Name = "invalid"
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(prod, staging, production, invalid).Build()
+
+	clientset := k8sfake.NewSimpleClientset()
+	targets := NewRuleTargets(c, clientset, &TenantResolver{Client: c, DefaultTenant: "fake"}, logf.Log)
+	targets.Debounce = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = targets.Start(ctx)
+	}()
+
+	lokiRule := &loggingv1beta1.LokiRule{}
+	lokiRule.Name, lokiRule.Namespace, lokiRule.Labels = "nginx", "prod", map[string]string{"staging": "true"}
+	groups := testGroups("nginx")
+
+	statuses, err := targets.Sync(ctx, lokiRule, "prod-nginx", "", (&LabelPolicy{}).Renderer(staticRules(groups), LabelSource{Name: "nginx", Namespace: prod}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []loggingv1beta1.RuleTargetStatus{
+		{Name: "production", Tenant: "fake", ConfigMap: "loki-rules", Key: "prod-nginx.yaml"},
+		{Name: "staging", Tenant: "staging", ConfigMap: "loki-rules", Key: "prod-nginx.yaml"},
+	}
+	if len(statuses) != len(expected) {
+		t.Fatalf("expected %d targets, got %+v", len(expected), statuses)
+	}
+	for i := range expected {
+		expected[i].Hash = statuses[i].Hash
+		if statuses[i] != expected[i] || statuses[i].Hash == "" {
+			t.Fatalf("expected %+v, got %+v", expected[i], statuses[i])
+		}
+	}
+	if groups[0].Rules[0].Labels != nil {
+		t.Fatal("expected the groups of the rule to be left as is")
+	}
+
+	cm, err := clientset.CoreV1().ConfigMaps("loki-staging").Get(ctx, "loki-rules", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := cm.Data["prod-nginx.yaml"]; !strings.Contains(data, "cluster: staging") {
+		t.Fatalf("expected the external labels of the target, got %q", data)
+	}
+	cm, err = clientset.CoreV1().ConfigMaps("loki-production").Get(ctx, "loki-rules", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := cm.Data["prod-nginx.yaml"]; data == "" || strings.Contains(data, "cluster:") {
+		t.Fatalf("expected the rules without external labels, got %q", data)
+	}
+
+	// No longer selected by the staging target
+	lokiRule.Labels = nil
+	statuses, err = targets.Sync(ctx, lokiRule, "prod-nginx", "", (&LabelPolicy{}).Renderer(staticRules(groups), LabelSource{Name: "nginx", Namespace: prod}), statuses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || statuses[0].Name != "production" {
+		t.Fatalf("expected only the production target, got %+v", statuses)
+	}
+	cm, err = clientset.CoreV1().ConfigMaps("loki-staging").Get(ctx, "loki-rules", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cm.Data["prod-nginx.yaml"]; ok {
+		t.Fatal("expected the rules to be removed from the staging target")
+	}
+
+	if err := targets.Cleanup(ctx, "prod-nginx", statuses); err != nil {
+		t.Fatal(err)
+	}
+	cm, err = clientset.CoreV1().ConfigMaps("loki-production").Get(ctx, "loki-rules", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cm.Data["prod-nginx.yaml"]; ok {
+		t.Fatal("expected the rules to be removed from the production target")
+	}
+}
+
+// targetTest stores the rules of a LokiRule in a ConfigMap target
+type targetTest struct {
+	t          *testing.T
+	ctx        context.Context
+	c          client.Client
+	clientset  *k8sfake.Clientset
+	targets    *RuleTargets
+	reconciler *LokiRulerTargetReconciler
+	lokiRule   *loggingv1beta1.LokiRule
+}
+
+func newTargetTest(t *testing.T, ctx context.Context) *targetTest {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := loggingv1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	prod := &v1.Namespace{}
+	prod.Name = "prod"
+	target := &loggingv1beta1.LokiRulerTarget{}
+	target.Name = "staging"
+	target.Spec.ConfigMap = &loggingv1beta1.ConfigMapTarget{Namespace: "loki-a", Name: "loki-rules"}
+	lokiRule := &loggingv1beta1.LokiRule{}
+	lokiRule.Name, lokiRule.Namespace = "nginx", "prod"
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(prod, target, lokiRule).Build()
+
+	clientset := k8sfake.NewSimpleClientset()
+	targets := NewRuleTargets(c, clientset, &TenantResolver{Client: c, DefaultTenant: "fake"}, logf.Log)
+	targets.Debounce = 0
+	go func() {
+		_ = targets.Start(ctx)
+	}()
+	reconciler := &LokiRulerTargetReconciler{Client: c, Log: logf.Log, Scheme: scheme, Targets: targets}
+	return &targetTest{t: t, ctx: ctx, c: c, clientset: clientset, targets: targets, reconciler: reconciler, lokiRule: lokiRule}
+}
+
+// sync stores the rules of the LokiRule in the target, like the LokiRule controller does
+func (tt *targetTest) sync() {
+	if err := tt.c.Get(tt.ctx, client.ObjectKeyFromObject(tt.lokiRule), tt.lokiRule); err != nil {
+		tt.t.Fatal(err)
+	}
+	statuses, err := tt.targets.Sync(tt.ctx, tt.lokiRule, RuleName(tt.lokiRule), "", staticRules(testGroups("nginx")), tt.lokiRule.Status.Targets)
+	if err != nil {
+		tt.t.Fatal(err)
+	}
+	tt.lokiRule.Status.Targets = statuses
+	if err := tt.c.Status().Update(tt.ctx, tt.lokiRule); err != nil {
+		tt.t.Fatal(err)
+	}
+}
+
+func (tt *targetTest) reconcile() {
+	if _, err := tt.reconciler.Reconcile(tt.ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "staging"}}); err != nil {
+		tt.t.Fatal(err)
+	}
+}
+
+func (tt *targetTest) target() *loggingv1beta1.LokiRulerTarget {
+	target := &loggingv1beta1.LokiRulerTarget{}
+	if err := tt.c.Get(tt.ctx, types.NamespacedName{Name: "staging"}, target); err != nil {
+		tt.t.Fatal(err)
+	}
+	return target
+}
+
+// expectStored checks whether the rules file is in the ConfigMap of the namespace
+func (tt *targetTest) expectStored(namespace string, stored bool) {
+	cm, err := tt.clientset.CoreV1().ConfigMaps(namespace).Get(tt.ctx, "loki-rules", metav1.GetOptions{})
+	if errors.IsNotFound(err) && !stored {
+		return
+	} else if err != nil {
+		tt.t.Fatal(err)
+	}
+	if _, ok := cm.Data[RuleName(tt.lokiRule)+ruleFileExtension]; ok != stored {
+		tt.t.Fatalf("expected the rules to be stored in %s: %v, got %v", namespace, stored, cm.Data)
+	}
+}
+
+// When the destination of a target changes, the rules are removed from the previous destination
+func TestLokiRulerTargetDestinationChange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tt := newTargetTest(t, ctx)
+
+	tt.reconcile()
+	tt.sync()
+	tt.expectStored("loki-a", true)
+
+	target := tt.target()
+	if target.Status.Destination == nil || target.Status.Destination.ConfigMap.Namespace != "loki-a" {
+		t.Fatalf("expected the destination in the status, got %+v", target.Status.Destination)
+	}
+	target.Spec.ConfigMap = &loggingv1beta1.ConfigMapTarget{Namespace: "loki-b", Name: "loki-rules"}
+	if err := tt.c.Update(ctx, target); err != nil {
+		t.Fatal(err)
+	}
+
+	// The rules are synced to the new destination before the target is reconciled
+	tt.sync()
+	tt.expectStored("loki-b", true)
+	tt.expectStored("loki-a", true)
+	tt.reconcile()
+	tt.expectStored("loki-a", false)
+	tt.expectStored("loki-b", true)
+	if destination := tt.target().Status.Destination; destination == nil || destination.ConfigMap.Namespace != "loki-b" {
+		t.Fatalf("expected the new destination in the status, got %+v", destination)
+	}
+}
+
+// Deleting a target removes the rules from its destination
+func TestLokiRulerTargetDeletion(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tt := newTargetTest(t, ctx)
+
+	tt.reconcile()
+	tt.sync()
+	tt.expectStored("loki-a", true)
+
+	target := tt.target()
+	if !controllerutil.ContainsFinalizer(target, Finalizer) {
+		t.Fatalf("expected the finalizer, got %v", target.Finalizers)
+	}
+	now := metav1.Now()
+	target.DeletionTimestamp = &now
+	if err := tt.c.Update(ctx, target); err != nil {
+		t.Fatal(err)
+	}
+
+	// The rules stay in the status of the rule until the target is gone
+	tt.sync()
+	if len(tt.lokiRule.Status.Targets) != 1 {
+		t.Fatalf("expected the target to be kept in the status, got %+v", tt.lokiRule.Status.Targets)
+	}
+	tt.reconcile()
+	tt.expectStored("loki-a", false)
+	if target := tt.target(); len(target.Finalizers) != 0 {
+		t.Fatalf("expected the finalizer to be removed, got %v", target.Finalizers)
+	}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	goerrors "errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// TenantKey is the annotation or label on a Namespace that selects the tenant
+// of the LokiRules in that namespace
+const TenantKey = "logging.opsgy.com/tenant"
+
+// InvalidTenantError is returned when a rule targets a tenant it is not allowed to use
+type InvalidTenantError struct {
+	msg string
+}
+
+func (e *InvalidTenantError) Error() string {
+	return e.msg
+}
+
+// IsInvalidTenant returns true if the error is an InvalidTenantError
+func IsInvalidTenant(err error) bool {
+	var invalidTenant *InvalidTenantError
+	return goerrors.As(err, &invalidTenant)
+}
+
+// TenantResolver determines the Loki tenant (X-Scope-OrgID) of a rule
+type TenantResolver struct {
+	Client        client.Client
+	DefaultTenant string
+	// AllowedNamespaces restricts which namespaces may target a tenant.
+	// Tenants without an entry can be targeted from every namespace.
+	AllowedNamespaces map[string][]*regexp.Regexp
+}
+
+// Resolve returns the tenant of a rule in the given namespace, which is in order of preference:
+// the tenant in the spec, the tenant annotation or label of the namespace, or the default tenant.
+// Cluster scoped rules pass an empty namespace and are not restricted.
+func (t *TenantResolver) Resolve(ctx context.Context, namespace string, specTenant string) (string, error) {
+	return t.ResolveDefault(ctx, namespace, specTenant, t.DefaultTenant)
+}
+
+// ResolveDefault is like Resolve, but falls back to the given default tenant
+func (t *TenantResolver) ResolveDefault(ctx context.Context, namespace string, specTenant string, defaultTenant string) (string, error) {
+	tenant := specTenant
+	if tenant == "" && namespace != "" {
+		ns := &v1.Namespace{}
+		if err := t.Client.Get(ctx, types.NamespacedName{Name: namespace}, ns); err != nil {
+			return "", err
+		}
+		if value, ok := ns.Annotations[TenantKey]; ok {
+			tenant = value
+		} else if value, ok := ns.Labels[TenantKey]; ok {
+			tenant = value
+		}
+	}
+	if tenant == "" {
+		tenant = defaultTenant
+	}
+
+	if errs := validation.IsDNS1123Label(tenant); len(errs) > 0 {
+		return "", &InvalidTenantError{fmt.Sprintf("invalid tenant '%s': %s", tenant, strings.Join(errs, ", "))}
+	}
+
+	if namespace == "" {
+		return tenant, nil
+	}
+	allowed, restricted := t.AllowedNamespaces[tenant]
+	if !restricted {
+		return tenant, nil
+	}
+	for _, re := range allowed {
+		if re.MatchString(namespace) {
+			return tenant, nil
+		}
+	}
+	return "", &InvalidTenantError{fmt.Sprintf("namespace '%s' is not allowed to use tenant '%s'", namespace, tenant)}
+}
@@ -0,0 +1,153 @@
+package controllers
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+)
+
+func tenantNamespace(name string, annotation string, label string) *v1.Namespace {
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{}, Annotations: map[string]string{}}}
+	if annotation != "" {
+		ns.Annotations[TenantKey] = annotation
+	}
+	if label != "" {
+		ns.Labels[TenantKey] = label
+	}
+	return ns
+}
+
+func TestTenantResolver(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		tenantNamespace("annotated", "team-a", "team-b"),
+		tenantNamespace("labeled", "", "team-b"),
+		tenantNamespace("plain", "", ""),
+		tenantNamespace("invalid", "Team_A", ""),
+		tenantNamespace("ops", "ops", ""),
+	).Build()
+	resolver := &TenantResolver{
+		Client:            c,
+		DefaultTenant:     "fake",
+		AllowedNamespaces: map[string][]*regexp.Regexp{"ops": {regexp.MustCompile("^(?:ops|monitoring)$")}},
+	}
+
+	tests := []struct {
+		name       string
+		namespace  string
+		specTenant string
+		tenant     string
+		invalid    bool
+	}{
+		{name: "spec before annotation", namespace: "annotated", specTenant: "team-c", tenant: "team-c"},
+		{name: "annotation before label", namespace: "annotated", tenant: "team-a"},
+		{name: "label", namespace: "labeled", tenant: "team-b"},
+		{name: "default", namespace: "plain", tenant: "fake"},
+		{name: "cluster scoped", specTenant: "ops", tenant: "ops"},
+		{name: "cluster scoped default", tenant: "fake"},
+		{name: "allowed namespace", namespace: "ops", tenant: "ops"},
+		{name: "allowed namespace in spec", namespace: "plain", specTenant: "ops", invalid: true},
+		{name: "invalid tenant", namespace: "invalid", invalid: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tenant, err := resolver.Resolve(context.Background(), test.namespace, test.specTenant)
+			if test.invalid {
+				if !IsInvalidTenant(err) {
+					t.Fatalf("expected an invalid tenant, got %q, %v", tenant, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tenant != test.tenant {
+				t.Fatalf("expected tenant %s, got %s", test.tenant, tenant)
+			}
+		})
+	}
+
+	if _, err := resolver.Resolve(context.Background(), "missing", ""); err == nil || IsInvalidTenant(err) {
+		t.Fatalf("expected the namespace not to be found, got %v", err)
+	}
+	if tenant, err := resolver.ResolveDefault(context.Background(), "plain", "", "target"); err != nil || tenant != "target" {
+		t.Fatalf("expected the default of the target, got %q, %v", tenant, err)
+	}
+}
+
+// When a namespace is no longer allowed to use its tenant, the rules it stored for the tenant are removed
+func TestInvalidTenantRemovesRules(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := loggingv1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	lokiRule := &loggingv1beta1.LokiRule{
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "prod"},
+		Spec: loggingv1beta1.LokiRuleSpec{Groups: []*loggingv1beta1.LokiRuleGroup{{
+			Name:  "nginx",
+			Rules: []*loggingv1beta1.LokiGroupRule{{Alert: "NginxErrors", Expr: `count_over_time({app="nginx"}[5m]) > 0`}},
+		}}},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(tenantNamespace("prod", "ops", ""), lokiRule).Build()
+	clientset := k8sfake.NewSimpleClientset(rulesConfigMap("loki-rules", ""))
+	sink := &ConfigMapSink{Clientset: clientset, Name: "loki-rules", Namespace: "loki", DefaultTenant: "fake", MaxSize: DefaultConfigMapMaxSize, MaxShards: 1}
+	tenants := &TenantResolver{Client: c, DefaultTenant: "fake", AllowedNamespaces: map[string][]*regexp.Regexp{}}
+	reconciler := &LokiRuleReconciler{
+		Client:   c,
+		Log:      logf.Log,
+		Scheme:   scheme,
+		Sink:     sink,
+		Tenants:  tenants,
+		Recorder: &record.FakeRecorder{},
+	}
+	ctx := context.Background()
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(lokiRule)}
+
+	if _, err := reconciler.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	files, err := sink.ListFiles(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Tenant != "ops" {
+		t.Fatalf("expected the rules to be stored for tenant ops, got %v", files)
+	}
+
+	tenants.AllowedNamespaces["ops"] = []*regexp.Regexp{regexp.MustCompile("^ops$")}
+	if _, err := reconciler.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if files, err = sink.ListFiles(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("expected the rules to be removed, got %v", files)
+	}
+	got := &loggingv1beta1.LokiRule{}
+	if err := c.Get(ctx, req.NamespacedName, got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status.Valid || got.Status.Tenant != "" || got.Status.Key != "" {
+		t.Fatalf("expected an invalid rule without a location, got %+v", got.Status)
+	}
+}
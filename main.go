@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -30,48 +31,24 @@ import (
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
 	v1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 
 	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+	"github.com/opsgy/loki-rule-operator/cmd"
 	"github.com/opsgy/loki-rule-operator/controllers"
+	"github.com/opsgy/loki-rule-operator/pkg/ruler"
 	// +kubebuilder:scaffold:imports
 )
 
-// Created so that multiple inputs can be accecpted
-type labelFlags []controllers.Label
-
-func (l *labelFlags) String() string {
-	str := ""
-	for i, label := range *l {
-		if i > 0 {
-			str += ","
-		}
-		str += label.Name + "=" + label.Value
-	}
-	// change this, this is just can example to satisfy the interface
-	return str
-}
-
-func (l *labelFlags) Set(value string) error {
-	pair := strings.Split(value, "=")
-	if len(pair) != 2 {
-		return fmt.Errorf("invalid label, should be in the format <key>=<value>")
-	}
-	label := controllers.Label{
-		Name:  strings.TrimSpace(pair[0]),
-		Value: strings.TrimSpace(pair[1]),
-	}
-	*l = append(*l, label)
-	return nil
-}
-
 var (
 	scheme   = runtime.NewScheme()
 	setupLog = ctrl.Log.WithName("setup")
@@ -85,20 +62,49 @@ func init() {
 }
 
 func main() {
+	// Subcommands, e.g. 'convert', run without a cluster
+	if len(os.Args) > 1 {
+		if command, ok := cmd.Commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+		}
+	}
+
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
-	var rulesCM string
+	var sinkType string
+	var rulerURL string
+	var syncPeriod time.Duration
+	ruleFlags := &cmd.RuleFlags{}
 	var enableWebhook bool
-	var externalLabels labelFlags
+	var removeFinalizers bool
+	var orphanSweepInterval time.Duration
+	var orphanSweepDryRun bool
+	var ruleStoreDebounce time.Duration
+	var maxConcurrentReconciles int
+	var watchNamespaces string
+	var namespaceSelector string
+	var ruleSelector string
+	var instance string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
-	flag.StringVar(&rulesCM, "rules-configmap", "default/loki-rules", "Configmap name to store all the LokiRules, in the format '<namespace>/<name>'")
+	flag.StringVar(&sinkType, "sink", "configmap", "Where to store the rules, either 'configmap' (see --rules-configmap), 'ruler' (see --ruler-url) or 'none' to only store them in LokiRulerTargets")
+	flag.StringVar(&rulerURL, "ruler-url", "", "URL of the Loki ruler, e.g. 'http://loki:3100'. Used when --sink=ruler")
+	flag.DurationVar(&syncPeriod, "sync-period", 10*time.Hour, "Minimum frequency at which all the rules are reconciled, which also reverts drift in the Loki ruler")
 	flag.BoolVar(&enableWebhook, "enable-webhook", false, "Enable validation webhook")
-	flag.Var(&externalLabels, "external-label", "Add labels to the alert rules")
+	flag.DurationVar(&ruleStoreDebounce, "rules-configmap-debounce", controllers.DefaultRuleStoreDebounce, "How long changes to the rules are collected before they are written to the rules ConfigMaps at once")
+	flag.IntVar(&maxConcurrentReconciles, "max-concurrent-reconciles", 50, "Maximum number of concurrent reconciles per controller. Most reconciles wait for their changes to be written in a batch")
+	flag.DurationVar(&orphanSweepInterval, "orphan-sweep-interval", time.Hour, "Interval at which rules files without a LokiRule or GlobalLokiRule are removed from the rules ConfigMaps, 0 disables the sweep. Used when --sink=configmap")
+	flag.BoolVar(&orphanSweepDryRun, "orphan-sweep-dry-run", false, "Only log and count the rules files without a LokiRule or GlobalLokiRule, instead of removing them")
+	flag.StringVar(&watchNamespaces, "watch-namespaces", "", "Comma separated list of namespaces to watch LokiRules in, defaults to all namespaces")
+	flag.StringVar(&namespaceSelector, "namespace-selector", "", "Label selector of the namespaces to select LokiRules in, e.g. 'loki=main'. Unlike --watch-namespaces it doesn't restrict what is cached, the LokiRules of namespaces that are relabeled out of the selector must still be seen to remove their rules")
+	flag.StringVar(&ruleSelector, "rule-selector", "", "Label selector of the LokiRules and GlobalLokiRules to manage, e.g. 'loki=main'. Rules that are no longer selected are removed, so all the rules are cached to see them leave the selector")
+	flag.StringVar(&instance, "instance", "", "Name of this instance of the operator, used in the name of its finalizer. Required when multiple instances manage different rules")
+	flag.BoolVar(&removeFinalizers, "remove-finalizers", false, "Remove the finalizer of the instance from all LokiRules and GlobalLokiRules and exit, without removing their rules. Used when uninstalling the operator")
+	ruleFlags.Bind(flag.CommandLine)
 	opts := zap.Options{
 		Development: true,
 	}
@@ -109,69 +115,137 @@ func main() {
 
 	config := ctrl.GetConfigOrDie()
 
-	mgr, err := ctrl.NewManager(config, ctrl.Options{
+	if err := controllers.ValidateInstance(instance); err != nil {
+		setupLog.Error(err, "invalid value for --instance")
+		os.Exit(1)
+	}
+
+	if removeFinalizers {
+		c, err := client.New(config, client.Options{Scheme: scheme})
+		if err != nil {
+			setupLog.Error(err, "unable to create client")
+			os.Exit(1)
+		}
+		removed, err := controllers.RemoveFinalizers(context.Background(), c, controllers.InstanceFinalizer(instance))
+		if err != nil {
+			setupLog.Error(err, "unable to remove finalizers")
+			os.Exit(1)
+		}
+		setupLog.Info("removed finalizers", "count", removed)
+		return
+	}
+
+	enforcement := ruleFlags.Enforcement()
+	labelPolicy, err := ruleFlags.Labels()
+	if err != nil {
+		setupLog.Error(err, "invalid labels")
+		os.Exit(1)
+	}
+
+	scope, err := parseScope(watchNamespaces, namespaceSelector, ruleSelector)
+	if err != nil {
+		setupLog.Error(err, "invalid scope")
+		os.Exit(1)
+	}
+	scope.Instance = instance
+
+	options := ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
 		Port:                   9443,
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "934c0416.opsgy.com",
-	})
+		SyncPeriod:             &syncPeriod,
+	}
+	if len(scope.Namespaces) > 0 {
+		options.NewCache = controllers.NewScopedCache(scope.Namespaces)
+	}
+	mgr, err := ctrl.NewManager(config, options)
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
+	scope.Client = mgr.GetClient()
 
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		panic(err.Error())
-	}
-
-	rulesCMParts := strings.Split(rulesCM, "/")
-	if len(rulesCMParts) != 2 {
-		setupLog.Error(err, "invalid value for --rules-configmap")
+		setupLog.Error(err, "unable to create clientset")
 		os.Exit(1)
 	}
 
-	// Create cm if not exists
-	_, err = clientset.CoreV1().ConfigMaps(rulesCMParts[0]).Get(context.TODO(), rulesCMParts[1], metav1.GetOptions{})
-	if err != nil {
-		if errors.IsNotFound(err) {
-			labelMap := make(map[string]string)
-			labelMap["app.kubernetes.io/managed-by"] = "loki-rule-operator"
-			dataMap := make(map[string]string)
-
-			cm := &v1.ConfigMap{
-				TypeMeta: metav1.TypeMeta{
-					Kind:       "ConfigMap",
-					APIVersion: "v1",
-				},
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      rulesCMParts[1],
-					Namespace: rulesCMParts[0],
-					Labels:    labelMap,
-				},
-				Data: dataMap,
-			}
-			_, err := clientset.CoreV1().ConfigMaps(rulesCMParts[0]).Create(context.TODO(), cm, metav1.CreateOptions{})
-			if err != nil {
-				setupLog.Error(err, "Failed to create configmap")
+	var sink controllers.RuleSink
+	switch sinkType {
+	case "configmap":
+		cmSink, err := ruleFlags.ConfigMapSink(context.Background(), clientset)
+		if err != nil {
+			setupLog.Error(err, "unable to set up rules ConfigMap")
+			os.Exit(1)
+		}
+		// Rules files of the released operator are moved before the store writes the rules
+		migration := controllers.NewLegacyMigration(mgr.GetClient(), cmSink, ctrl.Log.WithName("legacy-migration"))
+		if err := mgr.Add(migration); err != nil {
+			setupLog.Error(err, "unable to set up legacy migration")
+			os.Exit(1)
+		}
+		store := controllers.NewRuleStore(cmSink, ctrl.Log.WithName("rule-store"))
+		store.Debounce = ruleStoreDebounce
+		store.Ready = migration.Done()
+		if err := mgr.Add(store); err != nil {
+			setupLog.Error(err, "unable to set up rule store")
+			os.Exit(1)
+		}
+		sink = store
+
+		if orphanSweepInterval > 0 {
+			if err := mgr.Add(&controllers.OrphanSweeper{
+				Client:   mgr.GetClient(),
+				Sink:     store,
+				Interval: orphanSweepInterval,
+				DryRun:   orphanSweepDryRun,
+				Scope:    scope,
+				Log:      ctrl.Log.WithName("orphan-sweeper"),
+			}); err != nil {
+				setupLog.Error(err, "unable to set up orphan sweeper")
 				os.Exit(1)
 			}
-		} else {
-			setupLog.Error(err, "Failed to get configmap")
+		}
+	case "ruler":
+		if rulerURL == "" {
+			setupLog.Error(fmt.Errorf("--ruler-url is required"), "invalid value for --ruler-url")
 			os.Exit(1)
 		}
+		sink = &controllers.RulerSink{Client: ruler.NewClient(rulerURL), DefaultTenant: ruleFlags.DefaultTenant}
+	case "none":
+	default:
+		setupLog.Error(fmt.Errorf("unknown sink %q", sinkType), "invalid value for --sink")
+		os.Exit(1)
+	}
+
+	tenants := ruleFlags.Tenants(mgr.GetClient())
+
+	targets := controllers.NewRuleTargets(mgr.GetClient(), clientset, tenants, ctrl.Log.WithName("targets"))
+	targets.Debounce = ruleStoreDebounce
+	if err := mgr.Add(targets); err != nil {
+		setupLog.Error(err, "unable to set up rule targets")
+		os.Exit(1)
 	}
 
+	metrics.Registry.MustRegister(controllers.NewRuleCollector(mgr.GetClient(), ctrl.Log.WithName("metrics")))
+
 	if err = (&controllers.LokiRuleReconciler{
 		Client:                  mgr.GetClient(),
 		Log:                     ctrl.Log.WithName("controllers").WithName("LokiRule"),
 		Scheme:                  mgr.GetScheme(),
-		Clientset:               clientset,
-		RulesConfigMapName:      rulesCMParts[1],
-		RulesConfigMapNamespace: rulesCMParts[0],
-		ExternalLabels:          externalLabels,
+		Sink:                    sink,
+		Tenants:                 tenants,
+		Labels:                  labelPolicy,
+		Recorder:                mgr.GetEventRecorderFor("loki-rule-operator"),
+		Scope:                   scope,
+		Enforcement:             enforcement,
+		Durations:               ruleFlags.Durations,
+		Targets:                 targets,
+		MaxConcurrentReconciles: maxConcurrentReconciles,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "LokiRule")
 		os.Exit(1)
@@ -180,19 +254,52 @@ func main() {
 		Client:                  mgr.GetClient(),
 		Log:                     ctrl.Log.WithName("controllers").WithName("GlobalLokiRule"),
 		Scheme:                  mgr.GetScheme(),
-		Clientset:               clientset,
-		RulesConfigMapName:      rulesCMParts[1],
-		RulesConfigMapNamespace: rulesCMParts[0],
-		ExternalLabels:          externalLabels,
+		Sink:                    sink,
+		Tenants:                 tenants,
+		Labels:                  labelPolicy,
+		Recorder:                mgr.GetEventRecorderFor("loki-rule-operator"),
+		Scope:                   scope,
+		Durations:               ruleFlags.Durations,
+		Targets:                 targets,
+		MaxConcurrentReconciles: maxConcurrentReconciles,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "GlobalLokiRule")
 		os.Exit(1)
 	}
+	if err = (&controllers.LokiRulerTargetReconciler{
+		Client:  mgr.GetClient(),
+		Log:     ctrl.Log.WithName("controllers").WithName("LokiRulerTarget"),
+		Scheme:  mgr.GetScheme(),
+		Targets: targets,
+		Scope:   scope,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "LokiRulerTarget")
+		os.Exit(1)
+	}
 	if enableWebhook {
-		if err = (&loggingv1beta1.LokiRule{}).SetupWebhookWithManager(mgr); err != nil {
+		validator := &loggingv1beta1.RuleValidator{
+			Enforcement: enforcement,
+			Namespace: func(name string) (*v1.Namespace, error) {
+				ns := &v1.Namespace{}
+				err := mgr.GetAPIReader().Get(context.Background(), types.NamespacedName{Name: name}, ns)
+				return ns, err
+			},
+			GrantedNamespaces: func(namespace string) ([]string, error) {
+				return controllers.GrantedNamespaces(context.Background(), mgr.GetAPIReader(), namespace)
+			},
+			TargetEnforcements: func(lokiRule *loggingv1beta1.LokiRule) (map[string]*loggingv1beta1.EnforcementPolicy, error) {
+				return targets.Enforcements(context.Background(), lokiRule)
+			},
+			Durations: ruleFlags.Durations,
+		}
+		if err = (&loggingv1beta1.LokiRule{}).SetupWebhookWithManager(mgr, validator); err != nil {
 			setupLog.Error(err, "unable to create webhook", "webhook", "LokiRule")
 			os.Exit(1)
 		}
+		if err = (&loggingv1beta1.GlobalLokiRule{}).SetupWebhookWithManager(mgr, validator); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "GlobalLokiRule")
+			os.Exit(1)
+		}
 	}
 	// +kubebuilder:scaffold:builder
 
@@ -211,3 +318,21 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// parseScope parses the flags that select the rules managed by the operator
+func parseScope(watchNamespaces string, namespaceSelector string, ruleSelector string) (*controllers.RuleScope, error) {
+	scope := &controllers.RuleScope{}
+	for _, namespace := range strings.Split(watchNamespaces, ",") {
+		if namespace = strings.TrimSpace(namespace); namespace != "" {
+			scope.Namespaces = append(scope.Namespaces, namespace)
+		}
+	}
+	var err error
+	if scope.NamespaceSelector, err = labels.Parse(namespaceSelector); err != nil {
+		return nil, fmt.Errorf("invalid value for --namespace-selector: %w", err)
+	}
+	if scope.RuleSelector, err = labels.Parse(ruleSelector); err != nil {
+		return nil, fmt.Errorf("invalid value for --rule-selector: %w", err)
+	}
+	return scope, nil
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package ruler contains a client for the rules API of the Loki ruler
+package ruler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+)
+
+const rulesPath = "/loki/api/v1/rules"
+
+// Client manages rule groups through the rules API of the Loki ruler
+type Client struct {
+	// Address is the base URL of the Loki ruler, e.g. http://loki:3100
+	Address    string
+	HTTPClient *http.Client
+	// Tenant is sent as X-Scope-OrgID, which is required when Loki runs with auth_enabled
+	Tenant string
+}
+
+// NewClient creates a Client for the Loki ruler at the given address
+func NewClient(address string) *Client {
+	return &Client{
+		Address:    strings.TrimSuffix(address, "/"),
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+// WithTenant returns a copy of the client for the given tenant
+func (c *Client) WithTenant(tenant string) *Client {
+	tenantClient := *c
+	tenantClient.Tenant = tenant
+	return &tenantClient
+}
+
+// ListRuleGroups returns the rule groups the ruler has stored in the given namespace
+func (c *Client) ListRuleGroups(ctx context.Context, namespace string) ([]*loggingv1beta1.LokiRuleGroup, error) {
+	resp, err := c.do(ctx, http.MethodGet, c.namespaceURL(namespace), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// The ruler responds with 404 when the namespace doesn't contain any rule groups
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	namespaces := make(map[string][]*loggingv1beta1.LokiRuleGroup)
+	if err := yaml.Unmarshal(body, &namespaces); err != nil {
+		return nil, fmt.Errorf("failed to decode rule groups of namespace %s: %w", namespace, err)
+	}
+	return namespaces[namespace], nil
+}
+
+// SetRuleGroup creates or replaces a rule group in the given namespace
+func (c *Client) SetRuleGroup(ctx context.Context, namespace string, group *loggingv1beta1.LokiRuleGroup) error {
+	data, err := yaml.Marshal(group)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, http.MethodPost, c.namespaceURL(namespace), data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+// DeleteRuleGroup removes a rule group from the given namespace
+func (c *Client) DeleteRuleGroup(ctx context.Context, namespace string, groupName string) error {
+	resp, err := c.do(ctx, http.MethodDelete, c.namespaceURL(namespace)+"/"+url.PathEscape(groupName), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Already gone
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return checkResponse(resp)
+}
+
+// Sync makes the rule groups stored in the namespace equal to the given groups.
+// Groups that differ from what the ruler reports are (re)created and
+// groups that are no longer desired are deleted.
+func (c *Client) Sync(ctx context.Context, namespace string, groups []*loggingv1beta1.LokiRuleGroup) error {
+	current, err := c.ListRuleGroups(ctx, namespace)
+	if err != nil {
+		return err
+	}
+	currentByName := make(map[string]*loggingv1beta1.LokiRuleGroup)
+	for _, group := range current {
+		currentByName[group.Name] = group
+	}
+
+	desired := make(map[string]bool)
+	for _, group := range groups {
+		desired[group.Name] = true
+		equal, err := equalGroups(currentByName[group.Name], group)
+		if err != nil {
+			return err
+		}
+		if equal {
+			continue
+		}
+		if err := c.SetRuleGroup(ctx, namespace, group); err != nil {
+			return err
+		}
+	}
+
+	for _, group := range current {
+		if desired[group.Name] {
+			continue
+		}
+		if err := c.DeleteRuleGroup(ctx, namespace, group.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) namespaceURL(namespace string) string {
+	return c.Address + rulesPath + "/" + url.PathEscape(namespace)
+}
+
+func (c *Client) do(ctx context.Context, method string, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/yaml")
+	}
+	if c.Tenant != "" {
+		req.Header.Set("X-Scope-OrgID", c.Tenant)
+	}
+	return c.HTTPClient.Do(req)
+}
+
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	return fmt.Errorf("%s %s: unexpected status %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+}
+
+// equalGroups compares the groups by their YAML representation, which is what
+// the ruler stores.
+func equalGroups(a *loggingv1beta1.LokiRuleGroup, b *loggingv1beta1.LokiRuleGroup) (bool, error) {
+	if a == nil || b == nil {
+		return a == b, nil
+	}
+	dataA, err := yaml.Marshal(a)
+	if err != nil {
+		return false, err
+	}
+	dataB, err := yaml.Marshal(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(dataA, dataB), nil
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ruler
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+
+	loggingv1beta1 "github.com/opsgy/loki-rule-operator/api/v1beta1"
+)
+
+// fakeRuler is an in-memory stand-in for the rules API of the Loki ruler
+type fakeRuler struct {
+	mu     sync.Mutex
+	groups map[string]map[string]*loggingv1beta1.LokiRuleGroup
+	writes int
+}
+
+func newFakeRuler() *fakeRuler {
+	return &fakeRuler{groups: make(map[string]map[string]*loggingv1beta1.LokiRuleGroup)}
+}
+
+func (f *fakeRuler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	parts := strings.Split(strings.TrimPrefix(req.URL.EscapedPath(), rulesPath+"/"), "/")
+	namespace, _ := url.PathUnescape(parts[0])
+
+	switch {
+	case req.Method == http.MethodGet && len(parts) == 1:
+		if len(f.groups[namespace]) == 0 {
+			http.Error(w, "no rule groups found", http.StatusNotFound)
+			return
+		}
+		var groups []*loggingv1beta1.LokiRuleGroup
+		for _, group := range f.groups[namespace] {
+			groups = append(groups, group)
+		}
+		data, _ := yaml.Marshal(map[string][]*loggingv1beta1.LokiRuleGroup{namespace: groups})
+		w.Write(data)
+
+	case req.Method == http.MethodPost && len(parts) == 1:
+		body, _ := ioutil.ReadAll(req.Body)
+		group := &loggingv1beta1.LokiRuleGroup{}
+		if err := yaml.Unmarshal(body, group); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if f.groups[namespace] == nil {
+			f.groups[namespace] = make(map[string]*loggingv1beta1.LokiRuleGroup)
+		}
+		f.groups[namespace][group.Name] = group
+		f.writes++
+		w.WriteHeader(http.StatusAccepted)
+
+	case req.Method == http.MethodDelete && len(parts) == 2:
+		groupName, _ := url.PathUnescape(parts[1])
+		if _, ok := f.groups[namespace][groupName]; !ok {
+			http.Error(w, "no rule groups found", http.StatusNotFound)
+			return
+		}
+		delete(f.groups[namespace], groupName)
+		f.writes++
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func newGroup(name string, expr string) *loggingv1beta1.LokiRuleGroup {
+	return &loggingv1beta1.LokiRuleGroup{
+		Name: name,
+		Rules: []*loggingv1beta1.LokiGroupRule{{
+			Alert: "test",
+			Expr:  expr,
+		}},
+	}
+}
+
+func TestSync(t *testing.T) {
+	fake := newFakeRuler()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := NewClient(server.URL)
+	ctx := context.Background()
+	namespace := "prod-credentials-leak"
+
+	// Create
+	groups := []*loggingv1beta1.LokiRuleGroup{
+		newGroup("a", `count_over_time({namespace="prod"}[5m]) > 0`),
+		newGroup("b", `count_over_time({namespace="prod"}[1m]) > 0`),
+	}
+	if err := client.Sync(ctx, namespace, groups); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.groups[namespace]) != 2 || fake.writes != 2 {
+		t.Fatalf("expected 2 groups and 2 writes, got %d groups and %d writes", len(fake.groups[namespace]), fake.writes)
+	}
+
+	// Nothing changed, nothing should be written
+	if err := client.Sync(ctx, namespace, groups); err != nil {
+		t.Fatal(err)
+	}
+	if fake.writes != 2 {
+		t.Fatalf("expected no writes for unchanged groups, got %d", fake.writes-2)
+	}
+
+	// Update a group and drop the other
+	groups = []*loggingv1beta1.LokiRuleGroup{
+		newGroup("a", `count_over_time({namespace="prod"}[10m]) > 0`),
+	}
+	if err := client.Sync(ctx, namespace, groups); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.groups[namespace]["b"]; ok {
+		t.Fatal("expected group b to be deleted")
+	}
+	if expr := fake.groups[namespace]["a"].Rules[0].Expr; expr != groups[0].Rules[0].Expr {
+		t.Fatalf("expected group a to be updated, got expression %s", expr)
+	}
+
+	// Drift made outside of the operator is reverted
+	fake.groups[namespace]["a"].Rules[0].Expr = `count_over_time({namespace="dev"}[10m]) > 0`
+	if err := client.Sync(ctx, namespace, groups); err != nil {
+		t.Fatal(err)
+	}
+	if expr := fake.groups[namespace]["a"].Rules[0].Expr; expr != groups[0].Rules[0].Expr {
+		t.Fatalf("expected drift to be reverted, got expression %s", expr)
+	}
+
+	// Delete everything
+	if err := client.Sync(ctx, namespace, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.groups[namespace]) != 0 {
+		t.Fatalf("expected all groups to be deleted, got %d", len(fake.groups[namespace]))
+	}
+}
+
+func TestListRuleGroupsError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "ruler not ready", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	_, err := NewClient(server.URL).ListRuleGroups(context.Background(), "prod-credentials-leak")
+	if err == nil || !strings.Contains(err.Error(), "ruler not ready") {
+		t.Fatalf("expected error containing the ruler response, got %v", err)
+	}
+}